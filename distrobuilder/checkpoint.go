@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	incus "github.com/lxc/incus/v7/shared/util"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+// Build stages after which a checkpoint is saved, in build order.
+const (
+	checkpointUnpack = iota
+	checkpointRepositories
+	checkpointPackages
+	checkpointGenerators
+)
+
+var checkpointStages = []string{"post-unpack", "post-repositories", "post-packages", "post-generators"}
+
+// checkpointCacheDirs are the cache directories generators write to.
+var checkpointCacheDirs = []string{"metadata", "templates"}
+
+// checkpointHashes returns the hash of each build stage. Each hash covers the
+// parts of the definition consumed up to and including that stage.
+func checkpointHashes(def shared.Definition, builder string, imageTargets shared.ImageTarget) ([]string, error) {
+	// These fields change between builds without affecting the rootfs.
+	img := def.Image
+	img.Description = ""
+	img.Expiry = ""
+	img.Name = ""
+	img.Serial = ""
+
+	stages := []any{
+		struct {
+			Image     shared.DefinitionImage
+			Source    shared.DefinitionSource
+			Variables map[string]string
+			Actions   []shared.DefinitionAction
+		}{img, def.Source, def.GetVariables(), def.GetRunnableActions("pre-unpack", imageTargets)},
+		struct {
+			ImageTargets  shared.ImageTarget
+			Type          shared.DefinitionFilterType
+			Manager       string
+			CustomManager *shared.DefinitionPackagesCustomManager
+			Repositories  []shared.DefinitionPackagesRepository
+			Environment   shared.DefinitionEnv
+			Mappings      shared.DefinitionMappings
+			Actions       []shared.DefinitionAction
+			Mounts        []shared.DefinitionMount
+		}{imageTargets, def.Targets.Type, def.Packages.Manager, def.Packages.CustomManager, def.Packages.Repositories, def.Environment, def.Mappings, def.GetRunnableActions("post-unpack", imageTargets), slices.Concat(def.GetMounts("", imageTargets), def.GetMounts("post-unpack", imageTargets))},
+		struct {
+			Packages shared.DefinitionPackages
+			Actions  []shared.DefinitionAction
+			Mounts   []shared.DefinitionMount
+		}{def.Packages, def.GetRunnableActions("post-packages", imageTargets), slices.Concat(def.GetMounts("post-update", imageTargets), def.GetMounts("post-packages", imageTargets))},
+		struct {
+			Builder string
+			Files   []shared.DefinitionFile
+			Targets shared.DefinitionTarget
+		}{builder, def.Files, def.Targets},
+	}
+
+	hashes := make([]string, 0, len(stages))
+	previous := ""
+
+	for _, stage := range stages {
+		data, err := yaml.Marshal(stage)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal definition: %w", err)
+		}
+
+		hash := sha256.New()
+		hash.Write([]byte(previous))
+		hash.Write(data)
+
+		previous = fmt.Sprintf("%x", hash.Sum(nil))
+		hashes = append(hashes, previous)
+	}
+
+	return hashes, nil
+}
+
+func (c *cmdGlobal) checkpointDir(stage int) string {
+	return filepath.Join(c.flagCacheDir, "checkpoints", checkpointStages[stage])
+}
+
+// setupCheckpoints computes the checkpoint hashes of the build. If resuming, it
+// also looks for the latest valid checkpoint.
+func (c *cmdGlobal) setupCheckpoints(builder string, imageTargets shared.ImageTarget) error {
+	c.checkpointHashes = nil
+	c.resumeStage = -1
+
+	if !c.flagCheckpoint {
+		return nil
+	}
+
+	hashes, err := checkpointHashes(*c.definition, builder, imageTargets)
+	if err != nil {
+		return fmt.Errorf("Failed to compute checkpoint hashes: %w", err)
+	}
+
+	c.checkpointHashes = hashes
+
+	if !c.flagResume {
+		return nil
+	}
+
+	for stage := len(hashes) - 1; stage >= 0; stage-- {
+		hash, err := os.ReadFile(filepath.Join(c.checkpointDir(stage), "hash"))
+		if err != nil || string(hash) != hashes[stage] {
+			continue
+		}
+
+		c.logger.WithField("stage", checkpointStages[stage]).Info("Resuming from checkpoint")
+		c.resumeStage = stage
+
+		return nil
+	}
+
+	c.logger.Info("No valid checkpoint found")
+
+	return nil
+}
+
+// resumed returns whether the given stage is covered by the checkpoint the
+// build is resumed from.
+func (c *cmdGlobal) resumed(stage int) bool {
+	return c.flagResume && c.resumeStage >= stage
+}
+
+// saveCheckpoint saves the rootfs as checkpoint of the given stage. If
+// metadata is set, it's stored alongside the rootfs.
+func (c *cmdGlobal) saveCheckpoint(stage int, rootfs string, metadata any) error {
+	if !c.flagCheckpoint {
+		return nil
+	}
+
+	c.logger.WithField("stage", checkpointStages[stage]).Info("Saving checkpoint")
+
+	// Checkpoints of this and later stages are outdated now.
+	for i := stage; i < len(checkpointStages); i++ {
+		err := os.RemoveAll(c.checkpointDir(i))
+		if err != nil {
+			return fmt.Errorf("Failed to remove checkpoint %q: %w", checkpointStages[i], err)
+		}
+	}
+
+	dir := c.checkpointDir(stage)
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", dir, err)
+	}
+
+	args := []string{"-aHASX", "--devices"}
+
+	// Hard link unchanged files to the previous checkpoint to save space.
+	if stage > 0 && incus.PathExists(filepath.Join(c.checkpointDir(stage-1), "rootfs")) {
+		linkDest, err := filepath.Abs(filepath.Join(c.checkpointDir(stage-1), "rootfs"))
+		if err != nil {
+			return fmt.Errorf("Failed to get absolute path: %w", err)
+		}
+
+		args = append(args, "--link-dest", linkDest)
+	}
+
+	args = append(args, rootfs+"/", filepath.Join(dir, "rootfs"))
+
+	err = shared.RunCommand(c.ctx, nil, nil, "rsync", args...)
+	if err != nil {
+		return fmt.Errorf("Failed to copy %q to %q: %w", rootfs, dir, err)
+	}
+
+	if stage == checkpointGenerators {
+		for _, name := range checkpointCacheDirs {
+			if !incus.PathExists(filepath.Join(c.flagCacheDir, name)) {
+				continue
+			}
+
+			err := shared.RsyncLocal(c.ctx, filepath.Join(c.flagCacheDir, name)+"/", filepath.Join(dir, "cache", name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if metadata != nil {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal metadata: %w", err)
+		}
+
+		err = os.WriteFile(filepath.Join(dir, "metadata.json"), data, 0o644)
+		if err != nil {
+			return fmt.Errorf("Failed to write metadata: %w", err)
+		}
+	}
+
+	// The hash is written last so that incomplete checkpoints are never used.
+	err = os.WriteFile(filepath.Join(dir, "hash"), []byte(c.checkpointHashes[stage]), 0o644)
+	if err != nil {
+		return fmt.Errorf("Failed to write checkpoint hash: %w", err)
+	}
+
+	return nil
+}
+
+// restoreCheckpoint restores the rootfs and cache of the checkpoint the build
+// is resumed from.
+func (c *cmdGlobal) restoreCheckpoint(rootfs string) error {
+	dir := c.checkpointDir(c.resumeStage)
+
+	c.logger.WithField("stage", checkpointStages[c.resumeStage]).Info("Restoring checkpoint")
+
+	err := shared.RsyncLocal(c.ctx, filepath.Join(dir, "rootfs")+"/", rootfs)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range checkpointCacheDirs {
+		if !incus.PathExists(filepath.Join(dir, "cache", name)) {
+			continue
+		}
+
+		err := shared.RsyncLocal(c.ctx, filepath.Join(dir, "cache", name)+"/", filepath.Join(c.flagCacheDir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadCheckpointMetadata loads the metadata stored with the checkpoint of the
+// given stage.
+func (c *cmdGlobal) loadCheckpointMetadata(stage int, metadata any) error {
+	data, err := os.ReadFile(filepath.Join(c.checkpointDir(stage), "metadata.json"))
+	if err != nil {
+		return fmt.Errorf("Failed to read checkpoint metadata: %w", err)
+	}
+
+	err = json.Unmarshal(data, metadata)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal checkpoint metadata: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+func TestCheckpointHashes(t *testing.T) {
+	def := shared.Definition{
+		Image: shared.DefinitionImage{
+			Distribution: "ubuntu",
+			Release:      "noble",
+			Serial:       "20240101_0000",
+		},
+		Source: shared.DefinitionSource{
+			Downloader: "debootstrap",
+		},
+		Packages: shared.DefinitionPackages{
+			Manager: "apt",
+			Sets: []shared.DefinitionPackagesSet{
+				{Packages: []string{"vim"}, Action: "install"},
+			},
+		},
+	}
+
+	imageTargets := getImageTargets("build-incus", false)
+
+	hashes, err := checkpointHashes(def, "build-incus", imageTargets)
+	require.NoError(t, err)
+	require.Len(t, hashes, len(checkpointStages))
+
+	// The serial doesn't affect any stage
+	def.Image.Serial = "20240102_0000"
+
+	other, err := checkpointHashes(def, "build-incus", imageTargets)
+	require.NoError(t, err)
+	require.Equal(t, hashes, other)
+
+	// Changing the packages invalidates the packages stage and all later ones
+	def.Packages.Sets[0].Packages = []string{"vim", "curl"}
+
+	other, err = checkpointHashes(def, "build-incus", imageTargets)
+	require.NoError(t, err)
+	require.Equal(t, hashes[:checkpointPackages], other[:checkpointPackages])
+	require.NotEqual(t, hashes[checkpointPackages], other[checkpointPackages])
+	require.NotEqual(t, hashes[checkpointGenerators], other[checkpointGenerators])
+
+	// Mounts invalidate the stages whose actions use them
+	def.Mounts = []shared.DefinitionMount{{Source: "/srv/files", Target: "/opt/files", Triggers: []string{"post-packages"}}}
+
+	hashes, err = checkpointHashes(def, "build-incus", imageTargets)
+	require.NoError(t, err)
+
+	def.Mounts[0].Source = "/srv/other"
+
+	other, err = checkpointHashes(def, "build-incus", imageTargets)
+	require.NoError(t, err)
+	require.Equal(t, hashes[:checkpointPackages], other[:checkpointPackages])
+	require.NotEqual(t, hashes[checkpointPackages], other[checkpointPackages])
+
+	def.Mounts[0].Triggers = nil
+
+	other, err = checkpointHashes(def, "build-incus", imageTargets)
+	require.NoError(t, err)
+	require.Equal(t, hashes[:checkpointRepositories], other[:checkpointRepositories])
+	require.NotEqual(t, hashes[checkpointRepositories], other[checkpointRepositories])
+
+	// The builder only affects the generators stage
+	other, err = checkpointHashes(def, "build-lxc", imageTargets)
+	require.NoError(t, err)
+
+	hashes, err = checkpointHashes(def, "build-incus", imageTargets)
+	require.NoError(t, err)
+	require.Equal(t, hashes[:checkpointGenerators], other[:checkpointGenerators])
+	require.NotEqual(t, hashes[checkpointGenerators], other[checkpointGenerators])
+}
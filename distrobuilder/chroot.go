@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
+
+	"github.com/lxc/distrobuilder/v3/shared"
 )
 
-func getOverlay(logger *logrus.Logger, cacheDir, sourceDir string) (func(), string, error) {
+func getOverlay(ctx context.Context, logger *logrus.Logger, cacheDir, sourceDir string) (func(), string, error) {
 	var stat unix.Statfs_t
 
 	// Skip overlay on xfs and zfs
@@ -51,7 +55,17 @@ func getOverlay(logger *logrus.Logger, cacheDir, sourceDir string) (func(), stri
 
 	err = unix.Mount("overlay", overlayDir, "overlay", 0, opts)
 	if err != nil {
-		return nil, "", fmt.Errorf("Failed to mount overlay: %w", err)
+		// Rootless builds fall back to fuse-overlayfs, as not all kernels allow
+		// overlays in user namespaces.
+		_, lookErr := exec.LookPath("fuse-overlayfs")
+		if !isRootless() || lookErr != nil {
+			return nil, "", fmt.Errorf("Failed to mount overlay: %w", err)
+		}
+
+		err = shared.RunCommand(ctx, nil, nil, "fuse-overlayfs", "-o", opts, overlayDir)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to mount fuse-overlayfs: %w", err)
+		}
 	}
 
 	cleanup := func() {
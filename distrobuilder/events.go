@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+// setupEvents sets up the event recorder, and routes the output of commands
+// through the logger if logging JSON.
+func (c *cmdGlobal) setupEvents() error {
+	if c.flagLogFormat == "json" {
+		c.ctx = context.WithValue(c.ctx, shared.ContextKeyStdout, c.logger.WithField("stream", "stdout").WriterLevel(logrus.InfoLevel))
+		c.ctx = context.WithValue(c.ctx, shared.ContextKeyStderr, c.logger.WithField("stream", "stderr").WriterLevel(logrus.InfoLevel))
+	}
+
+	// Events are always recorded for the build report, and written to the
+	// events file if set.
+	events, err := shared.NewEventRecorder(c.flagEventsFile)
+	if err != nil {
+		return fmt.Errorf("Failed to create events file: %w", err)
+	}
+
+	c.events = events
+	c.ctx = context.WithValue(c.ctx, shared.ContextKeyEvents, events)
+
+	return nil
+}
+
+// closeEvents closes the events file.
+func (c *cmdGlobal) closeEvents() {
+	if c.events == nil {
+		return
+	}
+
+	err := c.events.Close()
+	if err != nil && c.logger != nil {
+		c.logger.WithField("err", err).Warn("Failed recording events")
+	}
+
+	c.events = nil
+}
+
+// startStage finishes the current build stage, and starts the given one.
+func (c *cmdGlobal) startStage(stage string) {
+	c.finishStage(nil)
+
+	c.stage = stage
+	c.stageStart = time.Now()
+
+	if c.cgroup != nil {
+		err := c.cgroup.StartStage()
+		if err != nil {
+			c.logger.WithField("err", err).Warn("Failed measuring resource usage")
+		}
+	}
+
+	shared.RecordEvent(c.ctx, shared.Event{Type: shared.EventStageStarted, Stage: stage})
+}
+
+// finishStage finishes the current build stage, if any.
+func (c *cmdGlobal) finishStage(err error) {
+	if c.stage == "" {
+		return
+	}
+
+	event := shared.Event{
+		Type:     shared.EventStageFinished,
+		Stage:    c.stage,
+		Duration: time.Since(c.stageStart).Seconds(),
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	// Stages in which no commands ran in the cgroup have no usage.
+	if c.cgroup != nil {
+		usage, err := c.cgroup.StageUsage()
+		if err != nil {
+			c.logger.WithField("err", err).Warn("Failed measuring resource usage")
+		} else if usage.CPUTime > 0 {
+			event.Usage = &usage
+		}
+	}
+
+	shared.RecordEvent(c.ctx, event)
+
+	c.stage = ""
+}
+
+// logResourceUsage logs the resource usage of the build stages.
+func (c *cmdGlobal) logResourceUsage() {
+	if c.events == nil || c.logger == nil {
+		return
+	}
+
+	for _, event := range c.events.Events() {
+		if event.Type != shared.EventStageFinished || event.Usage == nil {
+			continue
+		}
+
+		fields := logrus.Fields{
+			"stage":    event.Stage,
+			"cpu_time": time.Duration(event.Usage.CPUTime * float64(time.Second)).Round(time.Millisecond),
+		}
+
+		// The memory and I/O usage need the memory and io controllers.
+		if event.Usage.MemoryPeak > 0 {
+			fields["memory_peak"] = units.BytesSize(float64(event.Usage.MemoryPeak))
+		}
+
+		if event.Usage.IORead > 0 || event.Usage.IOWritten > 0 {
+			fields["io_read"] = units.BytesSize(float64(event.Usage.IORead))
+			fields["io_written"] = units.BytesSize(float64(event.Usage.IOWritten))
+		}
+
+		c.logger.WithFields(fields).Info("Resource usage")
+	}
+}
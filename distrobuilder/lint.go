@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/flosch/pongo2/v4"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+// A lintWarning is a problem found in a valid definition.
+type lintWarning struct {
+	Rule    string `json:"rule"`
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+func (w lintWarning) String() string {
+	return fmt.Sprintf("%s: %s (%s)", w.Key, w.Message, w.Rule)
+}
+
+// lintWarnFunc records a warning.
+type lintWarnFunc func(rule string, key string, format string, args ...any)
+
+// lintFilter is a filterable entry of the definition.
+type lintFilter struct {
+	key    string
+	filter shared.Filter
+}
+
+// lintDefinition returns the problems of the definition which Validate doesn't
+// catch, as they don't prevent building images.
+func lintDefinition(def *shared.Definition) []lintWarning {
+	var warnings []lintWarning
+
+	var warn lintWarnFunc = func(rule string, key string, format string, args ...any) {
+		warnings = append(warnings, lintWarning{Rule: rule, Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	lxcOnly := !reflect.ValueOf(def.Targets.LXC).IsZero() && reflect.ValueOf(def.Targets.Incus).IsZero()
+
+	for i, file := range def.Files {
+		key := fmt.Sprintf("files.%d", i)
+
+		switch file.Generator {
+		case "copy":
+			if file.Source != "" && !isPongoTemplate(file.Source) {
+				matches, _ := filepath.Glob(file.Source)
+				if len(matches) == 0 {
+					warn("copy-source", key, "Source %q doesn't exist", file.Source)
+				}
+			}
+
+		case "template":
+			if lxcOnly {
+				warn("template-lxc", key, "The template generator is ignored for LXC images, and the definition only has LXC targets")
+			}
+
+		case "fstab":
+			if !slices.Equal(file.Types, []shared.DefinitionFilterType{shared.DefinitionFilterTypeVM}) {
+				warn("fstab-vm", key, "The fstab generator is only supported for VMs, and should be restricted with types: [vm]")
+			}
+		}
+
+		if file.Path != "" {
+			for j, other := range def.Files[:i] {
+				if other.Path == file.Path && reflect.DeepEqual(other.DefinitionFilter, file.DefinitionFilter) {
+					warn("duplicate-path", key, "Path %q is already used by files.%d", file.Path, j)
+					break
+				}
+			}
+		}
+
+		if file.Pongo {
+			lintPongo(warn, key+".path", file.Path)
+			lintPongo(warn, key+".content", file.Content)
+			lintPongo(warn, key+".source", file.Source)
+		}
+	}
+
+	for i, action := range def.Actions {
+		if action.Pongo {
+			lintPongo(warn, fmt.Sprintf("actions.%d.action", i), action.Action)
+		}
+	}
+
+	// These are always rendered.
+	lintPongo(warn, "image.name", def.Image.Name)
+	lintPongo(warn, "image.description", def.Image.Description)
+	lintPongo(warn, "source.url", def.Source.URL)
+
+	for i, key := range def.Source.Keys {
+		lintPongo(warn, fmt.Sprintf("source.keys.%d", i), key)
+	}
+
+	for i, repo := range def.Packages.Repositories {
+		lintPongo(warn, fmt.Sprintf("packages.repositories.%d.url", i), repo.URL)
+		lintPongo(warn, fmt.Sprintf("packages.repositories.%d.key", i), repo.Key)
+	}
+
+	for _, entry := range lintFilters(def) {
+		lintArchitectures(warn, def, entry.key, entry.filter)
+	}
+
+	return warnings
+}
+
+// lintFilters returns all filterable entries of the definition with their keys.
+func lintFilters(def *shared.Definition) []lintFilter {
+	var filters []lintFilter
+
+	for i := range def.Files {
+		filters = append(filters, lintFilter{fmt.Sprintf("files.%d", i), &def.Files[i]})
+	}
+
+	for i := range def.Actions {
+		filters = append(filters, lintFilter{fmt.Sprintf("actions.%d", i), &def.Actions[i]})
+	}
+
+	for i := range def.Mounts {
+		filters = append(filters, lintFilter{fmt.Sprintf("mounts.%d", i), &def.Mounts[i]})
+	}
+
+	for i := range def.Packages.Sets {
+		filters = append(filters, lintFilter{fmt.Sprintf("packages.sets.%d", i), &def.Packages.Sets[i]})
+	}
+
+	for i := range def.Packages.Repositories {
+		filters = append(filters, lintFilter{fmt.Sprintf("packages.repositories.%d", i), &def.Packages.Repositories[i]})
+	}
+
+	for i := range def.Environment.EnvVariables {
+		filters = append(filters, lintFilter{fmt.Sprintf("environment.variables.%d", i), &def.Environment.EnvVariables[i]})
+	}
+
+	for i := range def.Targets.LXC.Config {
+		filters = append(filters, lintFilter{fmt.Sprintf("targets.lxc.config.%d", i), &def.Targets.LXC.Config[i]})
+	}
+
+	names := make([]string, 0, len(def.Variables))
+	for name := range def.Variables {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := def.Variables[name]
+
+		for i := range values {
+			filters = append(filters, lintFilter{fmt.Sprintf("variables.%s.%d", name, i), &values[i]})
+		}
+	}
+
+	return filters
+}
+
+// lintArchitectures warns about architectures of the filter and its except
+// filters which never match.
+func lintArchitectures(warn lintWarnFunc, def *shared.Definition, key string, filter shared.Filter) {
+	for _, arch := range filter.GetArchitectures() {
+		mapped, ok := lintMapArchitecture(def, strings.TrimPrefix(arch, "!"))
+		if ok {
+			warn("architecture-filter", key, "Architecture %q never matches, as it's mapped to %q", arch, mapped)
+		}
+	}
+
+	except := filter.GetExcept()
+	if except != nil {
+		lintArchitectures(warn, def, key+".except", except)
+	}
+}
+
+// lintMapArchitecture returns the mapped name of the architecture, and true if
+// it differs, in which case a filter on the architecture never matches.
+func lintMapArchitecture(def *shared.Definition, arch string) (string, bool) {
+	// Patterns are left alone.
+	if strings.ContainsAny(arch, "*?[") {
+		return "", false
+	}
+
+	var mapped string
+
+	if def.Mappings.ArchitectureMap != "" {
+		var err error
+
+		mapped, err = shared.GetArch(def.Mappings.ArchitectureMap, arch)
+		if err != nil {
+			return "", false
+		}
+	} else if len(def.Mappings.Architectures) > 0 {
+		// Architectures which are the target of a mapping can be matched.
+		for _, target := range def.Mappings.Architectures {
+			if target == arch {
+				return "", false
+			}
+		}
+
+		var ok bool
+
+		mapped, ok = def.Mappings.Architectures[arch]
+		if !ok {
+			return "", false
+		}
+	} else {
+		return "", false
+	}
+
+	return mapped, mapped != arch
+}
+
+// lintPongo warns if the value isn't a valid pongo2 template.
+func lintPongo(warn lintWarnFunc, key string, value string) {
+	if !isPongoTemplate(value) {
+		return
+	}
+
+	_, err := pongo2.FromString(value)
+	if err != nil {
+		warn("pongo-syntax", key, "Failed to parse template: %v", err)
+	}
+}
+
+// isPongoTemplate returns true if the value contains pongo2 tags.
+func isPongoTemplate(value string) bool {
+	return strings.Contains(value, "{{") || strings.Contains(value, "{%")
+}
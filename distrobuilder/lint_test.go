@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+func TestLintDefinition(t *testing.T) {
+	tests := []struct {
+		name     string
+		def      shared.Definition
+		expected []lintWarning
+	}{
+		{
+			"no problems",
+			shared.Definition{
+				Files: []shared.DefinitionFile{
+					{Generator: "copy", Source: "lint_test.go", Path: "/root/test"},
+					{Generator: "fstab", DefinitionFilter: shared.DefinitionFilter{Types: []shared.DefinitionFilterType{"vm"}}},
+					{Generator: "template", Name: "hosts", Path: "/etc/hosts"},
+					{Generator: "dump", Path: "/etc/motd", Content: "{{ image.release }}", Pongo: true},
+				},
+				Mappings: shared.DefinitionMappings{ArchitectureMap: "debian"},
+				Actions: []shared.DefinitionAction{
+					{Trigger: "post-packages", Action: "true", DefinitionFilter: shared.DefinitionFilter{Architectures: []string{"amd64", "arm*"}}},
+				},
+			},
+			nil,
+		},
+		{
+			"copy source",
+			shared.Definition{
+				Files: []shared.DefinitionFile{
+					{Generator: "copy", Source: "does-not-exist"},
+				},
+			},
+			[]lintWarning{{Rule: "copy-source", Key: "files.0", Message: `Source "does-not-exist" doesn't exist`}},
+		},
+		{
+			"template with LXC targets",
+			shared.Definition{
+				Targets: shared.DefinitionTarget{
+					LXC: shared.DefinitionTargetLXC{CreateMessage: "foo"},
+				},
+				Files: []shared.DefinitionFile{
+					{Generator: "template", Name: "hosts", Path: "/etc/hosts"},
+				},
+			},
+			[]lintWarning{{Rule: "template-lxc", Key: "files.0", Message: "The template generator is ignored for LXC images, and the definition only has LXC targets"}},
+		},
+		{
+			"fstab without types",
+			shared.Definition{
+				Files: []shared.DefinitionFile{
+					{Generator: "fstab"},
+				},
+			},
+			[]lintWarning{{Rule: "fstab-vm", Key: "files.0", Message: "The fstab generator is only supported for VMs, and should be restricted with types: [vm]"}},
+		},
+		{
+			"duplicate path",
+			shared.Definition{
+				Files: []shared.DefinitionFile{
+					{Generator: "dump", Path: "/etc/motd"},
+					{Generator: "dump", Path: "/etc/motd", DefinitionFilter: shared.DefinitionFilter{Releases: []string{"noble"}}},
+					{Generator: "dump", Path: "/etc/motd"},
+				},
+			},
+			[]lintWarning{{Rule: "duplicate-path", Key: "files.2", Message: `Path "/etc/motd" is already used by files.0`}},
+		},
+		{
+			"pongo syntax",
+			shared.Definition{
+				Files: []shared.DefinitionFile{
+					{Generator: "dump", Path: "/etc/motd", Content: "{{ image.release }", Pongo: true},
+					{Generator: "dump", Path: "/etc/issue", Content: "{{ image.release }", Pongo: false},
+				},
+			},
+			[]lintWarning{{Rule: "pongo-syntax", Key: "files.0.content"}},
+		},
+		{
+			"architecture filter",
+			shared.Definition{
+				Mappings: shared.DefinitionMappings{ArchitectureMap: "debian"},
+				Packages: shared.DefinitionPackages{
+					Sets: []shared.DefinitionPackagesSet{
+						{
+							Packages: []string{"foo"},
+							Action:   "install",
+							DefinitionFilter: shared.DefinitionFilter{
+								Architectures: []string{"amd64", "aarch64"},
+								Except:        &shared.DefinitionFilter{Architectures: []string{"!x86_64"}},
+							},
+						},
+					},
+				},
+			},
+			[]lintWarning{
+				{Rule: "architecture-filter", Key: "packages.sets.0", Message: `Architecture "aarch64" never matches, as it's mapped to "arm64"`},
+				{Rule: "architecture-filter", Key: "packages.sets.0.except", Message: `Architecture "!x86_64" never matches, as it's mapped to "amd64"`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings := lintDefinition(&tt.def)
+
+			// The pongo2 error messages aren't stable.
+			for i := range warnings {
+				if warnings[i].Rule == "pongo-syntax" {
+					warnings[i].Message = ""
+				}
+			}
+
+			require.Equal(t, tt.expected, warnings)
+		})
+	}
+}
@@ -5,6 +5,7 @@ package main
 #include <errno.h>
 #include <sched.h>
 #include <stdio.h>
+#include <stdlib.h>
 #include <string.h>
 #include <sys/mount.h>
 #include <sys/types.h>
@@ -19,6 +20,12 @@ __attribute__((constructor)) void init(void) {
 		return;
 	}
 
+	// Rootless builds set up the namespaces once they've been executed again
+	// with their ID mappings.
+	if (getenv("DISTROBUILDER_ROOTLESS_SYNC") != NULL) {
+		return;
+	}
+
 	// Unshare a new mntns so our mounts don't leak
 	if (unshare(CLONE_NEWNS | CLONE_NEWPID | CLONE_NEWUTS) < 0) {
 		fprintf(stderr, "Failed to unshare namespaces: %s\n", strerror(errno));
@@ -61,14 +68,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	incus "github.com/lxc/incus/v7/shared/util"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v2"
 
 	"github.com/lxc/distrobuilder/v3/managers"
@@ -102,16 +112,31 @@ For supported compression methods, a compression level can be specified with
 method-N, where N is an integer, e.g. gzip-9.
 `
 
+// inspectCommands don't build anything. They neither require root nor a cache
+// directory.
+var inspectCommands = []string{"plan", "publish-simplestreams", "render", "schema", "validate", "verify-reproducible"}
+
 type cmdGlobal struct {
-	flagCleanup        bool
-	flagCacheDir       string
-	flagDebug          bool
-	flagOptions        []string
-	flagTimeout        uint
-	flagVersion        bool
-	flagDisableOverlay bool
-	flagSourcesDir     string
-	flagKeepSources    bool
+	flagCleanup         bool
+	flagCacheDir        string
+	flagDebug           bool
+	flagOptions         []string
+	flagTimeout         uint
+	flagVersion         bool
+	flagDisableOverlay  bool
+	flagSourcesDir      string
+	flagKeepSources     bool
+	flagCheckpoint      bool
+	flagResume          bool
+	flagLogFormat       string
+	flagEventsFile      string
+	flagReproducible    bool
+	flagChecksums       bool
+	flagSignKey         string
+	flagPackageCacheDir string
+	flagOfflineActions  []string
+
+	flagDebugShellOnFailure bool
 
 	definition     *shared.Definition
 	sourceDir      string
@@ -122,9 +147,26 @@ type cmdGlobal struct {
 	ctx            context.Context
 	cancel         context.CancelFunc
 	subCommand     *cobra.Command
+
+	checkpointHashes []string
+	resumeStage      int
+
+	events     *shared.EventRecorder
+	stage      string
+	stageStart time.Time
+	cgroup     *shared.Cgroup
+
+	packages []managers.Package
 }
 
 func main() {
+	// The child process of rootless builds waits for its user namespace.
+	err := waitRootless()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to setup user namespace: %s\n", err)
+		os.Exit(1)
+	}
+
 	// Global flags
 	globalCmd := cmdGlobal{}
 
@@ -132,20 +174,21 @@ func main() {
 		Use:   "distrobuilder",
 		Short: "System container and VM image builder for LXC and Incus",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			// Quick checks
-			if os.Geteuid() != 0 {
-				fmt.Fprintf(os.Stderr, "You must be root to run this tool\n")
+			// Quick checks. Without root, builds run in a user namespace.
+			if os.Geteuid() != 0 && !slices.Contains(inspectCommands, cmd.CalledAs()) {
+				err := runRootless()
+				fmt.Fprintf(os.Stderr, "You must be root or have subordinate IDs to run this tool: %s\n", err)
 				os.Exit(1)
 			}
 
 			// Keep track of the current subcommand. When app.Execute() fails, there's no way of
 			// knowing which command failed. However, we want to know this as we call postRun in
-			// case of an error, and handle the "validate" subcommand differently in that function.
+			// case of an error, and handle the inspect subcommands differently in that function.
 			globalCmd.subCommand = cmd
 
 			var err error
 
-			globalCmd.logger, err = shared.GetLogger(globalCmd.flagDebug)
+			globalCmd.logger, err = shared.GetLogger(globalCmd.flagDebug, globalCmd.flagLogFormat)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Failed to get logger: %s\n", err)
 				os.Exit(1)
@@ -157,6 +200,27 @@ func main() {
 				globalCmd.ctx, globalCmd.cancel = context.WithTimeout(context.Background(), time.Duration(globalCmd.flagTimeout)*time.Second)
 			}
 
+			// All timestamps are set to SOURCE_DATE_EPOCH in reproducible builds.
+			if globalCmd.flagReproducible {
+				sourceDateEpoch, err := shared.SourceDateEpoch()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "--reproducible requires a valid SOURCE_DATE_EPOCH: %s\n", err)
+					os.Exit(1)
+				}
+
+				globalCmd.ctx = context.WithValue(globalCmd.ctx, shared.ContextKeySourceDateEpoch, sourceDateEpoch)
+			}
+
+			// Actions of the offline triggers run without network access.
+			for _, trigger := range globalCmd.flagOfflineActions {
+				if !slices.Contains(shared.ActionTriggers, trigger) {
+					fmt.Fprintf(os.Stderr, "--offline-actions must be some of %v\n", shared.ActionTriggers)
+					os.Exit(1)
+				}
+			}
+
+			globalCmd.ctx = context.WithValue(globalCmd.ctx, shared.ContextKeyOfflineTriggers, globalCmd.flagOfflineActions)
+
 			go func() {
 				for {
 					select {
@@ -174,14 +238,41 @@ func main() {
 				}
 			}()
 
-			// No need to create cache directory if we're only validating.
-			if cmd.CalledAs() == "validate" {
+			// No need to create cache directory if we're not building anything.
+			if slices.Contains(inspectCommands, cmd.CalledAs()) {
 				return
 			}
 
+			// Resuming requires checkpoints to be kept up to date
+			if globalCmd.flagResume {
+				globalCmd.flagCheckpoint = true
+			}
+
 			// Create temp directory if the cache directory isn't explicitly set
 			if globalCmd.flagCacheDir == "" {
-				dir, err := os.MkdirTemp("/var/cache", "distrobuilder.")
+				if globalCmd.flagCheckpoint {
+					fmt.Fprintf(os.Stderr, "--checkpoint and --resume require --cache-dir to be set\n")
+					os.Exit(1)
+				}
+
+				cacheDir := "/var/cache"
+
+				// Rootless builds can't write to /var/cache.
+				if isRootless() {
+					cacheDir, err = os.UserCacheDir()
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to get user cache directory: %s\n", err)
+						os.Exit(1)
+					}
+
+					err = os.MkdirAll(cacheDir, 0o755)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to create directory %q: %s\n", cacheDir, err)
+						os.Exit(1)
+					}
+				}
+
+				dir, err := os.MkdirTemp(cacheDir, "distrobuilder.")
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Failed to create cache directory: %s\n", err)
 					os.Exit(1)
@@ -189,9 +280,22 @@ func main() {
 
 				globalCmd.flagCacheDir = dir
 			}
+
+			err = globalCmd.setupEvents()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
 		},
-		PersistentPostRunE: globalCmd.postRun,
-		CompletionOptions:  cobra.CompletionOptions{DisableDefaultCmd: true},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			globalCmd.finishStage(nil)
+
+			// The build succeeded, so the checkpoints can be removed with the cache.
+			globalCmd.flagCheckpoint = false
+
+			return globalCmd.postRun(cmd, args)
+		},
+		CompletionOptions: cobra.CompletionOptions{DisableDefaultCmd: true},
 	}
 
 	app.PersistentFlags().BoolVar(&globalCmd.flagCleanup, "cleanup", true,
@@ -205,6 +309,10 @@ func main() {
 	app.PersistentFlags().BoolVar(&globalCmd.flagVersion, "version", false, "Print version number")
 	app.PersistentFlags().BoolVar(&globalCmd.flagDebug, "debug", false, "Enable debug output")
 	app.PersistentFlags().BoolVar(&globalCmd.flagDisableOverlay, "disable-overlay", false, "Disable the use of filesystem overlays")
+	app.PersistentFlags().StringVar(&globalCmd.flagLogFormat, "log-format", "text", "Log format (text or json)"+"``")
+	app.PersistentFlags().StringVar(&globalCmd.flagEventsFile, "events-file", "", "File to append build events to"+"``")
+	app.PersistentFlags().BoolVar(&globalCmd.flagReproducible, "reproducible", false, "Build reproducible images using SOURCE_DATE_EPOCH"+"``")
+	app.PersistentFlags().StringSliceVar(&globalCmd.flagOfflineActions, "offline-actions", nil, "Run the actions of these triggers without network access, unless they set a network"+"``")
 
 	// Version handling
 	app.SetVersionTemplate("{{.Version}}\n")
@@ -224,6 +332,14 @@ func main() {
 	buildDirCmd := cmdBuildDir{global: &globalCmd}
 	app.AddCommand(buildDirCmd.command())
 
+	// build-matrix sub-command
+	buildMatrixCmd := cmdBuildMatrix{global: &globalCmd}
+	app.AddCommand(buildMatrixCmd.command())
+
+	// publish-simplestreams sub-command
+	publishSimplestreamsCmd := cmdPublishSimplestreams{global: &globalCmd}
+	app.AddCommand(publishSimplestreamsCmd.command())
+
 	// repack-windows sub-command
 	repackWindowsCmd := cmdRepackWindows{global: &globalCmd}
 	app.AddCommand(repackWindowsCmd.command())
@@ -231,11 +347,27 @@ func main() {
 	validateCmd := cmdValidate{global: &globalCmd}
 	app.AddCommand(validateCmd.command())
 
+	// plan sub-command
+	planCmd := cmdPlan{global: &globalCmd}
+	app.AddCommand(planCmd.command())
+
+	// render sub-command
+	renderCmd := cmdRender{global: &globalCmd}
+	app.AddCommand(renderCmd.command())
+
+	// schema sub-command
+	schemaCmd := cmdSchema{global: &globalCmd}
+	app.AddCommand(schemaCmd.command())
+
+	// verify-reproducible sub-command
+	verifyReproducibleCmd := cmdVerifyReproducible{global: &globalCmd}
+	app.AddCommand(verifyReproducibleCmd.command())
+
 	globalCmd.interrupt = make(chan os.Signal, 1)
 	signal.Notify(globalCmd.interrupt, os.Interrupt)
 
 	// Run the main command and handle errors
-	err := app.Execute()
+	err = app.Execute()
 	if err != nil {
 		if globalCmd.logger != nil {
 			globalCmd.logger.WithFields(logrus.Fields{"err": err}).Error("Failed running distrobuilder")
@@ -243,12 +375,20 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Failed running distrobuilder: %s\n", err.Error())
 		}
 
+		globalCmd.finishStage(err)
+
 		_ = globalCmd.postRun(globalCmd.subCommand, nil)
 		os.Exit(1)
 	}
 }
 
 func (c *cmdGlobal) cleanupCacheDirectory() {
+	// Keep the checkpoints so that a failed build can be resumed.
+	if c.flagCheckpoint {
+		c.cleanupCacheDirectoryKeepCheckpoints()
+		return
+	}
+
 	// Try removing the entire cache directory.
 	err := os.RemoveAll(c.flagCacheDir)
 	if err == nil {
@@ -268,16 +408,55 @@ func (c *cmdGlobal) cleanupCacheDirectory() {
 	}
 }
 
+// cleanupCacheDirectoryKeepCheckpoints removes the content of the cache
+// directory except for the checkpoints, including those of build-matrix images.
+func (c *cmdGlobal) cleanupCacheDirectoryKeepCheckpoints() {
+	entries, err := os.ReadDir(c.flagCacheDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(c.flagCacheDir, entry.Name())
+
+		if entry.Name() == "checkpoints" || incus.PathExists(filepath.Join(path, "checkpoints")) {
+			continue
+		}
+
+		err := os.RemoveAll(path)
+		if err != nil {
+			c.logger.WithField("err", err).Warn("Failed cleaning up cache directory")
+		}
+	}
+}
+
 func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 	// if an error is returned, disable the usage message
 	cmd.SilenceUsage = true
 
-	isRunningBuildDir := cmd.CalledAs() == "build-dir"
+	vm := false
+
+	if cmd.CalledAs() == "build-incus" {
+		var err error
+
+		vm, err = cmd.Flags().GetBool("vm")
+		if err != nil {
+			return fmt.Errorf(`Failed to get bool value of "vm": %w`, err)
+		}
+	}
+
+	return c.buildRootfs(cmd.CalledAs(), vm, args)
+}
+
+// buildRootfs downloads the source and runs all steps up to the post-packages
+// actions for the given builder (build-dir, build-lxc or build-incus).
+func (c *cmdGlobal) buildRootfs(builder string, vm bool, args []string) (err error) {
+	isRunningBuildDir := builder == "build-dir"
 
 	// Clean up cache directory before doing anything
 	c.cleanupCacheDirectory()
 
-	err := os.MkdirAll(c.flagCacheDir, 0o755)
+	err = os.MkdirAll(c.flagCacheDir, 0o755)
 	if err != nil {
 		return fmt.Errorf("Failed creating cache directory: %w", err)
 	}
@@ -311,7 +490,7 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 	}
 
 	// Get the image definition
-	c.definition, err = getDefinition(args[0], c.flagOptions)
+	c.definition, err = getDefinition(args[0], c.flagOptions, shared.BuildTime(c.ctx))
 	if err != nil {
 		return fmt.Errorf("Failed to get definition: %w", err)
 	}
@@ -338,57 +517,90 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Failed to render source URL: %w", err)
 	}
 
-	// Load and run downloader
-	downloader, err := sources.Load(c.ctx, c.definition.Source.Downloader, c.logger, *c.definition, c.sourceDir, c.flagCacheDir, c.flagSourcesDir)
+	imageTargets := getImageTargets(builder, vm)
+
+	if builder == "build-incus" && vm {
+		c.definition.Targets.Type = shared.DefinitionFilterTypeVM
+	}
+
+	err = c.setupCheckpoints(builder, imageTargets)
 	if err != nil {
-		return fmt.Errorf("Failed to load downloader %q: %w", c.definition.Source.Downloader, err)
+		return err
 	}
 
-	c.logger.Info("Downloading source")
+	if c.resumed(checkpointUnpack) {
+		err = c.restoreCheckpoint(c.sourceDir)
+		if err != nil {
+			return fmt.Errorf("Failed to restore checkpoint: %w", err)
+		}
+	} else {
+		// Load and run downloader
+		downloader, err := sources.Load(c.ctx, c.definition.Source.Downloader, c.logger, *c.definition, c.sourceDir, c.flagCacheDir, c.flagSourcesDir)
+		if err != nil {
+			return fmt.Errorf("Failed to load downloader %q: %w", c.definition.Source.Downloader, err)
+		}
 
-	err = downloader.Run()
-	if err != nil {
-		return fmt.Errorf("Error while downloading source: %w", err)
+		c.startStage("pre-unpack")
+
+		err = c.runActions("pre-unpack", imageTargets, c.sourceDir)
+		if err != nil {
+			return err
+		}
+
+		c.startStage("unpack")
+		c.logger.Info("Downloading source")
+
+		err = downloader.Run()
+		if err != nil {
+			return fmt.Errorf("Error while downloading source: %w", err)
+		}
+
+		err = c.saveCheckpoint(checkpointUnpack, c.sourceDir, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to save checkpoint: %w", err)
+		}
 	}
 
 	// Setup the mounts and chroot into the rootfs
-	exitChroot, err := shared.SetupChroot(c.sourceDir, *c.definition, nil)
+	exitChroot, err := c.setupChroot(c.sourceDir, imageTargets)
 	if err != nil {
-		return fmt.Errorf("Failed to setup chroot: %w", err)
+		return err
 	}
 	// Unmount everything and exit the chroot
 	defer func() {
 		_ = exitChroot()
 	}()
 
-	// Always include sections which have no type filter. If running build-dir,
-	// only these sections will be processed.
-	imageTargets := shared.ImageTargetUndefined
+	// Allow debugging failures before leaving the chroot
+	defer func() {
+		c.debugShell(err)
+	}()
 
-	// If we're running either build-lxc or build-incus, include types which are
-	// meant for all.
-	if !isRunningBuildDir {
-		imageTargets |= shared.ImageTargetAll
-	}
+	// The chroot needs to be left while saving a checkpoint, as the rootfs
+	// contains the chroot mounts otherwise.
+	checkpoint := func(stage int) error {
+		if !c.flagCheckpoint {
+			return nil
+		}
 
-	switch cmd.CalledAs() {
-	case "build-lxc":
-		// If we're running build-lxc, also process container-only sections.
-		imageTargets |= shared.ImageTargetContainer
-	case "build-incus":
-		// Include either container-specific or vm-specific sections when
-		// running build-incus.
-		ok, err := cmd.Flags().GetBool("vm")
+		err := exitChroot()
 		if err != nil {
-			return fmt.Errorf(`Failed to get bool value of "vm": %w`, err)
+			return fmt.Errorf("Failed exiting chroot: %w", err)
 		}
 
-		if ok {
-			imageTargets |= shared.ImageTargetVM
-			c.definition.Targets.Type = shared.DefinitionFilterTypeVM
-		} else {
-			imageTargets |= shared.ImageTargetContainer
+		err = c.saveCheckpoint(stage, c.sourceDir, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to save checkpoint: %w", err)
+		}
+
+		exit, err := c.setupChroot(c.sourceDir, imageTargets)
+		if err != nil {
+			return err
 		}
+
+		exitChroot = exit
+
+		return nil
 	}
 
 	manager, err := managers.Load(c.ctx, c.definition.Packages.Manager, c.logger, *c.definition)
@@ -396,52 +608,54 @@ func (c *cmdGlobal) preRunBuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Failed to load manager %q: %w", c.definition.Packages.Manager, err)
 	}
 
-	c.logger.Info("Managing repositories")
+	if !c.resumed(checkpointRepositories) {
+		c.startStage("repositories")
+		c.logger.Info("Managing repositories")
 
-	err = manager.ManageRepositories(imageTargets)
-	if err != nil {
-		return fmt.Errorf("Failed to manage repositories: %w", err)
-	}
-
-	c.logger.WithField("trigger", "post-unpack").Info("Running hooks")
+		err = manager.ManageRepositories(imageTargets)
+		if err != nil {
+			return fmt.Errorf("Failed to manage repositories: %w", err)
+		}
 
-	// Run post unpack hook
-	for _, hook := range c.definition.GetRunnableActions("post-unpack", imageTargets) {
-		if hook.Pongo {
-			hook.Action, err = shared.RenderTemplate(hook.Action, c.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
+		c.startStage("post-unpack")
+		err = c.runActions("post-unpack", imageTargets, "")
+		if err != nil {
+			return err
 		}
 
-		err := shared.RunScript(c.ctx, hook.Action)
+		err = checkpoint(checkpointRepositories)
 		if err != nil {
-			return fmt.Errorf("Failed to run post-unpack: %w", err)
+			return err
 		}
 	}
 
-	c.logger.Info("Managing packages")
+	if !c.resumed(checkpointPackages) {
+		c.startStage("packages")
+		c.logger.Info("Managing packages")
 
-	// Install/remove/update packages
-	err = manager.ManagePackages(imageTargets)
-	if err != nil {
-		return fmt.Errorf("Failed to manage packages: %w", err)
-	}
+		// Install/remove/update packages
+		err = manager.ManagePackages(imageTargets)
+		if err != nil {
+			return fmt.Errorf("Failed to manage packages: %w", err)
+		}
 
-	c.logger.WithField("trigger", "post-packages").Info("Running hooks")
+		c.startStage("post-packages")
+		err = c.runActions("post-packages", imageTargets, "")
+		if err != nil {
+			return err
+		}
 
-	// Run post packages hook
-	for _, hook := range c.definition.GetRunnableActions("post-packages", imageTargets) {
-		if hook.Pongo {
-			hook.Action, err = shared.RenderTemplate(hook.Action, c.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
+		err = checkpoint(checkpointPackages)
+		if err != nil {
+			return err
 		}
+	}
 
-		err := shared.RunScript(c.ctx, hook.Action)
+	// The installed packages are only needed for the SBOM of images.
+	if builder != "build-dir" {
+		err = c.listPackages(manager)
 		if err != nil {
-			return fmt.Errorf("Failed to run post-packages: %w", err)
+			return err
 		}
 	}
 
@@ -472,7 +686,7 @@ func (c *cmdGlobal) preRunPack(cmd *cobra.Command, args []string) error {
 	}
 
 	// Get the image definition
-	c.definition, err = getDefinition(args[0], c.flagOptions)
+	c.definition, err = getDefinition(args[0], c.flagOptions, shared.BuildTime(c.ctx))
 	if err != nil {
 		return fmt.Errorf("Failed to get definition: %w", err)
 	}
@@ -481,22 +695,18 @@ func (c *cmdGlobal) preRunPack(cmd *cobra.Command, args []string) error {
 }
 
 func (c *cmdGlobal) postRun(cmd *cobra.Command, args []string) error {
-	// If we're only validating, there's nothing to clean up.
-	if cmd != nil && cmd.CalledAs() == "validate" {
+	// If we're not building anything, there's nothing to clean up.
+	if cmd != nil && slices.Contains(inspectCommands, cmd.CalledAs()) {
 		return nil
 	}
 
 	hasLogger := c.logger != nil
 
 	// exit all chroots otherwise we cannot remove the cache directory
-	for _, exit := range shared.ActiveChroots {
-		if exit != nil {
-			err := exit()
-			if err != nil && hasLogger {
-				c.logger.WithField("err", err).Warn("Failed exiting chroot")
-			}
-		}
-	}
+	c.exitChroots()
+
+	// Report the resource usage of the build stages, and remove the cgroup
+	c.removeCgroup()
 
 	// Clean up overlay
 	if c.overlayCleanup != nil {
@@ -525,9 +735,304 @@ func (c *cmdGlobal) postRun(cmd *cobra.Command, args []string) error {
 		_ = os.RemoveAll(c.flagSourcesDir)
 	}
 
+	c.closeEvents()
+
 	return nil
 }
 
+// exitChroots exits all active chroots.
+func (c *cmdGlobal) exitChroots() {
+	for _, exit := range shared.ActiveChroots {
+		if exit != nil {
+			err := exit()
+			if err != nil && c.logger != nil {
+				c.logger.WithField("err", err).Warn("Failed exiting chroot")
+			}
+		}
+	}
+}
+
+// debugShell runs an interactive shell in the active chroot if the build
+// failed and --debug-shell-on-failure is set. The chroot is left by the caller
+// once the shell exits.
+func (c *cmdGlobal) debugShell(buildErr error) {
+	if buildErr == nil || !c.flagDebugShellOnFailure {
+		return
+	}
+
+	// Don't get in the way of interrupted builds.
+	if errors.Is(c.ctx.Err(), context.Canceled) {
+		return
+	}
+
+	inChroot := false
+
+	for _, exit := range shared.ActiveChroots {
+		if exit != nil {
+			inChroot = true
+			break
+		}
+	}
+
+	if !inChroot {
+		c.logger.Warn("Not starting debug shell, as the build failed outside of the chroot")
+		return
+	}
+
+	_, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS)
+	if err != nil {
+		c.logger.Warn("Not starting debug shell, as stdin isn't a terminal")
+		return
+	}
+
+	// The chroot environment is set in the process environment.
+	shell := os.Getenv("SHELL")
+	if shell == "" || !incus.PathExists(shell) {
+		shell = "/bin/sh"
+	}
+
+	c.logger.WithFields(logrus.Fields{"err": buildErr, "shell": shell}).Error("Build failed, starting debug shell in the chroot. Exit the shell to clean up")
+
+	cmd := exec.Command(shell)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	env, ok := c.ctx.Value(shared.ContextKeyEnviron).([]string)
+	if ok && len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	err = cmd.Run()
+	if err != nil {
+		var exitErr *exec.ExitError
+
+		if !errors.As(err, &exitErr) {
+			c.logger.WithField("err", err).Warn("Failed running debug shell")
+		}
+	}
+}
+
+// makeReproducible removes the files of the rootfs which differ between builds
+// in reproducible builds. If clamp is set, the modification times are clamped
+// to SOURCE_DATE_EPOCH, which is done by tar otherwise.
+func (c *cmdGlobal) makeReproducible(rootfs string, clamp bool) error {
+	if !shared.IsReproducible(c.ctx) {
+		return nil
+	}
+
+	err := shared.StripNondeterminism(rootfs)
+	if err != nil {
+		return fmt.Errorf("Failed to strip nondeterminism: %w", err)
+	}
+
+	if clamp {
+		err = shared.ClampMtimes(rootfs, shared.BuildTime(c.ctx))
+		if err != nil {
+			return fmt.Errorf("Failed to clamp modification times: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// packageCacheMounts returns the mount of the package cache into the chroot.
+// The packages are cached per distribution, release and architecture.
+func (c *cmdGlobal) packageCacheMounts() ([]shared.ChrootMount, error) {
+	if c.flagPackageCacheDir == "" {
+		return nil, nil
+	}
+
+	target := managers.PackageCacheDir(c.definition.Packages.Manager)
+	if target == "" {
+		c.logger.WithField("manager", c.definition.Packages.Manager).Warn("Not caching packages, as the package manager doesn't support it")
+		return nil, nil
+	}
+
+	source, err := filepath.Abs(filepath.Join(c.flagPackageCacheDir, c.definition.Image.Distribution, c.definition.Image.Release, c.definition.Image.ArchitectureMapped))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get absolute path of package cache: %w", err)
+	}
+
+	err = os.MkdirAll(source, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create directory %q: %w", source, err)
+	}
+
+	return []shared.ChrootMount{{Source: source, Target: target, Flags: unix.MS_BIND, IsDir: true}}, nil
+}
+
+// setupChroot chroots into the rootfs for managing repositories and packages,
+// with the package cache and the definition mounts without triggers. The
+// definition mounts are unmounted before exiting the chroot, and the commands
+// run in the chroot are started in the cgroup of the build.
+func (c *cmdGlobal) setupChroot(rootfs string, imageTargets shared.ImageTarget) (func() error, error) {
+	packageCache, err := c.packageCacheMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	leaveCgroup, err := c.enterCgroup()
+	if err != nil {
+		return nil, err
+	}
+
+	exitChroot, err := shared.SetupChroot(rootfs, *c.definition, packageCache)
+	if err != nil {
+		leaveCgroup()
+		return nil, fmt.Errorf("Failed to setup chroot: %w", err)
+	}
+
+	unmount, err := shared.BindMounts(c.definition.GetMounts("", imageTargets))
+	if err != nil {
+		leaveCgroup()
+		_ = exitChroot()
+		return nil, fmt.Errorf("Failed to setup mounts: %w", err)
+	}
+
+	return func() error {
+		leaveCgroup()
+
+		err := unmount()
+		if err != nil {
+			_ = exitChroot()
+			return fmt.Errorf("Failed to remove mounts: %w", err)
+		}
+
+		return exitChroot()
+	}, nil
+}
+
+// enterCgroup starts the commands run through the context in the cgroup of
+// the build, if the definition has resource limits. The cgroup is created
+// when it's first entered, which needs to happen outside of the chroot. The
+// returned function leaves the cgroup again.
+func (c *cmdGlobal) enterCgroup() (func(), error) {
+	ctx := c.ctx
+
+	if c.definition.Limits == (shared.DefinitionLimits{}) {
+		return func() {}, nil
+	}
+
+	if c.cgroup == nil {
+		cgroup, err := shared.NewCgroup(c.definition.Limits)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to setup resource limits: %w", err)
+		}
+
+		c.cgroup = cgroup
+	}
+
+	c.ctx = context.WithValue(c.ctx, shared.ContextKeyCgroup, c.cgroup)
+
+	return func() {
+		c.ctx = ctx
+	}, nil
+}
+
+// removeCgroup reports the resource usage of the build stages, and removes
+// the cgroup of the build if there's one.
+func (c *cmdGlobal) removeCgroup() {
+	if c.cgroup == nil {
+		return
+	}
+
+	c.logResourceUsage()
+
+	err := c.cgroup.Remove()
+	if err != nil && c.logger != nil {
+		c.logger.WithField("err", err).Warn("Failed removing cgroup")
+	}
+
+	c.cgroup = nil
+}
+
+// bindMounts sets up the definition mounts of actions, and is replaced in tests.
+var bindMounts = shared.BindMounts
+
+// runActions runs the actions of the trigger. If rootfs is set, the actions
+// run outside of a chroot, and host actions get the rootfs and the given
+// environment variables. Otherwise, the definition mounts of the trigger are
+// set up while the actions run.
+func (c *cmdGlobal) runActions(trigger string, imageTargets shared.ImageTarget, rootfs string, env ...string) (err error) {
+	c.logger.WithField("trigger", trigger).Info("Running hooks")
+
+	actions := c.definition.GetRunnableActions(trigger, imageTargets)
+
+	if rootfs != "" {
+		absRootfs, err := filepath.Abs(rootfs)
+		if err != nil {
+			return fmt.Errorf("Failed to get absolute path of %q: %w", rootfs, err)
+		}
+
+		env = append(env, fmt.Sprintf("%s=%s", shared.EnvRootfs, absRootfs))
+	} else if len(actions) > 0 {
+		unmount, mountErr := bindMounts(c.definition.GetMounts(trigger, imageTargets))
+		if mountErr != nil {
+			return fmt.Errorf("Failed to setup mounts: %w", mountErr)
+		}
+
+		defer func() {
+			unmountErr := unmount()
+			if unmountErr != nil && err == nil {
+				err = fmt.Errorf("Failed to remove mounts: %w", unmountErr)
+			}
+		}()
+	}
+
+	for _, action := range actions {
+		if action.Pongo {
+			action.Action, err = shared.RenderTemplate(action.Action, c.definition)
+			if err != nil {
+				return fmt.Errorf("Failed to render action: %w", err)
+			}
+		}
+
+		ctx := c.ctx
+
+		if action.Host && len(env) > 0 {
+			environ, _ := ctx.Value(shared.ContextKeyEnviron).([]string)
+			ctx = context.WithValue(ctx, shared.ContextKeyEnviron, append(slices.Clone(environ), env...))
+		}
+
+		err = shared.RunAction(ctx, trigger, action)
+		if err != nil {
+			if action.ContinueOnError {
+				c.logger.WithFields(logrus.Fields{"trigger": trigger, "err": err}).Warn("Ignoring failed action")
+				continue
+			}
+
+			return fmt.Errorf("Failed to run %s: %w", trigger, err)
+		}
+	}
+
+	return nil
+}
+
+// packEnv returns the environment variables of post-pack actions, which hold
+// the target directory and the space separated paths of the image files.
+func (c *cmdGlobal) packEnv() ([]string, error) {
+	targetDir, err := filepath.Abs(c.targetDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get absolute path of %q: %w", c.targetDir, err)
+	}
+
+	var artifacts []string
+
+	if c.events != nil {
+		for path := range artifactChecksums(c.events.Events(), c.targetDir) {
+			artifacts = append(artifacts, filepath.Join(targetDir, path))
+		}
+	}
+
+	slices.Sort(artifacts)
+
+	return []string{
+		fmt.Sprintf("%s=%s", shared.EnvTargetDir, targetDir),
+		fmt.Sprintf("%s=%s", shared.EnvArtifacts, strings.Join(artifacts, " ")),
+	}, nil
+}
+
 func (c *cmdGlobal) getOverlayDir() (string, func(), error) {
 	var (
 		cleanup    func()
@@ -544,7 +1049,7 @@ func (c *cmdGlobal) getOverlayDir() (string, func(), error) {
 			return "", nil, fmt.Errorf("Failed to copy image content: %w", err)
 		}
 	} else {
-		cleanup, overlayDir, err = getOverlay(c.logger, c.flagCacheDir, c.sourceDir)
+		cleanup, overlayDir, err = getOverlay(c.ctx, c.logger, c.flagCacheDir, c.sourceDir)
 		if err != nil {
 			c.logger.WithField("err", err).Warn("Failed to create overlay")
 
@@ -561,7 +1066,39 @@ func (c *cmdGlobal) getOverlayDir() (string, func(), error) {
 	return overlayDir, cleanup, nil
 }
 
-func getDefinition(fname string, options []string) (*shared.Definition, error) {
+// getImageTargets returns the image targets processed by the given builder
+// (build-dir, build-lxc or build-incus).
+func getImageTargets(builder string, vm bool) shared.ImageTarget {
+	// Always include sections which have no type filter. If running build-dir,
+	// only these sections will be processed.
+	imageTargets := shared.ImageTargetUndefined
+
+	// If we're running either build-lxc or build-incus, include types which are
+	// meant for all.
+	if builder != "build-dir" {
+		imageTargets |= shared.ImageTargetAll
+	}
+
+	switch builder {
+	case "build-lxc":
+		// If we're running build-lxc, also process container-only sections.
+		imageTargets |= shared.ImageTargetContainer
+	case "build-incus":
+		// Include either container-specific or vm-specific sections when
+		// running build-incus.
+		if vm {
+			imageTargets |= shared.ImageTargetVM
+		} else {
+			imageTargets |= shared.ImageTargetContainer
+		}
+	}
+
+	return imageTargets
+}
+
+// getDefinition reads the definition, and applies the options. The build time
+// is used as default serial.
+func getDefinition(fname string, options []string, buildTime time.Time) (*shared.Definition, error) {
 	// Read the provided file, or if none was given, read from stdin
 	var buf bytes.Buffer
 	if fname == "" || fname == "-" {
@@ -583,16 +1120,27 @@ func getDefinition(fname string, options []string) (*shared.Definition, error) {
 		}
 	}
 
+	// Merge the base definitions, relative paths are relative to the definition file
+	baseDir := "."
+	if fname != "" && fname != "-" {
+		baseDir = filepath.Dir(fname)
+	}
+
+	data, err := shared.ResolveDefinitionExtends(buf.Bytes(), baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve extends: %w", err)
+	}
+
 	// Parse the yaml input
 	var def shared.Definition
-	err := yaml.UnmarshalStrict(buf.Bytes(), &def)
+	err = yaml.UnmarshalStrict(data, &def)
 	if err != nil {
 		return nil, err
 	}
 
 	// Set options from the command line
 	for _, o := range options {
-		parts := strings.Split(o, "=")
+		parts := strings.SplitN(o, "=", 2)
 		if len(parts) != 2 {
 			return nil, errors.New("Options need to be of type key=value")
 		}
@@ -603,8 +1151,13 @@ func getDefinition(fname string, options []string) (*shared.Definition, error) {
 		}
 	}
 
+	err = def.LoadActionFiles(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
 	// Apply some defaults on top of the provided configuration
-	def.SetDefaults()
+	def.SetDefaultsAt(buildTime)
 
 	// Validate the result
 	err = def.Validate()
@@ -25,6 +25,8 @@ func (c *cmdBuildDir) command() *cobra.Command {
 		Args:  cobra.ExactArgs(2),
 		RunE:  c.global.preRunBuild,
 		PostRunE: func(cmd *cobra.Command, args []string) error {
+			c.global.startStage("generators")
+
 			// Run global generators
 			for _, file := range c.global.definition.Files {
 				if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, 0) {
@@ -42,31 +44,35 @@ func (c *cmdBuildDir) command() *cobra.Command {
 				if err != nil {
 					continue
 				}
+
+				shared.RecordEvent(c.global.ctx, shared.Event{Type: shared.EventGeneratorRun, Generator: file.Generator, Path: file.Path})
 			}
 
 			if !c.flagWithPostFiles {
-				return nil
+				return c.global.makeReproducible(c.global.targetDir, true)
+			}
+
+			leaveCgroup, err := c.global.enterCgroup()
+			if err != nil {
+				return err
 			}
 
 			exitChroot, err := shared.SetupChroot(c.global.targetDir,
 				*c.global.definition, nil)
 			if err != nil {
+				leaveCgroup()
 				return fmt.Errorf("Failed to setup chroot in %q: %w", c.global.targetDir, err)
 			}
 
-			c.global.logger.WithField("trigger", "post-files").Info("Running hooks")
-
-			// Run post files hook
-			for _, action := range c.global.definition.GetRunnableActions("post-files", shared.ImageTargetUndefined) {
-				if action.Pongo {
-					action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
-					if err != nil {
-						return fmt.Errorf("Failed to render action: %w", err)
-					}
-				}
+			for _, trigger := range []string{"post-generators", "post-files"} {
+				c.global.startStage(trigger)
 
-				err := shared.RunScript(c.global.ctx, action.Action)
+				err = c.global.runActions(trigger, shared.ImageTargetUndefined, "")
 				if err != nil {
+					c.global.debugShell(err)
+
+					leaveCgroup()
+
 					{
 						err := exitChroot()
 						if err != nil {
@@ -74,21 +80,28 @@ func (c *cmdBuildDir) command() *cobra.Command {
 						}
 					}
 
-					return fmt.Errorf("Failed to run post-files: %w", err)
+					return err
 				}
 			}
 
+			leaveCgroup()
+
 			err = exitChroot()
 			if err != nil {
 				return fmt.Errorf("Failed exiting chroot: %w", err)
 			}
 
-			return nil
+			return c.global.makeReproducible(c.global.targetDir, true)
 		},
 	}
 
 	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "distrobuilder"), "Sources directory for distribution tarballs"+"``")
 	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
-	c.cmdBuild.Flags().BoolVar(&c.flagWithPostFiles, "with-post-files", false, "Run post-files actions"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.flagWithPostFiles, "with-post-files", false, "Run post-generators and post-files actions"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagCheckpoint, "checkpoint", false, "Save a checkpoint of the rootfs after each build stage"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagResume, "resume", false, "Resume from the latest valid checkpoint"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagDebugShellOnFailure, "debug-shell-on-failure", false, "Start a shell in the chroot if the build fails"+"``")
+	c.cmdBuild.Flags().StringVar(&c.global.flagPackageCacheDir, "package-cache-dir", "", "Directory to keep the downloaded packages in across builds"+"``")
+
 	return c.cmdBuild
 }
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+var matrixDescription = `The releases, architectures and variants to build are taken from the matrix
+section of the definition. Each image is written to its own directory below the
+target directory. The layout can be set with the --output flag or the
+matrix.output key, and defaults to:
+  {{ image.release }}/{{ image.architecture }}/{{ image.variant }}
+
+The --target flag selects the image type and can take one of the following values:
+  - incus (default)
+  - lxc
+
+With --parallel=N, up to N images are built at the same time in separate
+processes. Images sharing the same release and architecture, and thus the same
+source tarball, are always built one after another.
+`
+
+type cmdBuildMatrix struct {
+	cmdBuild *cobra.Command
+	global   *cmdGlobal
+
+	flagTarget      string
+	flagType        string
+	flagCompression string
+	flagVM          bool
+	flagParallel    uint
+	flagOutput      string
+}
+
+type matrixBuild struct {
+	name      string
+	group     string
+	targetDir string
+	options   []string
+}
+
+func (c *cmdBuildMatrix) command() *cobra.Command {
+	c.cmdBuild = &cobra.Command{
+		Use:   "build-matrix <filename> [target dir] [--target=TARGET] [--parallel=N] [--output=LAYOUT]",
+		Short: "Build images for all entries of the definition matrix",
+		Long: fmt.Sprintf(`Build images for all entries of the definition matrix
+
+%s
+%s
+
+%s
+`, matrixDescription, typeDescription, compressionDescription),
+		Args: cobra.RangeArgs(1, 2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if args[0] == "-" {
+				return errors.New("build-matrix requires a definition file")
+			}
+
+			if !slices.Contains([]string{"incus", "lxc"}, c.flagTarget) {
+				return errors.New("--target needs to be one of ['incus', 'lxc']")
+			}
+
+			if !slices.Contains([]string{"split", "unified"}, c.flagType) {
+				return errors.New("--type needs to be one of ['split', 'unified']")
+			}
+
+			if c.flagTarget == "lxc" && c.flagVM {
+				return errors.New("--vm can only be used with --target=incus")
+			}
+
+			// Check compression arguments
+			_, _, err := shared.ParseCompression(c.flagCompression)
+			if err != nil {
+				return fmt.Errorf("Failed to parse compression level: %w", err)
+			}
+
+			if c.flagTarget == "incus" && c.flagType == "split" {
+				_, _, err := shared.ParseSquashfsCompression(c.flagCompression)
+				if err != nil {
+					return fmt.Errorf("Failed to parse compression level: %w", err)
+				}
+			}
+
+			// Check dependencies
+			if c.flagVM {
+				incusCmd := cmdIncus{global: c.global}
+
+				err := incusCmd.checkVMDependencies()
+				if err != nil {
+					return fmt.Errorf("Failed to check VM dependencies: %w", err)
+				}
+			}
+
+			// if an error is returned, disable the usage message
+			cmd.SilenceUsage = true
+
+			return nil
+		},
+		RunE: c.run,
+	}
+
+	c.cmdBuild.Flags().StringVar(&c.flagTarget, "target", "incus", "Type of image to build"+"``")
+	c.cmdBuild.Flags().StringVar(&c.flagType, "type", "split", "Type of tarball to create"+"``")
+	c.cmdBuild.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.flagVM, "vm", false, "Create a qcow2 image for VMs"+"``")
+	c.cmdBuild.Flags().UintVar(&c.flagParallel, "parallel", 1, "Number of images to build at the same time"+"``")
+	c.cmdBuild.Flags().StringVar(&c.flagOutput, "output", "", "Output directory layout"+"``")
+	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "distrobuilder"), "Sources directory for distribution tarballs"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagCheckpoint, "checkpoint", false, "Save a checkpoint of the rootfs after each build stage"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagResume, "resume", false, "Resume from the latest valid checkpoint"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagChecksums, "checksums", false, "Write the checksums of the image files to SHA256SUMS"+"``")
+	c.cmdBuild.Flags().StringVar(&c.global.flagSignKey, "sign-key", "", "Sign the image files with the GPG secret key in this file"+"``")
+	c.cmdBuild.Flags().StringVar(&c.global.flagPackageCacheDir, "package-cache-dir", "", "Directory to keep the downloaded packages in across builds"+"``")
+
+	return c.cmdBuild
+}
+
+func (c *cmdBuildMatrix) run(cmd *cobra.Command, args []string) error {
+	def, err := getDefinition(args[0], c.global.flagOptions, shared.BuildTime(c.global.ctx))
+	if err != nil {
+		return fmt.Errorf("Failed to get definition: %w", err)
+	}
+
+	targetDir := "."
+	if len(args) > 1 {
+		targetDir = args[1]
+	}
+
+	layout := c.flagOutput
+	if layout == "" {
+		layout = def.Matrix.Output
+	}
+
+	if layout == "" {
+		layout = "{{ image.release }}/{{ image.architecture }}/{{ image.variant }}"
+	}
+
+	var builds []matrixBuild
+
+	for _, entry := range def.Matrix.Expand() {
+		options := append(slices.Clone(c.global.flagOptions), entry.Options()...)
+
+		entryDef, err := getDefinition(args[0], options, shared.BuildTime(c.global.ctx))
+		if err != nil {
+			return fmt.Errorf("Failed to get definition for %v: %w", entry.Options(), err)
+		}
+
+		dir, err := shared.RenderTemplate(layout, entryDef)
+		if err != nil {
+			return fmt.Errorf("Failed to render output layout: %w", err)
+		}
+
+		builds = append(builds, matrixBuild{
+			name:      fmt.Sprintf("%s/%s/%s", entryDef.Image.Release, entryDef.Image.Architecture, entryDef.Image.Variant),
+			group:     fmt.Sprintf("%s/%s", entryDef.Image.Release, entryDef.Image.ArchitectureMapped),
+			targetDir: filepath.Join(targetDir, dir),
+			options:   options,
+		})
+	}
+
+	c.global.logger.WithFields(logrus.Fields{"images": len(builds), "parallel": c.flagParallel}).Info("Building matrix")
+
+	var failed []string
+
+	if c.flagParallel <= 1 {
+		for i, build := range builds {
+			err := c.buildEntry(cmd, i, args[0], build)
+			if err != nil {
+				c.global.logger.WithFields(logrus.Fields{"image": build.name, "err": err}).Error("Failed building image")
+				failed = append(failed, build.name)
+			}
+		}
+	} else {
+		failed = c.spawnEntries(args[0], builds)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to build %d of %d images: %s", len(failed), len(builds), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// buildEntry builds a single image of the matrix in this process.
+func (c *cmdBuildMatrix) buildEntry(cmd *cobra.Command, index int, fname string, build matrixBuild) (err error) {
+	c.global.logger.WithFields(logrus.Fields{"image": build.name, "target": build.targetDir}).Info("Building image")
+
+	global := c.entryGlobal(index, build)
+
+	defer func() {
+		c.finishEntry(global, err)
+	}()
+
+	args := []string{fname, build.targetDir}
+
+	builder := "build-lxc"
+	if c.flagTarget == "incus" {
+		builder = "build-incus"
+	}
+
+	err = global.buildRootfs(builder, c.flagVM, args)
+	if err != nil {
+		return err
+	}
+
+	overlayDir, cleanup, err := global.getOverlayDir()
+	if err != nil {
+		return fmt.Errorf("Failed to get overlay directory: %w", err)
+	}
+
+	if cleanup != nil {
+		defer cleanup()
+	}
+
+	if c.flagTarget == "lxc" {
+		lxcCmd := cmdLXC{global: global, flagCompression: c.flagCompression}
+
+		return lxcCmd.run(cmd, args, overlayDir)
+	}
+
+	incusCmd := cmdIncus{global: global, flagType: c.flagType, flagCompression: c.flagCompression, flagVM: c.flagVM}
+
+	return incusCmd.run(cmd, args, overlayDir)
+}
+
+// entryGlobal returns a copy of the global state for an image of the matrix,
+// with its own cache directory and cgroup. Its events are kept apart for its
+// build report, but still written to the events file.
+func (c *cmdBuildMatrix) entryGlobal(index int, build matrixBuild) *cmdGlobal {
+	global := *c.global
+	global.flagCacheDir = filepath.Join(c.global.flagCacheDir, fmt.Sprintf("%d", index))
+	global.flagOptions = build.options
+	global.definition = nil
+	global.overlayCleanup = nil
+	global.cgroup = nil
+	global.stage = ""
+
+	if c.global.events != nil {
+		global.events = c.global.events.NewChild()
+		global.ctx = context.WithValue(global.ctx, shared.ContextKeyEvents, global.events)
+	}
+
+	return &global
+}
+
+// finishEntry cleans up after building an image of the matrix, like postRun
+// does for single builds.
+func (c *cmdBuildMatrix) finishEntry(global *cmdGlobal, err error) {
+	// Make sure the next entry doesn't start inside a chroot
+	global.exitChroots()
+
+	// Each image gets its own cgroup, which needs to be removed before the
+	// next one is created.
+	global.removeCgroup()
+
+	// Only keep the checkpoints of failed images.
+	if err == nil {
+		global.flagCheckpoint = false
+	}
+
+	if global.flagCleanup {
+		global.cleanupCacheDirectory()
+	}
+
+	global.closeEvents()
+}
+
+// spawnEntries builds the images of the matrix in separate processes, as the
+// chroot is shared by the whole process. Images of the same group share their
+// source tarball and are therefore built sequentially.
+func (c *cmdBuildMatrix) spawnEntries(fname string, builds []matrixBuild) []string {
+	var groups []string
+
+	indexes := map[string][]int{}
+
+	for i, build := range builds {
+		_, ok := indexes[build.group]
+		if !ok {
+			groups = append(groups, build.group)
+		}
+
+		indexes[build.group] = append(indexes[build.group], i)
+	}
+
+	var (
+		failed []string
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+
+	sem := make(chan struct{}, c.flagParallel)
+
+	for _, group := range groups {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			for _, i := range indexes[group] {
+				err := c.spawnEntry(i, fname, builds[i])
+				if err != nil {
+					c.global.logger.WithFields(logrus.Fields{"image": builds[i].name, "err": err}).Error("Failed building image")
+
+					mu.Lock()
+					failed = append(failed, builds[i].name)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return failed
+}
+
+// spawnEntry builds a single image of the matrix by running build-lxc or
+// build-incus in a new process.
+func (c *cmdBuildMatrix) spawnEntry(index int, fname string, build matrixBuild) error {
+	c.global.logger.WithFields(logrus.Fields{"image": build.name, "target": build.targetDir}).Info("Building image")
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Failed to get executable path: %w", err)
+	}
+
+	args := []string{
+		fmt.Sprintf("build-%s", c.flagTarget), fname, build.targetDir,
+		"--cache-dir", filepath.Join(c.global.flagCacheDir, fmt.Sprintf("%d", index)),
+		fmt.Sprintf("--cleanup=%t", c.global.flagCleanup),
+		fmt.Sprintf("--debug=%t", c.global.flagDebug),
+		fmt.Sprintf("--disable-overlay=%t", c.global.flagDisableOverlay),
+		fmt.Sprintf("--timeout=%d", c.global.flagTimeout),
+		"--sources-dir", c.global.flagSourcesDir,
+		"--keep-sources=true",
+		fmt.Sprintf("--checkpoint=%t", c.global.flagCheckpoint),
+		fmt.Sprintf("--resume=%t", c.global.flagResume),
+		"--compression", c.flagCompression,
+		"--log-format", c.global.flagLogFormat,
+		fmt.Sprintf("--reproducible=%t", c.global.flagReproducible),
+		fmt.Sprintf("--checksums=%t", c.global.flagChecksums),
+	}
+
+	// All builds append to the same events file.
+	if c.global.flagEventsFile != "" {
+		args = append(args, "--events-file", c.global.flagEventsFile)
+	}
+
+	if c.global.flagSignKey != "" {
+		args = append(args, "--sign-key", c.global.flagSignKey)
+	}
+
+	if len(c.global.flagOfflineActions) > 0 {
+		args = append(args, "--offline-actions", strings.Join(c.global.flagOfflineActions, ","))
+	}
+
+	if c.global.flagPackageCacheDir != "" {
+		args = append(args, "--package-cache-dir", c.global.flagPackageCacheDir)
+	}
+
+	if c.flagTarget == "incus" {
+		args = append(args, "--type", c.flagType, fmt.Sprintf("--vm=%t", c.flagVM))
+	}
+
+	for _, option := range build.options {
+		// The options are parsed as CSV, so quote them to keep any commas.
+		if strings.ContainsAny(option, `,"`) {
+			option = fmt.Sprintf(`"%s"`, strings.ReplaceAll(option, `"`, `""`))
+		}
+
+		args = append(args, "-o", option)
+	}
+
+	command := exec.CommandContext(c.global.ctx, exe, args...)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	return command.Run()
+}
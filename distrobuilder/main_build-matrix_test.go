@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+func TestBuildMatrixEntryGlobal(t *testing.T) {
+	events, err := shared.NewEventRecorder("")
+	require.NoError(t, err)
+
+	global := &cmdGlobal{
+		flagCacheDir: "/var/cache/distrobuilder",
+		events:       events,
+		ctx:          context.WithValue(context.Background(), shared.ContextKeyEvents, events),
+	}
+
+	c := cmdBuildMatrix{global: global}
+
+	first := c.entryGlobal(0, matrixBuild{options: []string{"image.release=noble"}})
+	second := c.entryGlobal(1, matrixBuild{options: []string{"image.release=jammy"}})
+
+	require.Equal(t, filepath.Join("/var/cache/distrobuilder", "0"), first.flagCacheDir)
+	require.Equal(t, []string{"image.release=jammy"}, second.flagOptions)
+
+	// The events of an image only end up in its own build report, but are
+	// still forwarded to the events of the matrix.
+	first.startStage("unpack")
+	first.finishStage(nil)
+	second.startStage("pack")
+	second.finishStage(nil)
+
+	report, err := newBuildReport(&shared.Definition{}, shared.ImageTargetAll, first.events.Events(), "")
+	require.NoError(t, err)
+	require.Len(t, report.Stages, 1)
+	require.Equal(t, "unpack", report.Stages[0].Stage)
+
+	report, err = newBuildReport(&shared.Definition{}, shared.ImageTargetAll, second.events.Events(), "")
+	require.NoError(t, err)
+	require.Len(t, report.Stages, 1)
+	require.Equal(t, "pack", report.Stages[0].Stage)
+
+	require.Len(t, global.events.Events(), 4)
+
+	// The cgroup of an image is removed once it's built.
+	global.cgroup = &shared.Cgroup{}
+
+	third := c.entryGlobal(2, matrixBuild{})
+	require.Nil(t, third.cgroup)
+
+	third.cgroup = &shared.Cgroup{}
+	c.finishEntry(third, nil)
+	require.Nil(t, third.cgroup)
+	require.NotNil(t, global.cgroup)
+}
@@ -97,6 +97,12 @@ func (c *cmdIncus) commandBuild() *cobra.Command {
 	c.cmdBuild.Flags().StringVar(&c.flagImportIntoIncus, "import-into-incus", "", "Import built image into Incus"+"``")
 	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
 	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "distrobuilder"), "Sources directory for distribution tarballs"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagCheckpoint, "checkpoint", false, "Save a checkpoint of the rootfs after each build stage"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagResume, "resume", false, "Resume from the latest valid checkpoint"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagChecksums, "checksums", false, "Write the checksums of the image files to SHA256SUMS"+"``")
+	c.cmdBuild.Flags().StringVar(&c.global.flagSignKey, "sign-key", "", "Sign the image files with the GPG secret key in this file"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagDebugShellOnFailure, "debug-shell-on-failure", false, "Start a shell in the chroot if the build fails"+"``")
+	c.cmdBuild.Flags().StringVar(&c.global.flagPackageCacheDir, "package-cache-dir", "", "Directory to keep the downloaded packages in across builds"+"``")
 
 	return c.cmdBuild
 }
@@ -172,35 +178,45 @@ func (c *cmdIncus) commandPack() *cobra.Command {
 	c.cmdPack.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use")
 	c.cmdPack.Flags().BoolVar(&c.flagVM, "vm", false, "Create a qcow2 image for VMs"+"``")
 	c.cmdPack.Flags().StringVar(&c.flagImportIntoIncus, "import-into-incus", "", "Import built image into Incus"+"``")
+	c.cmdPack.Flags().BoolVar(&c.global.flagChecksums, "checksums", false, "Write the checksums of the image files to SHA256SUMS"+"``")
+	c.cmdPack.Flags().StringVar(&c.global.flagSignKey, "sign-key", "", "Sign the image files with the GPG secret key in this file"+"``")
+	c.cmdPack.Flags().BoolVar(&c.global.flagDebugShellOnFailure, "debug-shell-on-failure", false, "Start a shell in the chroot if the build fails"+"``")
 	c.cmdPack.Flags().Lookup("import-into-incus").NoOptDefVal = "-"
+	c.cmdPack.Flags().StringVar(&c.global.flagPackageCacheDir, "package-cache-dir", "", "Directory to keep the downloaded packages in across builds"+"``")
 
 	return c.cmdPack
 }
 
-func (c *cmdIncus) runPack(cmd *cobra.Command, args []string, overlayDir string) error {
+func (c *cmdIncus) runPack(cmd *cobra.Command, args []string, overlayDir string) (err error) {
+	imageTargets := shared.ImageTargetAll
+
+	if c.flagVM {
+		imageTargets |= shared.ImageTargetVM
+	} else {
+		imageTargets |= shared.ImageTargetContainer
+	}
+
 	// Setup the mounts and chroot into the rootfs
-	exitChroot, err := shared.SetupChroot(overlayDir, *c.global.definition, nil)
+	exitChroot, err := c.global.setupChroot(overlayDir, imageTargets)
 	if err != nil {
-		return fmt.Errorf("Failed to setup chroot: %w", err)
+		return err
 	}
 	// Unmount everything and exit the chroot
 	defer func() {
 		_ = exitChroot()
 	}()
 
-	imageTargets := shared.ImageTargetAll
-
-	if c.flagVM {
-		imageTargets |= shared.ImageTargetVM
-	} else {
-		imageTargets |= shared.ImageTargetContainer
-	}
+	// Allow debugging failures before leaving the chroot
+	defer func() {
+		c.global.debugShell(err)
+	}()
 
 	manager, err := managers.Load(c.global.ctx, c.global.definition.Packages.Manager, c.global.logger, *c.global.definition)
 	if err != nil {
 		return fmt.Errorf("Failed to load manager %q: %w", c.global.definition.Packages.Manager, err)
 	}
 
+	c.global.startStage("repositories")
 	c.global.logger.Info("Managing repositories")
 
 	err = manager.ManageRepositories(imageTargets)
@@ -208,23 +224,13 @@ func (c *cmdIncus) runPack(cmd *cobra.Command, args []string, overlayDir string)
 		return fmt.Errorf("Failed to manage repositories: %w", err)
 	}
 
-	c.global.logger.WithField("trigger", "post-unpack").Info("Running hooks")
-
-	// Run post unpack hook
-	for _, hook := range c.global.definition.GetRunnableActions("post-unpack", imageTargets) {
-		if hook.Pongo {
-			hook.Action, err = shared.RenderTemplate(hook.Action, c.global.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
-		}
-
-		err := shared.RunScript(c.global.ctx, hook.Action)
-		if err != nil {
-			return fmt.Errorf("Failed to run post-unpack: %w", err)
-		}
+	c.global.startStage("post-unpack")
+	err = c.global.runActions("post-unpack", imageTargets, "")
+	if err != nil {
+		return err
 	}
 
+	c.global.startStage("packages")
 	c.global.logger.Info("Managing packages")
 
 	// Install/remove/update packages
@@ -233,24 +239,13 @@ func (c *cmdIncus) runPack(cmd *cobra.Command, args []string, overlayDir string)
 		return fmt.Errorf("Failed to manage packages: %w", err)
 	}
 
-	c.global.logger.WithField("trigger", "post-packages").Info("Running hooks")
-
-	// Run post packages hook
-	for _, hook := range c.global.definition.GetRunnableActions("post-packages", imageTargets) {
-		if hook.Pongo {
-			hook.Action, err = shared.RenderTemplate(hook.Action, c.global.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
-		}
-
-		err := shared.RunScript(c.global.ctx, hook.Action)
-		if err != nil {
-			return fmt.Errorf("Failed to run post-packages: %w", err)
-		}
+	c.global.startStage("post-packages")
+	err = c.global.runActions("post-packages", imageTargets, "")
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return c.global.listPackages(manager)
 }
 
 func (c *cmdIncus) run(cmd *cobra.Command, args []string, overlayDir string) error {
@@ -271,39 +266,55 @@ func (c *cmdIncus) run(cmd *cobra.Command, args []string, overlayDir string) err
 		c.global.logger.WithField("overlay", overlayDir).Warn("Could not parse passwd/group file: %w", err)
 	}
 
-	for i, file := range c.global.definition.Files {
-		if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, imageTargets) {
-			continue
+	if c.global.resumed(checkpointGenerators) {
+		err = c.global.loadCheckpointMetadata(checkpointGenerators, &img.Metadata.Templates)
+		if err != nil {
+			return fmt.Errorf("Failed to restore checkpoint: %w", err)
 		}
+	} else {
+		c.global.startStage("generators")
 
-		if file.UID != "" && !isNumeric(file.UID) {
-			uid, exists := userMap[file.UID]
-			if exists {
-				c.global.definition.Files[i].UID = uid
-			} else {
-				c.global.logger.WithField("generator", file.Generator).Warnf("Could not find UID for user %q", file.UID)
+		for i, file := range c.global.definition.Files {
+			if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, imageTargets) {
+				continue
 			}
-		}
 
-		if file.UID != "" && !isNumeric(file.GID) {
-			gid, exists := groupMap[file.GID]
-			if exists {
-				c.global.definition.Files[i].GID = gid
-			} else {
-				c.global.logger.WithField("generator", file.Generator).Warnf("Could not find GID for group %q", file.GID)
+			if file.UID != "" && !isNumeric(file.UID) {
+				uid, exists := userMap[file.UID]
+				if exists {
+					c.global.definition.Files[i].UID = uid
+				} else {
+					c.global.logger.WithField("generator", file.Generator).Warnf("Could not find UID for user %q", file.UID)
+				}
 			}
-		}
 
-		generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
-		if err != nil {
-			return fmt.Errorf("Failed to load generator %q: %w", file.Generator, err)
-		}
+			if file.UID != "" && !isNumeric(file.GID) {
+				gid, exists := groupMap[file.GID]
+				if exists {
+					c.global.definition.Files[i].GID = gid
+				} else {
+					c.global.logger.WithField("generator", file.Generator).Warnf("Could not find GID for group %q", file.GID)
+				}
+			}
 
-		c.global.logger.WithField("generator", file.Generator).Info("Running generator")
+			generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
+			if err != nil {
+				return fmt.Errorf("Failed to load generator %q: %w", file.Generator, err)
+			}
 
-		err = generator.RunIncus(img, c.global.definition.Targets.Incus)
+			c.global.logger.WithField("generator", file.Generator).Info("Running generator")
+
+			err = generator.RunIncus(img, c.global.definition.Targets.Incus)
+			if err != nil {
+				return fmt.Errorf("Failed to create Incus data: %w", err)
+			}
+
+			shared.RecordEvent(c.global.ctx, shared.Event{Type: shared.EventGeneratorRun, Generator: file.Generator, Path: file.Path})
+		}
+
+		err = c.global.saveCheckpoint(checkpointGenerators, overlayDir, img.Metadata.Templates)
 		if err != nil {
-			return fmt.Errorf("Failed to create Incus data: %w", err)
+			return fmt.Errorf("Failed to save checkpoint: %w", err)
 		}
 	}
 
@@ -423,9 +434,15 @@ func (c *cmdIncus) run(cmd *cobra.Command, args []string, overlayDir string) err
 		}
 	}
 
+	leaveCgroup, err := c.global.enterCgroup()
+	if err != nil {
+		return err
+	}
+
 	exitChroot, err := shared.SetupChroot(rootfsDir,
 		*c.global.definition, mounts)
 	if err != nil {
+		leaveCgroup()
 		return fmt.Errorf("Failed to chroot: %w", err)
 	}
 
@@ -434,19 +451,15 @@ func (c *cmdIncus) run(cmd *cobra.Command, args []string, overlayDir string) err
 		return fmt.Errorf("Failed adding systemd generator: %w", err)
 	}
 
-	c.global.logger.WithField("trigger", "post-files").Info("Running hooks")
-
-	// Run post files hook
-	for _, action := range c.global.definition.GetRunnableActions("post-files", imageTargets) {
-		if action.Pongo {
-			action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
-		}
+	for _, trigger := range []string{"post-generators", "post-files"} {
+		c.global.startStage(trigger)
 
-		err := shared.RunScript(c.global.ctx, action.Action)
+		err = c.global.runActions(trigger, imageTargets, "")
 		if err != nil {
+			c.global.debugShell(err)
+
+			leaveCgroup()
+
 			{
 				err := exitChroot()
 				if err != nil {
@@ -454,15 +467,30 @@ func (c *cmdIncus) run(cmd *cobra.Command, args []string, overlayDir string) err
 				}
 			}
 
-			return fmt.Errorf("Failed to run post-files: %w", err)
+			return err
 		}
 	}
 
+	leaveCgroup()
+
 	err = exitChroot()
 	if err != nil {
 		return fmt.Errorf("Failed exiting chroot: %w", err)
 	}
 
+	c.global.startStage("pre-pack")
+
+	err = c.global.runActions("pre-pack", imageTargets, rootfsDir)
+	if err != nil {
+		return err
+	}
+
+	// The VM filesystem isn't packed by tar, so the times are clamped in place.
+	err = c.global.makeReproducible(rootfsDir, c.flagVM)
+	if err != nil {
+		return err
+	}
+
 	// Unmount VM directory and loop device before creating the image.
 	if c.flagVM {
 		err := vm.umountPartition(vmDir)
@@ -477,6 +505,11 @@ func (c *cmdIncus) run(cmd *cobra.Command, args []string, overlayDir string) err
 		}
 	}
 
+	if c.global.packages != nil {
+		img.Metadata.Properties["packages"] = packagesProperty(c.global.packages)
+	}
+
+	c.global.startStage("pack")
 	c.global.logger.WithFields(logrus.Fields{"type": c.flagType, "vm": c.flagVM, "compression": c.flagCompression}).Info("Creating Incus image")
 
 	imageFile, rootfsFile, err := img.Build(c.flagType == "unified", c.flagCompression, c.flagVM)
@@ -484,9 +517,38 @@ func (c *cmdIncus) run(cmd *cobra.Command, args []string, overlayDir string) err
 		return fmt.Errorf("Failed to create Incus image: %w", err)
 	}
 
+	err = c.global.writeSBOM()
+	if err != nil {
+		return fmt.Errorf("Failed to create SBOM: %w", err)
+	}
+
+	err = c.global.writeChecksums()
+	if err != nil {
+		return fmt.Errorf("Failed to create checksums: %w", err)
+	}
+
+	c.global.startStage("post-pack")
+
+	env, err := c.global.packEnv()
+	if err != nil {
+		return err
+	}
+
+	// The VM filesystem isn't mounted anymore, so the actions of VMs get the
+	// rootfs it was copied from.
+	err = c.global.runActions("post-pack", imageTargets, overlayDir, env...)
+	if err != nil {
+		return err
+	}
+
+	err = c.global.writeBuildReport(getImageTargets("build-incus", c.flagVM))
+	if err != nil {
+		return fmt.Errorf("Failed to create build report: %w", err)
+	}
+
 	importFlag := cmd.Flags().Lookup("import-into-incus")
 
-	if importFlag.Changed {
+	if importFlag != nil && importFlag.Changed {
 		path := ""
 
 		server, err := client.ConnectIncusUnix(path, nil)
@@ -573,6 +635,10 @@ func (c *cmdIncus) run(cmd *cobra.Command, args []string, overlayDir string) err
 }
 
 func (c *cmdIncus) checkVMDependencies() error {
+	if isRootless() {
+		return errors.New("VM images require root, as they use loop devices")
+	}
+
 	dependencies := []string{"btrfs", "mkfs.ext4", "mkfs.vfat", "qemu-img", "rsync", "sgdisk"}
 
 	for _, dep := range dependencies {
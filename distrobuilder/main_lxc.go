@@ -61,6 +61,12 @@ func (c *cmdLXC) commandBuild() *cobra.Command {
 	c.cmdBuild.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use"+"``")
 	c.cmdBuild.Flags().StringVar(&c.global.flagSourcesDir, "sources-dir", filepath.Join(os.TempDir(), "distrobuilder"), "Sources directory for distribution tarballs"+"``")
 	c.cmdBuild.Flags().BoolVar(&c.global.flagKeepSources, "keep-sources", true, "Keep sources after build"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagCheckpoint, "checkpoint", false, "Save a checkpoint of the rootfs after each build stage"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagResume, "resume", false, "Resume from the latest valid checkpoint"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagChecksums, "checksums", false, "Write the checksums of the image files to SHA256SUMS"+"``")
+	c.cmdBuild.Flags().StringVar(&c.global.flagSignKey, "sign-key", "", "Sign the image files with the GPG secret key in this file"+"``")
+	c.cmdBuild.Flags().BoolVar(&c.global.flagDebugShellOnFailure, "debug-shell-on-failure", false, "Start a shell in the chroot if the build fails"+"``")
+	c.cmdBuild.Flags().StringVar(&c.global.flagPackageCacheDir, "package-cache-dir", "", "Directory to keep the downloaded packages in across builds"+"``")
 
 	return c.cmdBuild
 }
@@ -108,28 +114,38 @@ func (c *cmdLXC) commandPack() *cobra.Command {
 	}
 
 	c.cmdPack.Flags().StringVar(&c.flagCompression, "compression", "xz", "Type of compression to use"+"``")
+	c.cmdPack.Flags().BoolVar(&c.global.flagChecksums, "checksums", false, "Write the checksums of the image files to SHA256SUMS"+"``")
+	c.cmdPack.Flags().StringVar(&c.global.flagSignKey, "sign-key", "", "Sign the image files with the GPG secret key in this file"+"``")
+	c.cmdPack.Flags().BoolVar(&c.global.flagDebugShellOnFailure, "debug-shell-on-failure", false, "Start a shell in the chroot if the build fails"+"``")
+	c.cmdPack.Flags().StringVar(&c.global.flagPackageCacheDir, "package-cache-dir", "", "Directory to keep the downloaded packages in across builds"+"``")
 
 	return c.cmdPack
 }
 
-func (c *cmdLXC) runPack(cmd *cobra.Command, args []string, overlayDir string) error {
+func (c *cmdLXC) runPack(cmd *cobra.Command, args []string, overlayDir string) (err error) {
+	imageTargets := shared.ImageTargetAll | shared.ImageTargetContainer
+
 	// Setup the mounts and chroot into the rootfs
-	exitChroot, err := shared.SetupChroot(overlayDir, *c.global.definition, nil)
+	exitChroot, err := c.global.setupChroot(overlayDir, imageTargets)
 	if err != nil {
-		return fmt.Errorf("Failed to setup chroot: %w", err)
+		return err
 	}
 	// Unmount everything and exit the chroot
 	defer func() {
 		_ = exitChroot()
 	}()
 
-	imageTargets := shared.ImageTargetAll | shared.ImageTargetContainer
+	// Allow debugging failures before leaving the chroot
+	defer func() {
+		c.global.debugShell(err)
+	}()
 
 	manager, err := managers.Load(c.global.ctx, c.global.definition.Packages.Manager, c.global.logger, *c.global.definition)
 	if err != nil {
 		return fmt.Errorf("Failed to load manager %q: %w", c.global.definition.Packages.Manager, err)
 	}
 
+	c.global.startStage("repositories")
 	c.global.logger.Info("Managing repositories")
 
 	err = manager.ManageRepositories(imageTargets)
@@ -137,23 +153,13 @@ func (c *cmdLXC) runPack(cmd *cobra.Command, args []string, overlayDir string) e
 		return fmt.Errorf("Failed to manage repositories: %w", err)
 	}
 
-	c.global.logger.WithField("trigger", "post-unpack").Info("Running hooks")
-
-	// Run post unpack hook
-	for _, hook := range c.global.definition.GetRunnableActions("post-unpack", imageTargets) {
-		if hook.Pongo {
-			hook.Action, err = shared.RenderTemplate(hook.Action, c.global.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
-		}
-
-		err := shared.RunScript(c.global.ctx, hook.Action)
-		if err != nil {
-			return fmt.Errorf("Failed to run post-unpack: %w", err)
-		}
+	c.global.startStage("post-unpack")
+	err = c.global.runActions("post-unpack", imageTargets, "")
+	if err != nil {
+		return err
 	}
 
+	c.global.startStage("packages")
 	c.global.logger.Info("Managing packages")
 
 	// Install/remove/update packages
@@ -162,53 +168,59 @@ func (c *cmdLXC) runPack(cmd *cobra.Command, args []string, overlayDir string) e
 		return fmt.Errorf("Failed to manage packages: %w", err)
 	}
 
-	c.global.logger.WithField("trigger", "post-packages").Info("Running hooks")
-
-	// Run post packages hook
-	for _, hook := range c.global.definition.GetRunnableActions("post-packages", imageTargets) {
-		if hook.Pongo {
-			hook.Action, err = shared.RenderTemplate(hook.Action, c.global.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
-		}
-
-		err := shared.RunScript(c.global.ctx, hook.Action)
-		if err != nil {
-			return fmt.Errorf("Failed to run post-packages: %w", err)
-		}
+	c.global.startStage("post-packages")
+	err = c.global.runActions("post-packages", imageTargets, "")
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return c.global.listPackages(manager)
 }
 
 func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error {
 	img := image.NewLXCImage(c.global.ctx, overlayDir, c.global.targetDir,
 		c.global.flagCacheDir, *c.global.definition)
 
-	for _, file := range c.global.definition.Files {
-		if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer) {
-			c.global.logger.WithField("generator", file.Generator).Info("Skipping generator")
+	if !c.global.resumed(checkpointGenerators) {
+		c.global.startStage("generators")
 
-			continue
-		}
+		for _, file := range c.global.definition.Files {
+			if !shared.ApplyFilter(&file, c.global.definition.Image.Release, c.global.definition.Image.ArchitectureMapped, c.global.definition.Image.Variant, c.global.definition.Targets.Type, shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer) {
+				c.global.logger.WithField("generator", file.Generator).Info("Skipping generator")
 
-		generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
-		if err != nil {
-			return fmt.Errorf("Failed to load generator %q: %w", file.Generator, err)
-		}
+				continue
+			}
 
-		c.global.logger.WithField("generator", file.Generator).Info("Running generator")
+			generator, err := generators.Load(file.Generator, c.global.logger, c.global.flagCacheDir, overlayDir, file, *c.global.definition)
+			if err != nil {
+				return fmt.Errorf("Failed to load generator %q: %w", file.Generator, err)
+			}
+
+			c.global.logger.WithField("generator", file.Generator).Info("Running generator")
+
+			err = generator.RunLXC(img, c.global.definition.Targets.LXC)
+			if err != nil {
+				return fmt.Errorf("Failed to run generator %q: %w", file.Generator, err)
+			}
+
+			shared.RecordEvent(c.global.ctx, shared.Event{Type: shared.EventGeneratorRun, Generator: file.Generator, Path: file.Path})
+		}
 
-		err = generator.RunLXC(img, c.global.definition.Targets.LXC)
+		err := c.global.saveCheckpoint(checkpointGenerators, overlayDir, nil)
 		if err != nil {
-			return fmt.Errorf("Failed to run generator %q: %w", file.Generator, err)
+			return fmt.Errorf("Failed to save checkpoint: %w", err)
 		}
 	}
 
+	leaveCgroup, err := c.global.enterCgroup()
+	if err != nil {
+		return err
+	}
+
 	exitChroot, err := shared.SetupChroot(overlayDir,
 		*c.global.definition, nil)
 	if err != nil {
+		leaveCgroup()
 		return fmt.Errorf("Failed to setup chroot in %q: %w", overlayDir, err)
 	}
 
@@ -217,19 +229,15 @@ func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error
 		return fmt.Errorf("Failed adding systemd generator: %w", err)
 	}
 
-	c.global.logger.WithField("trigger", "post-files").Info("Running hooks")
+	for _, trigger := range []string{"post-generators", "post-files"} {
+		c.global.startStage(trigger)
 
-	// Run post files hook
-	for _, action := range c.global.definition.GetRunnableActions("post-files", shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer) {
-		if action.Pongo {
-			action.Action, err = shared.RenderTemplate(action.Action, c.global.definition)
-			if err != nil {
-				return fmt.Errorf("Failed to render action: %w", err)
-			}
-		}
-
-		err := shared.RunScript(c.global.ctx, action.Action)
+		err = c.global.runActions(trigger, shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer, "")
 		if err != nil {
+			c.global.debugShell(err)
+
+			leaveCgroup()
+
 			{
 				err := exitChroot()
 				if err != nil {
@@ -237,15 +245,30 @@ func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error
 				}
 			}
 
-			return fmt.Errorf("Failed to run post-files: %w", err)
+			return err
 		}
 	}
 
+	leaveCgroup()
+
 	err = exitChroot()
 	if err != nil {
 		return fmt.Errorf("Failed exiting chroot: %w", err)
 	}
 
+	c.global.startStage("pre-pack")
+
+	err = c.global.runActions("pre-pack", shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer, overlayDir)
+	if err != nil {
+		return err
+	}
+
+	err = c.global.makeReproducible(overlayDir, false)
+	if err != nil {
+		return err
+	}
+
+	c.global.startStage("pack")
 	c.global.logger.WithField("compression", c.flagCompression).Info("Creating LXC image")
 
 	err = img.Build(c.flagCompression)
@@ -253,5 +276,32 @@ func (c *cmdLXC) run(cmd *cobra.Command, args []string, overlayDir string) error
 		return fmt.Errorf("Failed to create LXC image: %w", err)
 	}
 
+	err = c.global.writeSBOM()
+	if err != nil {
+		return fmt.Errorf("Failed to create SBOM: %w", err)
+	}
+
+	err = c.global.writeChecksums()
+	if err != nil {
+		return fmt.Errorf("Failed to create checksums: %w", err)
+	}
+
+	c.global.startStage("post-pack")
+
+	env, err := c.global.packEnv()
+	if err != nil {
+		return err
+	}
+
+	err = c.global.runActions("post-pack", shared.ImageTargetUndefined|shared.ImageTargetAll|shared.ImageTargetContainer, overlayDir, env...)
+	if err != nil {
+		return err
+	}
+
+	err = c.global.writeBuildReport(getImageTargets("build-lxc", false))
+	if err != nil {
+		return fmt.Errorf("Failed to create build report: %w", err)
+	}
+
 	return nil
 }
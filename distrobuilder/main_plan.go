@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lxc/distrobuilder/v3/managers"
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+type cmdPlan struct {
+	cmdPlan *cobra.Command
+	global  *cmdGlobal
+
+	flagType          string
+	flagVM            bool
+	flagWithPostFiles bool
+}
+
+// planPrinter prints numbered build steps.
+type planPrinter struct {
+	w     io.Writer
+	steps int
+}
+
+func (p *planPrinter) step(format string, args ...any) {
+	p.steps++
+	fmt.Fprintf(p.w, "%d. %s\n", p.steps, fmt.Sprintf(format, args...))
+}
+
+func (p *planPrinter) detail(format string, args ...any) {
+	for _, line := range strings.Split(strings.TrimRight(fmt.Sprintf(format, args...), "\n"), "\n") {
+		fmt.Fprintf(p.w, "     %s\n", line)
+	}
+}
+
+func (c *cmdPlan) command() *cobra.Command {
+	c.cmdPlan = &cobra.Command{
+		Use:   "plan <filename|-> [--type=TYPE] [--vm]",
+		Short: "Show the build steps of a definition",
+		Long: `Show the build steps of a definition
+
+The steps are listed in the order they're run, after applying the filters
+for the given image type. The --type flag can take one of the following values:
+  - dir
+  - lxc
+  - incus (default)
+`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if !slices.Contains([]string{"dir", "lxc", "incus"}, c.flagType) {
+				return errors.New("--type needs to be one of ['dir', 'lxc', 'incus']")
+			}
+
+			if c.flagVM && c.flagType != "incus" {
+				return errors.New("--vm can only be used with --type=incus")
+			}
+
+			if c.flagWithPostFiles && c.flagType != "dir" {
+				return errors.New("--with-post-files can only be used with --type=dir")
+			}
+
+			return nil
+		},
+		RunE:          c.run,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	c.cmdPlan.Flags().StringVar(&c.flagType, "type", "incus", "Type of image to plan"+"``")
+	c.cmdPlan.Flags().BoolVar(&c.flagVM, "vm", false, "Plan a VM image"+"``")
+	c.cmdPlan.Flags().BoolVar(&c.flagWithPostFiles, "with-post-files", false, "Include post-generators and post-files actions for --type=dir"+"``")
+
+	return c.cmdPlan
+}
+
+func (c *cmdPlan) run(cmd *cobra.Command, args []string) error {
+	def, err := getDefinition(args[0], c.global.flagOptions, shared.BuildTime(c.global.ctx))
+	if err != nil {
+		return fmt.Errorf("Failed to get definition: %w", err)
+	}
+
+	builder := fmt.Sprintf("build-%s", c.flagType)
+	imageTargets := getImageTargets(builder, c.flagVM)
+
+	if c.flagVM {
+		def.Targets.Type = shared.DefinitionFilterTypeVM
+	}
+
+	def.Source.URL, err = shared.RenderTemplate(def.Source.URL, def)
+	if err != nil {
+		return fmt.Errorf("Failed to render source URL: %w", err)
+	}
+
+	p := planPrinter{w: cmd.OutOrStdout()}
+
+	err = c.printActions(&p, def, "pre-unpack", imageTargets)
+	if err != nil {
+		return err
+	}
+
+	// Downloader
+	p.step("Download source using %q", def.Source.Downloader)
+
+	if def.Source.URL != "" {
+		p.detail("url: %s", def.Source.URL)
+	}
+
+	// GetEarlyPackages modifies the package sets, so work on a copy like the downloaders do.
+	earlyDef := *def
+
+	for _, action := range []string{"install", "remove"} {
+		early := earlyDef.GetEarlyPackages(action)
+		if len(early) > 0 {
+			p.detail("early %s: %s", action, strings.Join(early, " "))
+		}
+	}
+
+	if def.Limits != (shared.DefinitionLimits{}) {
+		p.step("Limit the resources of the commands run in the chroot")
+
+		if def.Limits.MemoryMax != "" {
+			p.detail("memory max: %s", def.Limits.MemoryMax)
+		}
+
+		if def.Limits.CPUWeight > 0 {
+			p.detail("cpu weight: %d", def.Limits.CPUWeight)
+		}
+
+		if def.Limits.CPUQuota != "" {
+			p.detail("cpu quota: %s", def.Limits.CPUQuota)
+		}
+
+		if def.Limits.PidsMax > 0 {
+			p.detail("pids max: %d", def.Limits.PidsMax)
+		}
+
+		if def.Limits.IOWeight > 0 {
+			p.detail("io weight: %d", def.Limits.IOWeight)
+		}
+	}
+
+	for _, mount := range def.GetMounts("", imageTargets) {
+		if mount.Writable {
+			p.step("Mount %s at %s", mount.Source, mount.Target)
+		} else {
+			p.step("Mount %s at %s read-only", mount.Source, mount.Target)
+		}
+	}
+
+	manager := def.Packages.Manager
+	if manager == "" {
+		manager = "custom"
+	}
+
+	// Repositories
+	for _, repo := range def.Packages.Repositories {
+		if !shared.ApplyFilter(&repo, def.Image.Release, def.Image.ArchitectureMapped, def.Image.Variant, def.Targets.Type, imageTargets) {
+			continue
+		}
+
+		repo.URL, err = shared.RenderTemplate(repo.URL, def)
+		if err != nil {
+			return fmt.Errorf("Failed to render template: %w", err)
+		}
+
+		p.step("Add repository %q using %q", repo.Name, manager)
+		p.detail("%s", repo.URL)
+	}
+
+	err = c.printActions(&p, def, "post-unpack", imageTargets)
+	if err != nil {
+		return err
+	}
+
+	// Packages
+	sets := managers.GetPackageSets(*def, imageTargets)
+
+	if len(sets) > 0 || def.Packages.Update {
+		p.step("Refresh package database using %q", manager)
+	}
+
+	if def.Packages.Update {
+		p.step("Update packages using %q", manager)
+
+		err = c.printActions(&p, def, "post-update", imageTargets)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, set := range sets {
+		p.step("%s packages using %q", strings.ToUpper(set.Action[:1])+set.Action[1:], manager)
+		p.detail("%s", strings.Join(set.Packages, " "))
+
+		if len(set.Flags) > 0 {
+			p.detail("flags: %s", strings.Join(set.Flags, " "))
+		}
+	}
+
+	if def.Packages.Cleanup {
+		p.step("Clean up packages using %q", manager)
+	}
+
+	err = c.printActions(&p, def, "post-packages", imageTargets)
+	if err != nil {
+		return err
+	}
+
+	// Generators
+	for _, file := range def.Files {
+		if !shared.ApplyFilter(&file, def.Image.Release, def.Image.ArchitectureMapped, def.Image.Variant, def.Targets.Type, imageTargets) {
+			continue
+		}
+
+		p.step("Run generator %q for %s", file.Generator, file.Path)
+	}
+
+	// build-dir only runs the post-generators and post-files actions with --with-post-files
+	if c.flagType != "dir" || c.flagWithPostFiles {
+		for _, trigger := range []string{"post-generators", "post-files"} {
+			err = c.printActions(&p, def, trigger, imageTargets)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// build-dir doesn't pack the rootfs
+	if c.flagType == "dir" {
+		return nil
+	}
+
+	err = c.printActions(&p, def, "pre-pack", imageTargets)
+	if err != nil {
+		return err
+	}
+
+	switch c.flagType {
+	case "lxc":
+		p.step("Create LXC image")
+	case "incus":
+		if c.flagVM {
+			p.step("Create Incus VM image")
+		} else {
+			p.step("Create Incus container image")
+		}
+	}
+
+	return c.printActions(&p, def, "post-pack", imageTargets)
+}
+
+func (c *cmdPlan) printActions(p *planPrinter, def *shared.Definition, trigger string, imageTargets shared.ImageTarget) error {
+	var err error
+
+	mounts := def.GetMounts(trigger, imageTargets)
+
+	for _, action := range def.GetRunnableActions(trigger, imageTargets) {
+		if action.Pongo {
+			action.Action, err = shared.RenderTemplate(action.Action, def)
+			if err != nil {
+				return fmt.Errorf("Failed to render action: %w", err)
+			}
+		}
+
+		if action.Host {
+			p.step("Run %s action on the host", trigger)
+		} else {
+			p.step("Run %s action", trigger)
+		}
+
+		if action.Network == shared.ActionNetworkNone || action.Network == "" && slices.Contains(c.global.flagOfflineActions, trigger) {
+			p.detail("network: none")
+		}
+
+		if action.Interpreter != "" {
+			p.detail("interpreter: %s", action.Interpreter)
+		}
+
+		if action.Timeout != "" {
+			p.detail("timeout: %s", action.Timeout)
+		}
+
+		if action.Retries > 0 {
+			p.detail("retries: %d", action.Retries)
+		}
+
+		for _, mount := range mounts {
+			if mount.Writable {
+				p.detail("mount: %s at %s", mount.Source, mount.Target)
+			} else {
+				p.detail("mount: %s at %s read-only", mount.Source, mount.Target)
+			}
+		}
+
+		p.detail("%s", action.Action)
+	}
+
+	return nil
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lxc/incus/v7/shared/api"
+	incus "github.com/lxc/incus/v7/shared/util"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+// Simplestreams item names and file types.
+const (
+	simplestreamsMetaItem     = "incus.tar.xz"
+	simplestreamsSquashfsItem = "root.squashfs"
+	simplestreamsDiskItem     = "disk.qcow2"
+
+	simplestreamsMetaType     = "incus.tar.xz"
+	simplestreamsSquashfsType = "squashfs"
+	simplestreamsDiskType     = "disk-kvm.img"
+
+	// simplestreamsVMVersionSuffix is appended to the serial of VMs whose
+	// metadata differs from the container with the same serial.
+	simplestreamsVMVersionSuffix = "-vm"
+)
+
+type cmdPublishSimplestreams struct {
+	cmdPublish *cobra.Command
+	global     *cmdGlobal
+
+	flagKeep uint
+}
+
+type simplestreamsIndex struct {
+	Format string                             `json:"format"`
+	Index  map[string]simplestreamsIndexEntry `json:"index"`
+}
+
+type simplestreamsIndexEntry struct {
+	DataType string   `json:"datatype"`
+	Path     string   `json:"path"`
+	Format   string   `json:"format"`
+	Products []string `json:"products"`
+}
+
+type simplestreamsProducts struct {
+	ContentID string                          `json:"content_id"`
+	DataType  string                          `json:"datatype"`
+	Format    string                          `json:"format"`
+	Products  map[string]simplestreamsProduct `json:"products"`
+}
+
+type simplestreamsProduct struct {
+	Aliases         string                          `json:"aliases"`
+	Architecture    string                          `json:"arch"`
+	OperatingSystem string                          `json:"os"`
+	Release         string                          `json:"release"`
+	ReleaseTitle    string                          `json:"release_title"`
+	Variant         string                          `json:"variant"`
+	Versions        map[string]simplestreamsVersion `json:"versions"`
+}
+
+type simplestreamsVersion struct {
+	Items map[string]simplestreamsItem `json:"items"`
+}
+
+type simplestreamsItem struct {
+	FileType                 string `json:"ftype"`
+	Path                     string `json:"path"`
+	Size                     int64  `json:"size"`
+	SHA256                   string `json:"sha256"`
+	CombinedSquashfsSHA256   string `json:"combined_squashfs_sha256,omitempty"`
+	CombinedDiskKVMImgSHA256 string `json:"combined_disk-kvm-img_sha256,omitempty"`
+}
+
+// simplestreamsImage is a split image built by build-incus or pack-incus.
+type simplestreamsImage struct {
+	dir      string
+	rootfs   string
+	vm       bool
+	metadata api.ImageMetadata
+}
+
+func (c *cmdPublishSimplestreams) command() *cobra.Command {
+	c.cmdPublish = &cobra.Command{
+		Use:   "publish-simplestreams <target dir> <image dir...>",
+		Short: "Add Incus images to a simplestreams tree",
+		Long: `Add Incus images to a simplestreams tree
+
+The image directories contain the output of build-incus or pack-incus in the
+split format, either a container (rootfs.squashfs) or a VM (disk.qcow2) image.
+The images are copied into the target directory and listed in
+streams/v1/index.json and streams/v1/images.json, which can be served by any
+web server as an Incus image server.
+
+Expired images, and all but the latest --keep versions of each image, are
+removed.
+`,
+		Args:          cobra.MinimumNArgs(2),
+		RunE:          c.run,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	c.cmdPublish.Flags().UintVar(&c.flagKeep, "keep", 3, "Number of versions to keep of each image (0 keeps all)"+"``")
+
+	return c.cmdPublish
+}
+
+func (c *cmdPublishSimplestreams) run(cmd *cobra.Command, args []string) error {
+	targetDir := args[0]
+
+	products, err := readSimplestreamsProducts(targetDir)
+	if err != nil {
+		return err
+	}
+
+	var images []simplestreamsImage
+
+	for _, dir := range args[1:] {
+		dirImages, err := c.readImages(dir)
+		if err != nil {
+			return fmt.Errorf("Failed to read image %q: %w", dir, err)
+		}
+
+		images = append(images, dirImages...)
+	}
+
+	// Add containers first, so that their metadata is preferred for the
+	// incus.tar.xz item.
+	slices.SortStableFunc(images, func(a, b simplestreamsImage) int {
+		if a.vm == b.vm {
+			return 0
+		} else if a.vm {
+			return 1
+		}
+
+		return -1
+	})
+
+	for _, img := range images {
+		err := addSimplestreamsImage(products, targetDir, img)
+		if err != nil {
+			return fmt.Errorf("Failed to add image %q: %w", img.dir, err)
+		}
+
+		c.global.logger.WithFields(logrus.Fields{"image": img.dir, "serial": img.metadata.Properties["serial"], "vm": img.vm}).Info("Added image")
+	}
+
+	removed, err := c.prune(products, targetDir, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, version := range removed {
+		c.global.logger.WithField("version", version).Info("Removed image")
+	}
+
+	return writeSimplestreams(products, targetDir)
+}
+
+// readImages returns the images of an image directory. A directory can
+// contain both a container and a VM image, if they share their metadata.
+func (c *cmdPublishSimplestreams) readImages(dir string) ([]simplestreamsImage, error) {
+	var out bytes.Buffer
+
+	err := shared.RunCommand(c.global.ctx, nil, &out, "tar", "-xOf", filepath.Join(dir, simplestreamsMetaItem), "metadata.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read metadata: %w", err)
+	}
+
+	var metadata api.ImageMetadata
+
+	err = yaml.Unmarshal(out.Bytes(), &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse metadata: %w", err)
+	}
+
+	for _, property := range []string{"os", "release", "variant", "serial"} {
+		if metadata.Properties[property] == "" {
+			return nil, fmt.Errorf("Metadata property %q isn't set", property)
+		}
+	}
+
+	var images []simplestreamsImage
+
+	for _, rootfs := range []string{"rootfs.squashfs", "disk.qcow2"} {
+		if !incus.PathExists(filepath.Join(dir, rootfs)) {
+			continue
+		}
+
+		images = append(images, simplestreamsImage{dir: dir, rootfs: rootfs, vm: rootfs == "disk.qcow2", metadata: metadata})
+	}
+
+	if len(images) == 0 {
+		return nil, errors.New("Neither rootfs.squashfs nor disk.qcow2 found, only split images are supported")
+	}
+
+	return images, nil
+}
+
+// prune removes the expired versions and all but the latest versions of each
+// product. It returns the removed versions.
+func (c *cmdPublishSimplestreams) prune(products *simplestreamsProducts, targetDir string, now time.Time) ([]string, error) {
+	var removed []string
+
+	for id, product := range products.Products {
+		serials := make([]string, 0, len(product.Versions))
+
+		for serial := range product.Versions {
+			serials = append(serials, serial)
+		}
+
+		// Serials sort by date, newest first.
+		slices.Sort(serials)
+		slices.Reverse(serials)
+
+		// The VM version of a serial counts as the same build.
+		var builds []string
+
+		for _, serial := range serials {
+			version := product.Versions[serial]
+
+			build := strings.TrimSuffix(serial, simplestreamsVMVersionSuffix)
+			if !slices.Contains(builds, build) {
+				builds = append(builds, build)
+			}
+
+			remove := c.flagKeep > 0 && uint(len(builds)) > c.flagKeep
+			if !remove {
+				expiry, err := c.expiryDate(targetDir, version)
+				if err != nil {
+					return nil, fmt.Errorf("Failed to get expiry date of %s:%s: %w", id, serial, err)
+				}
+
+				remove = !expiry.IsZero() && expiry.Before(now)
+			}
+
+			if !remove {
+				continue
+			}
+
+			for _, item := range version.Items {
+				err := os.RemoveAll(filepath.Join(targetDir, filepath.Dir(item.Path)))
+				if err != nil {
+					return nil, fmt.Errorf("Failed to remove %s:%s: %w", id, serial, err)
+				}
+			}
+
+			delete(product.Versions, serial)
+			removed = append(removed, fmt.Sprintf("%s:%s", id, serial))
+		}
+
+		if len(product.Versions) == 0 {
+			delete(products.Products, id)
+		}
+	}
+
+	slices.Sort(removed)
+
+	return removed, nil
+}
+
+// expiryDate returns the expiry date set in the image metadata of the
+// version, or the zero time if the image doesn't expire.
+func (c *cmdPublishSimplestreams) expiryDate(targetDir string, version simplestreamsVersion) (time.Time, error) {
+	item, ok := version.Items[simplestreamsMetaItem]
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	var out bytes.Buffer
+
+	err := shared.RunCommand(c.global.ctx, nil, &out, "tar", "-xOf", filepath.Join(targetDir, item.Path), "metadata.yaml")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to read metadata: %w", err)
+	}
+
+	var metadata api.ImageMetadata
+
+	err = yaml.Unmarshal(out.Bytes(), &metadata)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to parse metadata: %w", err)
+	}
+
+	if metadata.ExpiryDate == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(metadata.ExpiryDate, 0), nil
+}
+
+// readSimplestreamsProducts reads the products of the simplestreams tree. If
+// the tree doesn't exist yet, no products are returned.
+func readSimplestreamsProducts(targetDir string) (*simplestreamsProducts, error) {
+	products := simplestreamsProducts{
+		ContentID: "images",
+		DataType:  "image-downloads",
+		Format:    "products:1.0",
+		Products:  map[string]simplestreamsProduct{},
+	}
+
+	data, err := os.ReadFile(filepath.Join(targetDir, "streams", "v1", "images.json"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &products, nil
+		}
+
+		return nil, fmt.Errorf("Failed to read images.json: %w", err)
+	}
+
+	err = json.Unmarshal(data, &products)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse images.json: %w", err)
+	}
+
+	if products.Products == nil {
+		products.Products = map[string]simplestreamsProduct{}
+	}
+
+	return &products, nil
+}
+
+// addSimplestreamsImage copies the image into the simplestreams tree and adds
+// it to its product. Images whose version already contains the same image are
+// skipped.
+func addSimplestreamsImage(products *simplestreamsProducts, targetDir string, img simplestreamsImage) error {
+	arch, err := shared.GetArch("debian", img.metadata.Architecture)
+	if err != nil {
+		return fmt.Errorf("Failed to get architecture: %w", err)
+	}
+
+	osName := img.metadata.Properties["os"]
+	release := img.metadata.Properties["release"]
+	variant := img.metadata.Properties["variant"]
+	serial := img.metadata.Properties["serial"]
+
+	id := fmt.Sprintf("%s:%s:%s:%s", strings.ToLower(osName), release, arch, variant)
+
+	product, ok := products.Products[id]
+	if !ok {
+		aliases := []string{fmt.Sprintf("%s/%s/%s", strings.ToLower(osName), release, variant)}
+		if variant == "default" {
+			aliases = append(aliases, fmt.Sprintf("%s/%s", strings.ToLower(osName), release))
+		}
+
+		product = simplestreamsProduct{
+			Aliases:         strings.Join(aliases, ","),
+			Architecture:    arch,
+			OperatingSystem: osName,
+			Release:         release,
+			ReleaseTitle:    release,
+			Variant:         variant,
+			Versions:        map[string]simplestreamsVersion{},
+		}
+	}
+
+	rootfsItem := simplestreamsItem{FileType: simplestreamsSquashfsType}
+	rootfsName := simplestreamsSquashfsItem
+
+	if img.vm {
+		rootfsItem = simplestreamsItem{FileType: simplestreamsDiskType}
+		rootfsName = simplestreamsDiskItem
+	}
+
+	metaItem := simplestreamsItem{FileType: simplestreamsMetaType}
+
+	combined, err := hashSimplestreamsImage(img, &metaItem, &rootfsItem)
+	if err != nil {
+		return err
+	}
+
+	versionName := serial
+
+	version, ok := product.Versions[versionName]
+	if !ok {
+		version = simplestreamsVersion{Items: map[string]simplestreamsItem{}}
+	}
+
+	// Incus only reads one metadata item per version, so containers and VMs
+	// only share a version if their metadata is identical. Otherwise, the VM
+	// gets its own version.
+	existing, ok := version.Items[simplestreamsMetaItem]
+	_, hasRootfs := version.Items[rootfsName]
+
+	if ok && existing.SHA256 != metaItem.SHA256 && !hasRootfs {
+		vmVersionName := serial + simplestreamsVMVersionSuffix
+
+		if img.vm {
+			versionName = vmVersionName
+		} else {
+			// The version only contains a VM, which is moved to its own version.
+			err = moveSimplestreamsVersion(&product, targetDir, serial, vmVersionName)
+			if err != nil {
+				return err
+			}
+
+			versionName = serial
+		}
+
+		version, ok = product.Versions[versionName]
+		if !ok {
+			version = simplestreamsVersion{Items: map[string]simplestreamsItem{}}
+		}
+	}
+
+	versionDir := simplestreamsVersionDir(osName, release, arch, variant, versionName)
+	rootfsItem.Path = filepath.Join(versionDir, rootfsName)
+
+	existing, ok = version.Items[rootfsName]
+	if ok {
+		if existing.SHA256 == rootfsItem.SHA256 {
+			return nil
+		}
+
+		return fmt.Errorf("Version %q of %q already contains a different %s", versionName, id, rootfsName)
+	}
+
+	existing, ok = version.Items[simplestreamsMetaItem]
+	if ok && existing.SHA256 != metaItem.SHA256 {
+		return fmt.Errorf("Version %q of %q already contains different metadata", versionName, id)
+	}
+
+	err = os.MkdirAll(filepath.Join(targetDir, versionDir), 0o755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", versionDir, err)
+	}
+
+	err = shared.Copy(filepath.Join(img.dir, img.rootfs), filepath.Join(targetDir, rootfsItem.Path))
+	if err != nil {
+		return err
+	}
+
+	existing, ok = version.Items[simplestreamsMetaItem]
+	if ok {
+		metaItem = existing
+	} else {
+		metaItem.Path = filepath.Join(versionDir, simplestreamsMetaItem)
+
+		err = shared.Copy(filepath.Join(img.dir, simplestreamsMetaItem), filepath.Join(targetDir, metaItem.Path))
+		if err != nil {
+			return err
+		}
+	}
+
+	if img.vm {
+		metaItem.CombinedDiskKVMImgSHA256 = combined
+	} else {
+		metaItem.CombinedSquashfsSHA256 = combined
+	}
+
+	version.Items[simplestreamsMetaItem] = metaItem
+	version.Items[rootfsName] = rootfsItem
+	product.Versions[versionName] = version
+	products.Products[id] = product
+
+	return nil
+}
+
+// simplestreamsVersionDir returns the directory of the files of a version.
+func simplestreamsVersionDir(osName string, release string, arch string, variant string, version string) string {
+	return filepath.Join("images", strings.ToLower(osName), release, arch, variant, version)
+}
+
+// moveSimplestreamsVersion renames a version of the product, including the
+// directory of its files.
+func moveSimplestreamsVersion(product *simplestreamsProduct, targetDir string, from string, to string) error {
+	_, ok := product.Versions[to]
+	if ok {
+		return fmt.Errorf("Version %q already exists", to)
+	}
+
+	version := product.Versions[from]
+	fromDir := simplestreamsVersionDir(product.OperatingSystem, product.Release, product.Architecture, product.Variant, from)
+	toDir := simplestreamsVersionDir(product.OperatingSystem, product.Release, product.Architecture, product.Variant, to)
+
+	err := os.Rename(filepath.Join(targetDir, fromDir), filepath.Join(targetDir, toDir))
+	if err != nil {
+		return fmt.Errorf("Failed to move version %q: %w", from, err)
+	}
+
+	for name, item := range version.Items {
+		item.Path = filepath.Join(toDir, name)
+		version.Items[name] = item
+	}
+
+	product.Versions[to] = version
+	delete(product.Versions, from)
+
+	return nil
+}
+
+// hashSimplestreamsImage sets the checksums and sizes of the metadata and
+// rootfs items, and returns their combined checksum, which is the fingerprint
+// of the image.
+func hashSimplestreamsImage(img simplestreamsImage, metaItem *simplestreamsItem, rootfsItem *simplestreamsItem) (string, error) {
+	combinedHash := sha256.New()
+
+	// The combined checksum covers the metadata followed by the rootfs.
+	for _, file := range []struct {
+		path string
+		item *simplestreamsItem
+	}{
+		{filepath.Join(img.dir, simplestreamsMetaItem), metaItem},
+		{filepath.Join(img.dir, img.rootfs), rootfsItem},
+	} {
+		f, err := os.Open(file.path)
+		if err != nil {
+			return "", fmt.Errorf("Failed to open %q: %w", file.path, err)
+		}
+
+		hash := sha256.New()
+
+		file.item.Size, err = io.Copy(io.MultiWriter(hash, combinedHash), f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("Failed to hash %q: %w", file.path, err)
+		}
+
+		file.item.SHA256 = fmt.Sprintf("%x", hash.Sum(nil))
+	}
+
+	return fmt.Sprintf("%x", combinedHash.Sum(nil)), nil
+}
+
+// writeSimplestreams writes images.json and index.json of the simplestreams
+// tree. The files are replaced atomically, as they may be served while being
+// updated.
+func writeSimplestreams(products *simplestreamsProducts, targetDir string) error {
+	ids := make([]string, 0, len(products.Products))
+
+	for id := range products.Products {
+		ids = append(ids, id)
+	}
+
+	slices.Sort(ids)
+
+	index := simplestreamsIndex{
+		Format: "index:1.0",
+		Index: map[string]simplestreamsIndexEntry{
+			"images": {
+				DataType: products.DataType,
+				Path:     "streams/v1/images.json",
+				Format:   products.Format,
+				Products: ids,
+			},
+		},
+	}
+
+	streamsDir := filepath.Join(targetDir, "streams", "v1")
+
+	err := os.MkdirAll(streamsDir, 0o755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", streamsDir, err)
+	}
+
+	// The index refers to the products, so it's written last.
+	for _, file := range []struct {
+		name    string
+		content any
+	}{{"images.json", products}, {"index.json", index}} {
+		name := file.name
+
+		data, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Failed to marshal %s: %w", name, err)
+		}
+
+		path := filepath.Join(streamsDir, name)
+
+		err = os.WriteFile(path+".tmp", append(data, '\n'), 0o644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %s: %w", name, err)
+		}
+
+		err = os.Rename(path+".tmp", path)
+		if err != nil {
+			return fmt.Errorf("Failed to replace %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// createSplitImage creates the output of build-incus in dir.
+func createSplitImage(t *testing.T, dir string, serial string, expiry time.Time, rootfs string, content string) {
+	t.Helper()
+
+	metaDir := t.TempDir()
+
+	metadata := fmt.Sprintf(`architecture: x86_64
+creation_date: 1700000000
+expiry_date: %d
+properties:
+  os: Alpine
+  release: "3.19"
+  variant: default
+  serial: %s
+`, expiry.Unix(), serial)
+
+	require.NoError(t, os.WriteFile(filepath.Join(metaDir, "metadata.yaml"), []byte(metadata), 0o644))
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, exec.Command("tar", "-cf", filepath.Join(dir, "incus.tar.xz"), "-C", metaDir, "metadata.yaml").Run())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, rootfs), []byte(content), 0o644))
+}
+
+func readImagesJSON(t *testing.T, targetDir string) simplestreamsProducts {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(targetDir, "streams", "v1", "images.json"))
+	require.NoError(t, err)
+
+	var products simplestreamsProducts
+
+	require.NoError(t, json.Unmarshal(data, &products))
+
+	return products
+}
+
+func TestPublishSimplestreams(t *testing.T) {
+	dir := t.TempDir()
+	targetDir := filepath.Join(dir, "images")
+	expiry := time.Now().Add(24 * time.Hour)
+
+	createSplitImage(t, filepath.Join(dir, "container"), "20240101_0000", expiry, "rootfs.squashfs", "container")
+	createSplitImage(t, filepath.Join(dir, "vm"), "20240101_0000", expiry, "disk.qcow2", "vm")
+
+	c := cmdPublishSimplestreams{global: &cmdGlobal{ctx: context.Background(), logger: logrus.New()}}
+	cmd := c.command()
+	require.NoError(t, cmd.ParseFlags([]string{"--keep=1"}))
+
+	// VMs are added after containers, so the order doesn't matter.
+	err := c.run(cmd, []string{targetDir, filepath.Join(dir, "vm"), filepath.Join(dir, "container")})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(targetDir, "streams", "v1", "index.json"))
+	require.NoError(t, err)
+
+	var index simplestreamsIndex
+
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Equal(t, []string{"alpine:3.19:amd64:default"}, index.Index["images"].Products)
+
+	products := readImagesJSON(t, targetDir)
+	product := products.Products["alpine:3.19:amd64:default"]
+	require.Equal(t, "alpine/3.19/default,alpine/3.19", product.Aliases)
+	require.Equal(t, "amd64", product.Architecture)
+	require.Equal(t, "Alpine", product.OperatingSystem)
+
+	// The container and VM share their metadata.
+	items := product.Versions["20240101_0000"].Items
+	require.Len(t, items, 3)
+
+	meta, err := os.ReadFile(filepath.Join(dir, "container", "incus.tar.xz"))
+	require.NoError(t, err)
+
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(meta)), items["incus.tar.xz"].SHA256)
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(append(meta, "container"...))), items["incus.tar.xz"].CombinedSquashfsSHA256)
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(append(meta, "vm"...))), items["incus.tar.xz"].CombinedDiskKVMImgSHA256)
+	require.Equal(t, "squashfs", items["root.squashfs"].FileType)
+	require.Equal(t, "disk-kvm.img", items["disk.qcow2"].FileType)
+	require.Equal(t, int64(2), items["disk.qcow2"].Size)
+	require.FileExists(t, filepath.Join(targetDir, items["disk.qcow2"].Path))
+
+	// Publishing the same image again is a no-op, a different one fails.
+	err = c.run(cmd, []string{targetDir, filepath.Join(dir, "container")})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "container", "rootfs.squashfs"), []byte("other"), 0o644))
+
+	err = c.run(cmd, []string{targetDir, filepath.Join(dir, "container")})
+	require.ErrorContains(t, err, "already contains a different root.squashfs")
+
+	// Older versions are pruned.
+	createSplitImage(t, filepath.Join(dir, "new"), "20240102_0000", expiry, "rootfs.squashfs", "new")
+
+	err = c.run(cmd, []string{targetDir, filepath.Join(dir, "new")})
+	require.NoError(t, err)
+
+	products = readImagesJSON(t, targetDir)
+	require.Len(t, products.Products["alpine:3.19:amd64:default"].Versions, 1)
+	require.Contains(t, products.Products["alpine:3.19:amd64:default"].Versions, "20240102_0000")
+	require.NoDirExists(t, filepath.Join(targetDir, filepath.Dir(items["disk.qcow2"].Path)))
+
+	// Expired versions are pruned.
+	createSplitImage(t, filepath.Join(dir, "expired"), "20240103_0000", time.Now().Add(-time.Hour), "rootfs.squashfs", "expired")
+	require.NoError(t, cmd.ParseFlags([]string{"--keep=0"}))
+
+	err = c.run(cmd, []string{targetDir, filepath.Join(dir, "expired")})
+	require.NoError(t, err)
+
+	products = readImagesJSON(t, targetDir)
+	require.Len(t, products.Products["alpine:3.19:amd64:default"].Versions, 1)
+	require.Contains(t, products.Products["alpine:3.19:amd64:default"].Versions, "20240102_0000")
+}
+
+func TestPublishSimplestreamsVMMetadata(t *testing.T) {
+	dir := t.TempDir()
+	targetDir := filepath.Join(dir, "images")
+	expiry := time.Now().Add(24 * time.Hour)
+
+	createSplitImage(t, filepath.Join(dir, "vm"), "20240101_0000", expiry, "disk.qcow2", "vm")
+	createSplitImage(t, filepath.Join(dir, "container"), "20240101_0000", expiry.Add(time.Hour), "rootfs.squashfs", "container")
+
+	c := cmdPublishSimplestreams{global: &cmdGlobal{ctx: context.Background(), logger: logrus.New()}}
+	cmd := c.command()
+
+	// The VM is published first, and moved to its own version once the
+	// container is published with different metadata.
+	require.NoError(t, c.run(cmd, []string{targetDir, filepath.Join(dir, "vm")}))
+	require.NoError(t, c.run(cmd, []string{targetDir, filepath.Join(dir, "container")}))
+
+	products := readImagesJSON(t, targetDir)
+	versions := products.Products["alpine:3.19:amd64:default"].Versions
+	require.Len(t, versions, 2)
+
+	items := versions["20240101_0000"].Items
+	require.Len(t, items, 2)
+	require.NotEmpty(t, items["incus.tar.xz"].CombinedSquashfsSHA256)
+	require.Empty(t, items["incus.tar.xz"].CombinedDiskKVMImgSHA256)
+	require.Contains(t, items, "root.squashfs")
+
+	items = versions["20240101_0000-vm"].Items
+	require.Len(t, items, 2)
+	require.NotEmpty(t, items["incus.tar.xz"].CombinedDiskKVMImgSHA256)
+	require.Empty(t, items["incus.tar.xz"].CombinedSquashfsSHA256)
+	require.Equal(t, filepath.Join("images", "alpine", "3.19", "amd64", "default", "20240101_0000-vm", "disk.qcow2"), items["disk.qcow2"].Path)
+	require.FileExists(t, filepath.Join(targetDir, items["incus.tar.xz"].Path))
+	require.FileExists(t, filepath.Join(targetDir, items["disk.qcow2"].Path))
+
+	// Publishing the VM again is skipped.
+	require.NoError(t, c.run(cmd, []string{targetDir, filepath.Join(dir, "vm")}))
+
+	products = readImagesJSON(t, targetDir)
+	require.Len(t, products.Products["alpine:3.19:amd64:default"].Versions, 2)
+
+	// Both versions count as one build when pruning.
+	require.NoError(t, cmd.ParseFlags([]string{"--keep=1"}))
+	require.NoError(t, c.run(cmd, []string{targetDir, filepath.Join(dir, "container")}))
+
+	products = readImagesJSON(t, targetDir)
+	require.Len(t, products.Products["alpine:3.19:amd64:default"].Versions, 2)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+type cmdRender struct {
+	cmdRender *cobra.Command
+	global    *cmdGlobal
+
+	flagFormat string
+	flagType   string
+	flagVM     bool
+}
+
+func (c *cmdRender) command() *cobra.Command {
+	c.cmdRender = &cobra.Command{
+		Use:   "render <filename|-> [--format=FORMAT] [--type=TYPE] [--vm]",
+		Short: "Show the effective definition",
+		Long: `Show the effective definition
+
+The definition is shown after applying defaults, overrides and templates. Only
+the files, actions, package sets, environment variables and variable values
+matching the filters for the given image type are included. The --type flag
+can take one of the following values:
+  - dir
+  - lxc
+  - incus (default)
+
+The --format flag can be either yaml (default) or json.
+`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if !slices.Contains([]string{"yaml", "json"}, c.flagFormat) {
+				return errors.New("--format needs to be one of ['yaml', 'json']")
+			}
+
+			if !slices.Contains([]string{"dir", "lxc", "incus"}, c.flagType) {
+				return errors.New("--type needs to be one of ['dir', 'lxc', 'incus']")
+			}
+
+			if c.flagVM && c.flagType != "incus" {
+				return errors.New("--vm can only be used with --type=incus")
+			}
+
+			return nil
+		},
+		RunE:          c.run,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	c.cmdRender.Flags().StringVar(&c.flagFormat, "format", "yaml", "Output format"+"``")
+	c.cmdRender.Flags().StringVar(&c.flagType, "type", "incus", "Type of image to render the definition for"+"``")
+	c.cmdRender.Flags().BoolVar(&c.flagVM, "vm", false, "Render the definition for a VM image"+"``")
+
+	return c.cmdRender
+}
+
+func (c *cmdRender) run(cmd *cobra.Command, args []string) error {
+	def, err := getDefinition(args[0], c.global.flagOptions, shared.BuildTime(c.global.ctx))
+	if err != nil {
+		return fmt.Errorf("Failed to get definition: %w", err)
+	}
+
+	imageTargets := getImageTargets(fmt.Sprintf("build-%s", c.flagType), c.flagVM)
+
+	if c.flagVM {
+		def.Targets.Type = shared.DefinitionFilterTypeVM
+	}
+
+	err = renderDefinition(def, imageTargets)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+
+	if c.flagFormat == "json" {
+		out, err = definitionToJSON(def)
+		if err != nil {
+			return fmt.Errorf("Failed to convert definition to JSON: %w", err)
+		}
+
+		out = append(out, '\n')
+	} else {
+		out, err = yaml.Marshal(def)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal definition: %w", err)
+		}
+	}
+
+	_, err = cmd.OutOrStdout().Write(out)
+
+	return err
+}
+
+// renderDefinition renders the templates of the definition and removes all
+// entries which don't match the image targets.
+func renderDefinition(def *shared.Definition, imageTargets shared.ImageTarget) error {
+	var err error
+
+	for i, key := range def.Source.Keys {
+		def.Source.Keys[i], err = shared.RenderTemplate(key, def)
+		if err != nil {
+			return fmt.Errorf("Failed to render source keys: %w", err)
+		}
+	}
+
+	def.Source.URL, err = shared.RenderTemplate(def.Source.URL, def)
+	if err != nil {
+		return fmt.Errorf("Failed to render source URL: %w", err)
+	}
+
+	def.Image.Name, err = shared.RenderTemplate(def.Image.Name, def)
+	if err != nil {
+		return fmt.Errorf("Failed to render image name: %w", err)
+	}
+
+	def.Image.Description, err = shared.RenderTemplate(def.Image.Description, def)
+	if err != nil {
+		return fmt.Errorf("Failed to render image description: %w", err)
+	}
+
+	match := func(filter shared.Filter) bool {
+		return shared.ApplyFilter(filter, def.Image.Release, def.Image.ArchitectureMapped, def.Image.Variant, def.Targets.Type, imageTargets)
+	}
+
+	def.Files = slices.DeleteFunc(def.Files, func(file shared.DefinitionFile) bool {
+		return !match(&file)
+	})
+
+	def.Actions = slices.DeleteFunc(def.Actions, func(action shared.DefinitionAction) bool {
+		return !match(&action)
+	})
+
+	def.Mounts = slices.DeleteFunc(def.Mounts, func(mount shared.DefinitionMount) bool {
+		return !match(&mount)
+	})
+
+	def.Packages.Sets = slices.DeleteFunc(def.Packages.Sets, func(set shared.DefinitionPackagesSet) bool {
+		return !match(&set)
+	})
+
+	def.Environment.EnvVariables = slices.DeleteFunc(def.Environment.EnvVariables, func(env shared.DefinitionEnvVars) bool {
+		return !match(&env)
+	})
+
+	variables := def.GetVariables()
+	def.Variables = make(map[string]shared.DefinitionVariable, len(variables))
+
+	for name, value := range variables {
+		def.Variables[name] = shared.DefinitionVariable{{Value: value}}
+	}
+
+	return nil
+}
+
+// definitionToJSON converts the definition to JSON using the YAML field names.
+func definitionToJSON(def *shared.Definition) ([]byte, error) {
+	data, err := yaml.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+
+	var out any
+
+	err = yaml.Unmarshal(data, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(yamlToJSONValue(out), "", "  ")
+}
+
+// yamlToJSONValue converts the maps returned by the YAML parser to maps with
+// string keys, so they can be encoded as JSON.
+func yamlToJSONValue(value any) any {
+	switch v := value.(type) {
+	case map[any]any:
+		out := make(map[string]any, len(v))
+
+		for key, val := range v {
+			out[fmt.Sprint(key)] = yamlToJSONValue(val)
+		}
+
+		return out
+	case []any:
+		for i, val := range v {
+			v[i] = yamlToJSONValue(val)
+		}
+
+		return v
+	}
+
+	return value
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+func TestRenderDefinition(t *testing.T) {
+	def := shared.Definition{
+		Image: shared.DefinitionImage{
+			Distribution:       "ubuntu",
+			Release:            "noble",
+			Name:               "{{ image.distribution }}-{{ image.release }}",
+			ArchitectureMapped: "amd64",
+		},
+		Source: shared.DefinitionSource{
+			URL: "http://archive.ubuntu.com/{{ image.release }}",
+		},
+		Files: []shared.DefinitionFile{
+			{Generator: "hostname"},
+			{Generator: "dump", DefinitionFilter: shared.DefinitionFilter{Types: []shared.DefinitionFilterType{"vm"}}},
+		},
+		Actions: []shared.DefinitionAction{
+			{Trigger: "post-unpack", DefinitionFilter: shared.DefinitionFilter{Releases: []string{"jammy"}}},
+			{Trigger: "post-packages", DefinitionFilter: shared.DefinitionFilter{Architectures: []string{"amd64"}}},
+		},
+		Packages: shared.DefinitionPackages{
+			Sets: []shared.DefinitionPackagesSet{
+				{Packages: []string{"vim"}, Action: "install"},
+				{Packages: []string{"grub"}, Action: "install", DefinitionFilter: shared.DefinitionFilter{Types: []shared.DefinitionFilterType{"vm"}}},
+			},
+		},
+		Environment: shared.DefinitionEnv{
+			EnvVariables: []shared.DefinitionEnvVars{
+				{Key: "FOO", Value: "bar", DefinitionFilter: shared.DefinitionFilter{Variants: []string{"cloud"}}},
+			},
+		},
+		Targets: shared.DefinitionTarget{
+			Type: shared.DefinitionFilterTypeContainer,
+		},
+	}
+
+	err := renderDefinition(&def, getImageTargets("build-incus", false))
+	require.NoError(t, err)
+
+	require.Equal(t, "ubuntu-noble", def.Image.Name)
+	require.Equal(t, "http://archive.ubuntu.com/noble", def.Source.URL)
+	require.Len(t, def.Files, 1)
+	require.Equal(t, "hostname", def.Files[0].Generator)
+	require.Len(t, def.Actions, 1)
+	require.Equal(t, "post-packages", def.Actions[0].Trigger)
+	require.Len(t, def.Packages.Sets, 1)
+	require.Equal(t, []string{"vim"}, def.Packages.Sets[0].Packages)
+	require.Empty(t, def.Environment.EnvVariables)
+
+	data, err := definitionToJSON(&def)
+	require.NoError(t, err)
+
+	var out map[string]any
+
+	err = json.Unmarshal(data, &out)
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu-noble", out["image"].(map[string]any)["name"])
+	require.Equal(t, "hostname", out["files"].([]any)[0].(map[string]any)["generator"])
+}
@@ -108,6 +108,10 @@ func (c *cmdRepackWindows) command() *cobra.Command {
 func (c *cmdRepackWindows) preRun(cmd *cobra.Command, args []string) error {
 	logger := c.global.logger
 
+	if isRootless() {
+		return errors.New("Repacking Windows images requires root, as it uses loop devices")
+	}
+
 	if c.flagWindowsVersion == "" {
 		c.flagWindowsVersion = windows.DetectWindowsVersion(filepath.Base(args[0]))
 	} else {
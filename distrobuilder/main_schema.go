@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lxc/distrobuilder/v3/generators"
+	"github.com/lxc/distrobuilder/v3/managers"
+	"github.com/lxc/distrobuilder/v3/shared"
+	"github.com/lxc/distrobuilder/v3/sources"
+)
+
+type cmdSchema struct {
+	cmdSchema *cobra.Command
+	global    *cmdGlobal
+}
+
+// schemaGenerator generates JSON schemas of Go types using their yaml tags.
+type schemaGenerator struct {
+	// enums are the allowed values of fields, keyed by struct and field name.
+	enums map[string][]string
+	defs  map[string]any
+}
+
+func (c *cmdSchema) command() *cobra.Command {
+	c.cmdSchema = &cobra.Command{
+		Use:   "schema",
+		Short: "Show the JSON schema of definition files",
+		Long: `Show the JSON schema of definition files
+
+The schema is generated from the definition types and the available
+downloaders, package managers, generators and architecture maps. It can be used
+by editors and other tools to validate and complete definition files.
+`,
+		Args:          cobra.NoArgs,
+		RunE:          c.run,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	return c.cmdSchema
+}
+
+func (c *cmdSchema) run(cmd *cobra.Command, args []string) error {
+	encoder := json.NewEncoder(cmd.OutOrStdout())
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(definitionSchema())
+	if err != nil {
+		return fmt.Errorf("Failed to encode schema: %w", err)
+	}
+
+	return nil
+}
+
+// definitionSchema returns the JSON schema of definition files.
+func definitionSchema() map[string]any {
+	g := schemaGenerator{
+		enums: map[string][]string{
+			"DefinitionAction.network":            shared.ActionNetworks,
+			"DefinitionAction.trigger":            shared.ActionTriggers,
+			"DefinitionFile.generator":            generators.Names(),
+			"DefinitionMappings.architecture_map": shared.ArchitectureMaps(),
+			"DefinitionMount.triggers":            shared.MountTriggers,
+			"DefinitionPackages.manager":          managers.Names(),
+			"DefinitionPackagesSet.action":        shared.PackageActions,
+			"DefinitionSource.downloader":         sources.Names(),
+		},
+		defs: map[string]any{},
+	}
+
+	schema := g.structSchema(reflect.TypeOf(shared.Definition{}))
+
+	// The base definitions are resolved before parsing, and can also be a
+	// single file.
+	properties := schema["properties"].(map[string]any)
+	properties["extends"] = map[string]any{
+		"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+	}
+
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "distrobuilder image definition"
+	schema["$defs"] = g.defs
+
+	return schema
+}
+
+func (g *schemaGenerator) typeSchema(t reflect.Type) map[string]any {
+	// Types with custom unmarshalling
+	switch t {
+	case reflect.TypeOf(shared.DefinitionFilterType("")):
+		return map[string]any{
+			"type": "string",
+			"enum": []shared.DefinitionFilterType{shared.DefinitionFilterTypeContainer, shared.DefinitionFilterTypeVM},
+		}
+
+	case reflect.TypeOf(shared.DefinitionVariable{}):
+		return map[string]any{
+			"anyOf": []any{
+				map[string]any{"type": "string"},
+				map[string]any{"type": "array", "items": g.typeSchema(t.Elem())},
+			},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Struct:
+		// Structs are defined once, which also allows recursive types.
+		_, ok := g.defs[t.Name()]
+		if !ok {
+			g.defs[t.Name()] = nil
+			g.defs[t.Name()] = g.structSchema(t)
+		}
+
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	}
+
+	return map[string]any{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	g.addProperties(t, properties)
+
+	// Definitions are parsed strictly, so unknown keys are errors.
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func (g *schemaGenerator) addProperties(t reflect.Type, properties map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		// Fields without yaml tag are internal only.
+		tag := field.Tag.Get("yaml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+
+		if slices.Contains(strings.Split(options, ","), "inline") {
+			g.addProperties(field.Type, properties)
+			continue
+		}
+
+		enum, ok := g.enums[fmt.Sprintf("%s.%s", t.Name(), name)]
+		if ok {
+			properties[name] = map[string]any{"type": "string", "enum": enum}
+
+			if field.Type.Kind() == reflect.Slice {
+				properties[name] = map[string]any{"type": "array", "items": properties[name]}
+			}
+
+			continue
+		}
+
+		properties[name] = g.typeSchema(field.Type)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/generators"
+	"github.com/lxc/distrobuilder/v3/managers"
+	"github.com/lxc/distrobuilder/v3/shared"
+	"github.com/lxc/distrobuilder/v3/sources"
+)
+
+func TestDefinitionSchema(t *testing.T) {
+	schema := definitionSchema()
+	defs := schema["$defs"].(map[string]any)
+
+	properties := schema["properties"].(map[string]any)
+	require.Equal(t, map[string]any{"$ref": "#/$defs/DefinitionSource"}, properties["source"])
+	require.Equal(t, false, schema["additionalProperties"])
+
+	// Base definitions can be a single file or a list of files.
+	require.Equal(t, map[string]any{
+		"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+	}, properties["extends"])
+
+	source := defs["DefinitionSource"].(map[string]any)["properties"].(map[string]any)
+	require.Equal(t, map[string]any{"type": "string", "enum": sources.Names()}, source["downloader"])
+	require.Equal(t, map[string]any{"type": "array", "items": map[string]any{"type": "string"}}, source["keys"])
+
+	// Inline filters and recursive except filters
+	file := defs["DefinitionFile"].(map[string]any)["properties"].(map[string]any)
+	require.Equal(t, map[string]any{"type": "string", "enum": generators.Names()}, file["generator"])
+	require.Contains(t, file, "releases")
+	require.Equal(t, map[string]any{"$ref": "#/$defs/DefinitionFilter"}, file["except"])
+
+	filter := defs["DefinitionFilter"].(map[string]any)["properties"].(map[string]any)
+	require.Equal(t, map[string]any{"$ref": "#/$defs/DefinitionFilter"}, filter["except"])
+
+	// Internal fields
+	target := defs["DefinitionTarget"].(map[string]any)["properties"].(map[string]any)
+	require.NotContains(t, target, "type")
+	require.NotContains(t, target, "Type")
+}
+
+func TestDefinitionSchemaEnums(t *testing.T) {
+	// Everything allowed by the schema needs to pass validation.
+	newDefinition := func() shared.Definition {
+		return shared.Definition{
+			Image: shared.DefinitionImage{
+				Distribution: "ubuntu",
+				Architecture: "x86_64",
+			},
+			Source: shared.DefinitionSource{
+				Downloader: "debootstrap",
+			},
+			Packages: shared.DefinitionPackages{
+				Manager: "apt",
+			},
+		}
+	}
+
+	for _, name := range sources.Names() {
+		def := newDefinition()
+		def.Source.Downloader = name
+		require.NoError(t, def.Validate(), name)
+	}
+
+	for _, name := range managers.Names() {
+		def := newDefinition()
+		def.Packages.Manager = name
+		require.NoError(t, def.Validate(), name)
+	}
+
+	for _, name := range generators.Names() {
+		def := newDefinition()
+		def.Files = []shared.DefinitionFile{{Generator: name}}
+		require.NoError(t, def.Validate(), name)
+	}
+
+	for _, name := range shared.ArchitectureMaps() {
+		def := newDefinition()
+		def.Mappings.ArchitectureMap = name
+		require.NoError(t, def.Validate(), name)
+	}
+}
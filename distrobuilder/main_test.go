@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+func TestRunActionsUnmount(t *testing.T) {
+	t.Cleanup(func() { bindMounts = shared.BindMounts })
+
+	c := cmdGlobal{
+		ctx:    context.Background(),
+		logger: logrus.New(),
+		definition: &shared.Definition{
+			Actions: []shared.DefinitionAction{{Trigger: "post-unpack", Action: "#!/bin/sh\ntrue\n"}},
+		},
+	}
+
+	// Errors when removing the mounts fail the actions.
+	bindMounts = func(mounts []shared.DefinitionMount) (func() error, error) {
+		return func() error { return errors.New("busy") }, nil
+	}
+
+	err := c.runActions("post-unpack", shared.ImageTargetUndefined, "")
+	require.ErrorContains(t, err, "Failed to remove mounts: busy")
+
+	// Errors of the actions take precedence.
+	c.definition.Actions[0].Action = "#!/bin/sh\nfalse\n"
+
+	err = c.runActions("post-unpack", shared.ImageTargetUndefined, "")
+	require.ErrorContains(t, err, "Failed to run post-unpack")
+}
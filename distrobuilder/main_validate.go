@@ -1,36 +1,108 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/spf13/cobra"
+
+	"github.com/lxc/distrobuilder/v3/shared"
 )
 
 type cmdValidate struct {
 	cmdValidate *cobra.Command
 	global      *cmdGlobal
+
+	flagStrict bool
+	flagFormat string
+}
+
+// validateResult is the result of validate --format=json.
+type validateResult struct {
+	Valid    bool          `json:"valid"`
+	Error    string        `json:"error,omitempty"`
+	Warnings []lintWarning `json:"warnings"`
 }
 
 func (c *cmdValidate) command() *cobra.Command {
 	c.cmdValidate = &cobra.Command{
-		Use:   "validate <filename|->",
+		Use:   "validate <filename|-> [--strict] [--format=FORMAT]",
 		Short: "Validate definition file",
-		Args:  cobra.ExactArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			// Get the image definition
-			_, err := getDefinition(args[0], c.global.flagOptions)
-			if err != nil {
-				return fmt.Errorf("Failed to get definition: %w", err)
+		Long: `Validate definition file
+
+With --strict, the definition is also checked for problems which don't prevent
+building images, and the command fails if any are found. The following checks
+are run:
+  - architecture-filter: architecture filters which never match the mapped architecture
+  - copy-source: copy generator sources which don't exist
+  - duplicate-path: files entries with the same path and filters
+  - fstab-vm: fstab generator entries which aren't restricted to VMs
+  - pongo-syntax: pongo2 templates which fail to parse
+  - template-lxc: template generator entries in definitions with only LXC targets
+
+The --format flag can be either text (default) or json.
+`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if !slices.Contains([]string{"text", "json"}, c.flagFormat) {
+				return errors.New("--format needs to be one of ['text', 'json']")
 			}
 
 			return nil
 		},
+		RunE:          c.run,
 		SilenceUsage:  true,
 		SilenceErrors: true,
 	}
 
 	c.cmdValidate.Flags().StringSliceVarP(&c.global.flagOptions, "options", "o",
 		[]string{}, "Override options (list of key=value)"+"``")
+	c.cmdValidate.Flags().BoolVar(&c.flagStrict, "strict", false, "Check for problems which don't prevent building images"+"``")
+	c.cmdValidate.Flags().StringVar(&c.flagFormat, "format", "text", "Output format"+"``")
 
 	return c.cmdValidate
 }
+
+func (c *cmdValidate) run(cmd *cobra.Command, args []string) error {
+	result := validateResult{Warnings: []lintWarning{}}
+
+	// Get the image definition
+	def, err := getDefinition(args[0], c.global.flagOptions, shared.BuildTime(c.global.ctx))
+	if err != nil {
+		err = fmt.Errorf("Failed to get definition: %w", err)
+		result.Error = err.Error()
+	} else {
+		result.Valid = true
+
+		if c.flagStrict {
+			result.Warnings = append(result.Warnings, lintDefinition(def)...)
+		}
+	}
+
+	if c.flagFormat == "json" {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+
+		err := encoder.Encode(result)
+		if err != nil {
+			return fmt.Errorf("Failed to encode result: %w", err)
+		}
+	} else {
+		for _, warning := range result.Warnings {
+			fmt.Fprintln(cmd.OutOrStdout(), warning)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(result.Warnings) > 0 {
+		return fmt.Errorf("Found %d problems", len(result.Warnings))
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+// maxTarDifferences is the number of differing tarball entries which are shown.
+const maxTarDifferences = 10
+
+type cmdVerifyReproducible struct {
+	cmdVerifyReproducible *cobra.Command
+	global                *cmdGlobal
+}
+
+func (c *cmdVerifyReproducible) command() *cobra.Command {
+	c.cmdVerifyReproducible = &cobra.Command{
+		Use:   "verify-reproducible <dir1> <dir2>",
+		Short: "Compare the output of two builds",
+		Long: `Compare the output of two builds
+
+The files of both directories are compared by their checksum, except for the
+build report which contains the timings of the build. For differing tarballs,
+the entries whose name, permissions, owner, size or modification time differ
+are shown.
+
+The command fails if the directories differ.
+`,
+		Args:          cobra.ExactArgs(2),
+		RunE:          c.run,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	return c.cmdVerifyReproducible
+}
+
+func (c *cmdVerifyReproducible) run(cmd *cobra.Command, args []string) error {
+	hashes := make([]map[string]string, len(args))
+
+	for i, dir := range args {
+		var err error
+
+		hashes[i], err = hashFiles(dir)
+		if err != nil {
+			return fmt.Errorf("Failed to hash files of %q: %w", dir, err)
+		}
+	}
+
+	var paths []string
+
+	for _, h := range hashes {
+		for path := range h {
+			if !slices.Contains(paths, path) {
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	slices.Sort(paths)
+
+	differences := 0
+	out := cmd.OutOrStdout()
+
+	for _, path := range paths {
+		hash1, ok1 := hashes[0][path]
+		hash2, ok2 := hashes[1][path]
+
+		switch {
+		case !ok1:
+			fmt.Fprintf(out, "%s: only in %s\n", path, args[1])
+		case !ok2:
+			fmt.Fprintf(out, "%s: only in %s\n", path, args[0])
+		case hash1 != hash2:
+			fmt.Fprintf(out, "%s: differs\n", path)
+
+			if strings.Contains(filepath.Base(path), ".tar") {
+				err := c.showTarDifferences(out, filepath.Join(args[0], path), filepath.Join(args[1], path))
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			continue
+		}
+
+		differences++
+	}
+
+	if differences > 0 {
+		return fmt.Errorf("Found %d differences", differences)
+	}
+
+	fmt.Fprintf(out, "All %d files are identical\n", len(paths))
+
+	return nil
+}
+
+// showTarDifferences shows the entries of both tarballs which differ.
+func (c *cmdVerifyReproducible) showTarDifferences(out io.Writer, file1 string, file2 string) error {
+	entries1, err := c.tarEntries(file1)
+	if err != nil {
+		return err
+	}
+
+	entries2, err := c.tarEntries(file2)
+	if err != nil {
+		return err
+	}
+
+	shown := 0
+
+	for _, entry := range entries1 {
+		if !slices.Contains(entries2, entry) && shown < maxTarDifferences {
+			fmt.Fprintf(out, "  - %s\n", entry)
+			shown++
+		}
+	}
+
+	for _, entry := range entries2 {
+		if !slices.Contains(entries1, entry) && shown < maxTarDifferences {
+			fmt.Fprintf(out, "  + %s\n", entry)
+			shown++
+		}
+	}
+
+	if shown == 0 {
+		fmt.Fprintln(out, "  The entries only differ in their content")
+	}
+
+	return nil
+}
+
+// tarEntries lists the entries of a tarball, including their metadata.
+func (c *cmdVerifyReproducible) tarEntries(file string) ([]string, error) {
+	var buf bytes.Buffer
+
+	err := shared.RunCommand(c.global.ctx, nil, &buf, "tar", "--list", "--verbose", "--full-time", "--numeric-owner", "-f", file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list %q: %w", file, err)
+	}
+
+	return strings.Split(strings.TrimSpace(buf.String()), "\n"), nil
+}
+
+// hashFiles returns the checksums of all regular files in the directory,
+// keyed by their relative path.
+func hashFiles(dir string) (map[string]string, error) {
+	hashes := map[string]string{}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		// The build report contains the timings of the build.
+		if relPath == buildReportFile {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		hash := sha256.New()
+
+		_, err = io.Copy(hash, f)
+		if err != nil {
+			return err
+		}
+
+		hashes[relPath] = fmt.Sprintf("%x", hash.Sum(nil))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
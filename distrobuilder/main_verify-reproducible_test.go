@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReproducible(t *testing.T) {
+	dir1 := t.TempDir()
+	dir2 := t.TempDir()
+
+	files := map[string][]string{
+		"rootfs.squashfs":   {"same", "same"},
+		"meta/metadata":     {"same", "same"},
+		"build-report.json": {"1", "2"},
+	}
+
+	for name, content := range files {
+		for i, dir := range []string{dir1, dir2} {
+			path := filepath.Join(dir, name)
+
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+			require.NoError(t, os.WriteFile(path, []byte(content[i]), 0o644))
+		}
+	}
+
+	c := cmdVerifyReproducible{global: &cmdGlobal{ctx: context.Background()}}
+	cmd := c.command()
+
+	var out bytes.Buffer
+
+	cmd.SetOut(&out)
+
+	// The build report is ignored.
+	err := c.run(cmd, []string{dir1, dir2})
+	require.NoError(t, err)
+	require.Equal(t, "All 2 files are identical\n", out.String())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir2, "rootfs.squashfs"), []byte("other"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir1, "disk.qcow2"), []byte("disk"), 0o644))
+
+	out.Reset()
+
+	err = c.run(cmd, []string{dir1, dir2})
+	require.EqualError(t, err, "Found 2 differences")
+	require.Equal(t, "disk.qcow2: only in "+dir1+"\nrootfs.squashfs: differs\n", out.String())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+	"github.com/lxc/distrobuilder/v3/shared/version"
+)
+
+// buildReportFile is the name of the build report written alongside images.
+const buildReportFile = "build-report.json"
+
+// buildReport lists the inputs and outputs of an image build.
+type buildReport struct {
+	Version    string                `json:"version"`
+	Definition json.RawMessage       `json:"definition"`
+	Sources    []buildReportSource   `json:"sources"`
+	Keys       []string              `json:"keys"`
+	Packages   []buildReportPackage  `json:"packages"`
+	Actions    []buildReportAction   `json:"actions"`
+	Artifacts  []buildReportArtifact `json:"artifacts"`
+	Stages     []buildReportStage    `json:"stages"`
+}
+
+type buildReportSource struct {
+	URL      string `json:"url"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+type buildReportPackage struct {
+	Action   string   `json:"action"`
+	Packages []string `json:"packages"`
+}
+
+type buildReportAction struct {
+	Trigger  string  `json:"trigger"`
+	ExitCode int     `json:"exit_code"`
+	Duration float64 `json:"duration"`
+}
+
+type buildReportArtifact struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type buildReportStage struct {
+	Stage    string                `json:"stage"`
+	Duration float64               `json:"duration"`
+	Usage    *shared.ResourceUsage `json:"usage,omitempty"`
+}
+
+// newBuildReport creates the build report from the definition and the
+// recorded events. Artifact paths are made relative to the target directory.
+func newBuildReport(def *shared.Definition, imageTargets shared.ImageTarget, events []shared.Event, targetDir string) (*buildReport, error) {
+	// Render a copy of the definition, as rendering removes the entries which
+	// don't match the image targets.
+	data, err := yaml.Marshal(def)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal definition: %w", err)
+	}
+
+	var resolved shared.Definition
+
+	err = yaml.Unmarshal(data, &resolved)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to copy definition: %w", err)
+	}
+
+	resolved.Targets.Type = def.Targets.Type
+
+	err = renderDefinition(&resolved, imageTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	report := buildReport{
+		Version:   version.Version,
+		Sources:   []buildReportSource{},
+		Keys:      []string{},
+		Packages:  []buildReportPackage{},
+		Actions:   []buildReportAction{},
+		Artifacts: []buildReportArtifact{},
+		Stages:    []buildReportStage{},
+	}
+
+	report.Definition, err = definitionToJSON(&resolved)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to convert definition to JSON: %w", err)
+	}
+
+	for _, event := range events {
+		switch event.Type {
+		case shared.EventSourceDownloaded:
+			source := buildReportSource{URL: event.URL, Checksum: event.Checksum}
+
+			if !slices.Contains(report.Sources, source) {
+				report.Sources = append(report.Sources, source)
+			}
+
+		case shared.EventKeysImported:
+			for _, fingerprint := range event.Fingerprints {
+				if !slices.Contains(report.Keys, fingerprint) {
+					report.Keys = append(report.Keys, fingerprint)
+				}
+			}
+
+		case shared.EventPackagesManaged:
+			report.Packages = append(report.Packages, buildReportPackage{Action: event.Action, Packages: event.Packages})
+
+		case shared.EventActionRun:
+			action := buildReportAction{Trigger: event.Trigger, Duration: event.Duration}
+
+			if event.ExitCode != nil {
+				action.ExitCode = *event.ExitCode
+			}
+
+			report.Actions = append(report.Actions, action)
+
+		case shared.EventArtifactWritten:
+			path, err := filepath.Rel(targetDir, event.Path)
+			if err != nil {
+				path = event.Path
+			}
+
+			report.Artifacts = append(report.Artifacts, buildReportArtifact{Path: path, Size: event.Size, SHA256: event.SHA256})
+
+		case shared.EventStageFinished:
+			report.Stages = append(report.Stages, buildReportStage{Stage: event.Stage, Duration: event.Duration, Usage: event.Usage})
+		}
+	}
+
+	return &report, nil
+}
+
+// writeBuildReport writes the build report to the target directory. The
+// current build stage is finished first, so its timing is included.
+func (c *cmdGlobal) writeBuildReport(imageTargets shared.ImageTarget) error {
+	c.finishStage(nil)
+
+	if c.events == nil {
+		return nil
+	}
+
+	report, err := newBuildReport(c.definition, imageTargets, c.events.Events(), c.targetDir)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal build report: %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(c.targetDir, buildReportFile), append(data, '\n'), 0o644)
+	if err != nil {
+		return fmt.Errorf("Failed to write build report: %w", err)
+	}
+
+	return nil
+}
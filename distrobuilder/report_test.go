@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+func TestNewBuildReport(t *testing.T) {
+	exitCode := 0
+
+	def := &shared.Definition{
+		Image: shared.DefinitionImage{
+			Distribution: "ubuntu",
+			Release:      "noble",
+			Name:         "{{ image.distribution }}-{{ image.release }}",
+		},
+		Actions: []shared.DefinitionAction{
+			{Trigger: "post-unpack", Action: "#!/bin/sh"},
+			{Trigger: "post-unpack", Action: "#!/bin/sh", DefinitionFilter: shared.DefinitionFilter{Types: []shared.DefinitionFilterType{shared.DefinitionFilterTypeVM}}},
+		},
+	}
+
+	def.Targets.Type = shared.DefinitionFilterTypeContainer
+
+	events := []shared.Event{
+		{Type: shared.EventStageStarted, Stage: "unpack"},
+		{Type: shared.EventSourceDownloaded, URL: "https://example.com/rootfs.tar.xz", Checksum: "abc"},
+		{Type: shared.EventSourceDownloaded, URL: "https://example.com/rootfs.tar.xz", Checksum: "abc"},
+		{Type: shared.EventKeysImported, Fingerprints: []string{"A", "B"}},
+		{Type: shared.EventKeysImported, Fingerprints: []string{"B"}},
+		{Type: shared.EventStageFinished, Stage: "unpack", Duration: 2, Usage: &shared.ResourceUsage{MemoryPeak: 1024, CPUTime: 1.5}},
+		{Type: shared.EventPackagesManaged, Action: "install", Packages: []string{"vim"}},
+		{Type: shared.EventActionRun, Trigger: "post-unpack", ExitCode: &exitCode, Duration: 1},
+		{Type: shared.EventArtifactWritten, Path: "/out/rootfs.tar.xz", Size: 5, SHA256: "def"},
+		{Type: shared.EventStageFinished, Stage: "pack", Duration: 3},
+	}
+
+	report, err := newBuildReport(def, getImageTargets("build-incus", false), events, "/out")
+	require.NoError(t, err)
+
+	require.Equal(t, []buildReportSource{{URL: "https://example.com/rootfs.tar.xz", Checksum: "abc"}}, report.Sources)
+	require.Equal(t, []string{"A", "B"}, report.Keys)
+	require.Equal(t, []buildReportPackage{{Action: "install", Packages: []string{"vim"}}}, report.Packages)
+	require.Equal(t, []buildReportAction{{Trigger: "post-unpack", ExitCode: 0, Duration: 1}}, report.Actions)
+	require.Equal(t, []buildReportArtifact{{Path: "rootfs.tar.xz", Size: 5, SHA256: "def"}}, report.Artifacts)
+	require.Equal(t, []buildReportStage{{Stage: "unpack", Duration: 2, Usage: &shared.ResourceUsage{MemoryPeak: 1024, CPUTime: 1.5}}, {Stage: "pack", Duration: 3}}, report.Stages)
+
+	// The definition is rendered, without modifying the original.
+	var resolved map[string]any
+
+	err = json.Unmarshal(report.Definition, &resolved)
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu-noble", resolved["image"].(map[string]any)["name"])
+	require.Len(t, resolved["actions"], 1)
+	require.Len(t, def.Actions, 2)
+	require.Equal(t, "{{ image.distribution }}-{{ image.release }}", def.Image.Name)
+}
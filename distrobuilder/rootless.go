@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// rootlessEnv is set for builds which run in a user namespace.
+	rootlessEnv = "DISTROBUILDER_ROOTLESS"
+
+	// rootlessSyncEnv holds the file descriptor on which the child process of
+	// rootless builds waits for its ID mappings.
+	rootlessSyncEnv = "DISTROBUILDER_ROOTLESS_SYNC"
+)
+
+// isRootless returns whether the build runs in a user namespace rather than as
+// real root.
+func isRootless() bool {
+	return os.Getenv(rootlessEnv) == "1"
+}
+
+// subIDRange returns the first subordinate ID range of the user in the file,
+// like /etc/subuid.
+func subIDRange(path string, name string, id string) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != id) {
+			continue
+		}
+
+		return fields[1], fields[2], nil
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return "", "", err
+	}
+
+	return "", "", fmt.Errorf("No subordinate IDs for %q in %q", name, path)
+}
+
+// runRootless runs distrobuilder again in a new user namespace, where the
+// current user is mapped to root and the subordinate IDs of the user to the
+// other IDs. It exits with the exit code of the build.
+func runRootless() error {
+	for _, tool := range []string{"newuidmap", "newgidmap"} {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			return fmt.Errorf("Required tool %q is missing", tool)
+		}
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("Failed to get current user: %w", err)
+	}
+
+	uidStart, uidCount, err := subIDRange("/etc/subuid", current.Username, current.Uid)
+	if err != nil {
+		return fmt.Errorf("Failed to get subordinate user IDs: %w", err)
+	}
+
+	gidStart, gidCount, err := subIDRange("/etc/subgid", current.Username, current.Uid)
+	if err != nil {
+		return fmt.Errorf("Failed to get subordinate group IDs: %w", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Failed to get executable: %w", err)
+	}
+
+	syncRead, syncWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Failed to create pipe: %w", err)
+	}
+
+	defer syncWrite.Close()
+
+	// The child waits for its ID mappings on the first extra file.
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{syncRead}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=1", rootlessEnv), fmt.Sprintf("%s=3", rootlessSyncEnv))
+	cmd.SysProcAttr = &unix.SysProcAttr{Cloneflags: unix.CLONE_NEWUSER}
+
+	err = cmd.Start()
+	syncRead.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to start user namespace: %w", err)
+	}
+
+	pid := strconv.Itoa(cmd.Process.Pid)
+
+	for _, args := range [][]string{
+		{"newuidmap", pid, "0", current.Uid, "1", "1", uidStart, uidCount},
+		{"newgidmap", pid, "0", current.Gid, "1", "1", gidStart, gidCount},
+	} {
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+
+			return fmt.Errorf("Failed to map IDs using %q: %w (%s)", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	// Signals are forwarded, so that the build can clean up.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGINT, unix.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	// Closing the pipe lets the child continue.
+	syncWrite.Close()
+
+	err = cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to run in user namespace: %w", err)
+	}
+
+	os.Exit(0)
+
+	return nil
+}
+
+// waitRootless waits for the ID mappings of the user namespace, if the process
+// is the child of a rootless build, and executes distrobuilder again. The new
+// process is root in the user namespace, and therefore gets all capabilities
+// in it.
+func waitRootless() error {
+	fd := os.Getenv(rootlessSyncEnv)
+	if fd == "" {
+		return nil
+	}
+
+	syncFd, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q", rootlessSyncEnv, fd)
+	}
+
+	// The parent closes the pipe once the mappings are set.
+	buf := make([]byte, 1)
+
+	for {
+		_, err = unix.Read(syncFd, buf)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+
+	_ = unix.Close(syncFd)
+
+	err = os.Unsetenv(rootlessSyncEnv)
+	if err != nil {
+		return err
+	}
+
+	if os.Geteuid() != 0 {
+		return errors.New("The user namespace has no ID mappings")
+	}
+
+	return unix.Exec("/proc/self/exe", os.Args, os.Environ())
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubIDRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subuid")
+
+	err := os.WriteFile(path, []byte("alice:100000:65536\n1001:165536:65536\nbob:231072:65536\n"), 0o644)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		id            string
+		expectedStart string
+		expectedCount string
+		shouldFail    bool
+	}{
+		{"alice", "1000", "100000", "65536", false},
+		{"carol", "1001", "165536", "65536", false},
+		{"bob", "1002", "231072", "65536", false},
+		{"dave", "1003", "", "", true},
+	}
+
+	for _, tt := range tests {
+		start, count, err := subIDRange(path, tt.name, tt.id)
+		if tt.shouldFail {
+			require.Error(t, err)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, tt.expectedStart, start)
+		require.Equal(t, tt.expectedCount, count)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lxc/distrobuilder/v3/managers"
+	"github.com/lxc/distrobuilder/v3/shared"
+	"github.com/lxc/distrobuilder/v3/shared/version"
+)
+
+// SBOM file names.
+const (
+	sbomSPDXFile      = "sbom.spdx.json"
+	sbomCycloneDXFile = "sbom.cdx.json"
+)
+
+// purlTypes are the package URL types of the package managers. Packages of
+// other managers use the generic type.
+var purlTypes = map[string]string{
+	"apk":    "apk",
+	"apt":    "deb",
+	"dnf":    "rpm",
+	"pacman": "alpm",
+	"yum":    "rpm",
+	"zypper": "rpm",
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	SourceInfo            string            `json:"sourceInfo,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+type cycloneDXBOM struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     cycloneDXTools     `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTools struct {
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// listPackages lists the installed packages for the SBOM. If the package
+// manager can't list packages, no SBOM is created.
+func (c *cmdGlobal) listPackages(manager *managers.Manager) error {
+	pkgs, err := manager.ListPackages()
+	if err != nil {
+		if errors.Is(err, managers.ErrListPackagesUnsupported) {
+			c.logger.WithField("manager", c.definition.Packages.Manager).Warn("Not creating SBOM, as the installed packages can't be listed")
+			return nil
+		}
+
+		return fmt.Errorf("Failed to list installed packages: %w", err)
+	}
+
+	c.packages = pkgs
+
+	return nil
+}
+
+// packagesProperty returns the installed packages as image property, listing
+// the packages as <name>=<version>.
+func packagesProperty(pkgs []managers.Package) string {
+	entries := make([]string, 0, len(pkgs))
+
+	for _, pkg := range pkgs {
+		entries = append(entries, fmt.Sprintf("%s=%s", pkg.Name, pkg.Version))
+	}
+
+	return strings.Join(entries, " ")
+}
+
+// packageURL returns the package URL of a package.
+func packageURL(def *shared.Definition, pkg managers.Package) string {
+	purlType, ok := purlTypes[def.Packages.Manager]
+	if !ok {
+		purlType = "generic"
+	}
+
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s", purlType, url.PathEscape(strings.ToLower(def.Image.Distribution)),
+		url.PathEscape(pkg.Name), url.PathEscape(pkg.Version))
+
+	qualifiers := url.Values{}
+
+	if pkg.Architecture != "" {
+		qualifiers.Set("arch", pkg.Architecture)
+	}
+
+	if def.Image.Release != "" {
+		qualifiers.Set("distro", fmt.Sprintf("%s-%s", strings.ToLower(def.Image.Distribution), def.Image.Release))
+	}
+
+	if len(qualifiers) > 0 {
+		purl += "?" + qualifiers.Encode()
+	}
+
+	return purl
+}
+
+// sbomUUID returns a UUID derived from the data, so that the same packages
+// result in the same identifiers.
+func sbomUUID(data []byte) string {
+	hash := sha256.Sum256(data)
+
+	// Set the version and variant bits.
+	hash[6] = (hash[6] & 0x0f) | 0x50
+	hash[8] = (hash[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", hash[0:4], hash[4:6], hash[6:8], hash[8:10], hash[10:16])
+}
+
+// newSPDXDocument returns the SPDX document of the installed packages.
+func newSPDXDocument(def *shared.Definition, name string, pkgs []managers.Package, created time.Time) spdxDocument {
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        name,
+		CreationInfo: spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{fmt.Sprintf("Tool: distrobuilder-%s", version.Version)},
+		},
+		Packages: []spdxPackage{{
+			Name:                  name,
+			SPDXID:                "SPDXRef-Image",
+			VersionInfo:           def.Image.Release,
+			DownloadLocation:      "NOASSERTION",
+			PrimaryPackagePurpose: "OPERATING-SYSTEM",
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: "SPDXRef-Image",
+		}},
+	}
+
+	for i, pkg := range pkgs {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i)
+
+		p := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           id,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  packageURL(def, pkg),
+			}},
+		}
+
+		if pkg.Source != "" {
+			p.SourceInfo = fmt.Sprintf("built package from: %s", pkg.Source)
+		}
+
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      "SPDXRef-Image",
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	data, _ := json.Marshal(doc.Packages)
+	doc.DocumentNamespace = fmt.Sprintf("https://linuxcontainers.org/distrobuilder/spdx/%s-%s", url.PathEscape(name), sbomUUID(data))
+
+	return doc
+}
+
+// newCycloneDXBOM returns the CycloneDX BOM of the installed packages.
+func newCycloneDXBOM(def *shared.Definition, name string, pkgs []managers.Package, created time.Time) cycloneDXBOM {
+	bom := cycloneDXBOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: created.UTC().Format(time.RFC3339),
+			Tools: cycloneDXTools{
+				Components: []cycloneDXComponent{{Type: "application", Name: "distrobuilder", Version: version.Version}},
+			},
+			Component: cycloneDXComponent{
+				Type:    "operating-system",
+				BOMRef:  "image",
+				Name:    name,
+				Version: def.Image.Release,
+			},
+		},
+		Components: make([]cycloneDXComponent, 0, len(pkgs)),
+	}
+
+	for i, pkg := range pkgs {
+		component := cycloneDXComponent{
+			Type:    "library",
+			BOMRef:  fmt.Sprintf("package-%d", i),
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    packageURL(def, pkg),
+		}
+
+		if pkg.Source != "" {
+			component.Properties = append(component.Properties, cycloneDXProperty{Name: "distrobuilder:package:source", Value: pkg.Source})
+		}
+
+		bom.Components = append(bom.Components, component)
+	}
+
+	data, _ := json.Marshal(bom.Components)
+	bom.SerialNumber = fmt.Sprintf("urn:uuid:%s", sbomUUID(data))
+
+	return bom
+}
+
+// writeSBOM writes the SPDX and CycloneDX SBOMs of the installed packages to
+// the target directory.
+func (c *cmdGlobal) writeSBOM() error {
+	if c.packages == nil {
+		return nil
+	}
+
+	name, err := shared.RenderTemplate(c.definition.Image.Name, c.definition)
+	if err != nil {
+		return fmt.Errorf("Failed to render image name: %w", err)
+	}
+
+	created := shared.BuildTime(c.ctx)
+
+	documents := map[string]any{
+		sbomSPDXFile:      newSPDXDocument(c.definition, name, c.packages, created),
+		sbomCycloneDXFile: newCycloneDXBOM(c.definition, name, c.packages, created),
+	}
+
+	for _, file := range []string{sbomSPDXFile, sbomCycloneDXFile} {
+		data, err := json.MarshalIndent(documents[file], "", "  ")
+		if err != nil {
+			return fmt.Errorf("Failed to marshal %q: %w", file, err)
+		}
+
+		path := filepath.Join(c.targetDir, file)
+
+		err = os.WriteFile(path, append(data, '\n'), 0o644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %q: %w", path, err)
+		}
+
+		err = shared.RecordArtifact(c.ctx, path)
+		if err != nil {
+			return fmt.Errorf("Failed to record artifact: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/managers"
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+func TestPackageURL(t *testing.T) {
+	def := &shared.Definition{
+		Image:    shared.DefinitionImage{Distribution: "Ubuntu", Release: "noble"},
+		Packages: shared.DefinitionPackages{Manager: "apt"},
+	}
+
+	pkg := managers.Package{Name: "libstdc++6", Version: "14-20240412-0ubuntu1", Architecture: "amd64"}
+	require.Equal(t, "pkg:deb/ubuntu/libstdc++6@14-20240412-0ubuntu1?arch=amd64&distro=ubuntu-noble", packageURL(def, pkg))
+
+	def.Packages.Manager = "portage"
+	pkg = managers.Package{Name: "sys-apps/portage", Version: "3.0.63-r1"}
+	require.Equal(t, "pkg:generic/ubuntu/sys-apps%2Fportage@3.0.63-r1?distro=ubuntu-noble", packageURL(def, pkg))
+}
+
+func TestSBOM(t *testing.T) {
+	def := &shared.Definition{
+		Image:    shared.DefinitionImage{Distribution: "alpine", Release: "3.20"},
+		Packages: shared.DefinitionPackages{Manager: "apk"},
+	}
+
+	pkgs := []managers.Package{
+		{Name: "busybox", Version: "1.36.1-r29", Architecture: "x86_64", Source: "busybox"},
+		{Name: "musl", Version: "1.2.5-r0", Architecture: "x86_64"},
+	}
+
+	created := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	spdx := newSPDXDocument(def, "alpine-3.20", pkgs, created)
+	require.Equal(t, "2024-06-01T00:00:00Z", spdx.CreationInfo.Created)
+	require.Len(t, spdx.Packages, 3)
+	require.Equal(t, "OPERATING-SYSTEM", spdx.Packages[0].PrimaryPackagePurpose)
+	require.Equal(t, "built package from: busybox", spdx.Packages[1].SourceInfo)
+	require.Equal(t, "pkg:apk/alpine/musl@1.2.5-r0?arch=x86_64&distro=alpine-3.20", spdx.Packages[2].ExternalRefs[0].ReferenceLocator)
+	require.Len(t, spdx.Relationships, 3)
+
+	cdx := newCycloneDXBOM(def, "alpine-3.20", pkgs, created)
+	require.Len(t, cdx.Components, 2)
+	require.Equal(t, "operating-system", cdx.Metadata.Component.Type)
+	require.Equal(t, []cycloneDXProperty{{Name: "distrobuilder:package:source", Value: "busybox"}}, cdx.Components[0].Properties)
+	require.Regexp(t, `^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, cdx.SerialNumber)
+
+	// The same packages result in the same identifiers.
+	require.Equal(t, spdx.DocumentNamespace, newSPDXDocument(def, "alpine-3.20", pkgs, time.Now()).DocumentNamespace)
+	require.Equal(t, cdx.SerialNumber, newCycloneDXBOM(def, "alpine-3.20", pkgs, time.Now()).SerialNumber)
+
+	require.Equal(t, "busybox=1.36.1-r29 musl=1.2.5-r0", packagesProperty(pkgs))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+// checksumsFile is the name of the checksums file written alongside images.
+const checksumsFile = "SHA256SUMS"
+
+// envSignPassphrase holds the passphrase of the signing key, if it has one.
+const envSignPassphrase = "DISTROBUILDER_SIGN_PASSPHRASE"
+
+// artifactChecksums returns the SHA-256 checksums of the artifacts written to
+// the target directory, keyed by their relative path.
+func artifactChecksums(events []shared.Event, targetDir string) map[string]string {
+	checksums := map[string]string{}
+
+	for _, event := range events {
+		if event.Type != shared.EventArtifactWritten {
+			continue
+		}
+
+		path, err := filepath.Rel(targetDir, event.Path)
+		if err != nil || strings.HasPrefix(path, "..") {
+			continue
+		}
+
+		checksums[path] = event.SHA256
+	}
+
+	return checksums
+}
+
+// formatChecksums returns the checksums in the format of sha256sum, sorted by
+// path.
+func formatChecksums(checksums map[string]string) string {
+	var sb strings.Builder
+
+	paths := make([]string, 0, len(checksums))
+
+	for path := range checksums {
+		paths = append(paths, path)
+	}
+
+	slices.Sort(paths)
+
+	for _, path := range paths {
+		fmt.Fprintf(&sb, "%s  %s\n", checksums[path], path)
+	}
+
+	return sb.String()
+}
+
+// signFiles creates a detached, ASCII armored signature <file>.asc of each file
+// using the secret key in keyFile. It returns the fingerprint of the key.
+func signFiles(ctx context.Context, gpgParentDir string, keyFile string, files []string) (string, error) {
+	gpgDir, err := shared.CreateGPGHome(gpgParentDir)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		_ = exec.Command("gpgconf", "--homedir", gpgDir, "--kill", "gpg-agent").Run()
+		_ = os.RemoveAll(gpgDir)
+	}()
+
+	var out bytes.Buffer
+
+	cmd := shared.GPGCommand(ctx, gpgDir, "--batch", "--import", keyFile)
+	cmd.Stderr = &out
+
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("Failed to import key: %s: %w", strings.TrimSpace(out.String()), err)
+	}
+
+	out.Reset()
+
+	cmd = shared.GPGCommand(ctx, gpgDir, "--batch", "--list-secret-keys")
+	cmd.Stdout = &out
+
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("Failed to list secret keys: %w", err)
+	}
+
+	fingerprints := shared.GPGFingerprints(out.String())
+	if len(fingerprints) == 0 {
+		return "", fmt.Errorf("No secret key found in %q", keyFile)
+	}
+
+	// Sign with the first key of the file.
+	fingerprint := fingerprints[0]
+
+	passphrase, hasPassphrase := os.LookupEnv(envSignPassphrase)
+
+	for _, file := range files {
+		args := []string{"--batch", "--yes", "--armor", "--local-user", fingerprint}
+
+		if hasPassphrase {
+			args = append(args, "--pinentry-mode", "loopback", "--passphrase-fd", "0")
+		}
+
+		args = append(args, "--output", file+".asc", "--detach-sign", file)
+
+		out.Reset()
+
+		cmd := shared.GPGCommand(ctx, gpgDir, args...)
+		cmd.Stderr = &out
+
+		if hasPassphrase {
+			cmd.Stdin = strings.NewReader(passphrase)
+		}
+
+		err = cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("Failed to sign %q: %s: %w", file, strings.TrimSpace(out.String()), err)
+		}
+	}
+
+	return fingerprint, nil
+}
+
+// writeChecksums writes the checksums of the artifacts to the target directory
+// and, if a signing key is set, signs the artifacts and the checksums file.
+func (c *cmdGlobal) writeChecksums() error {
+	if !c.flagChecksums && c.flagSignKey == "" {
+		return nil
+	}
+
+	if c.events == nil {
+		return errors.New("No artifacts recorded")
+	}
+
+	checksums := artifactChecksums(c.events.Events(), c.targetDir)
+	path := filepath.Join(c.targetDir, checksumsFile)
+
+	err := os.WriteFile(path, []byte(formatChecksums(checksums)), 0o644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %q: %w", path, err)
+	}
+
+	err = shared.RecordArtifact(c.ctx, path)
+	if err != nil {
+		return fmt.Errorf("Failed to record artifact: %w", err)
+	}
+
+	if c.flagSignKey == "" {
+		return nil
+	}
+
+	files := []string{path}
+
+	for file := range checksums {
+		files = append(files, filepath.Join(c.targetDir, file))
+	}
+
+	slices.Sort(files)
+
+	fingerprint, err := signFiles(c.ctx, c.flagCacheDir, c.flagSignKey, files)
+	if err != nil {
+		return err
+	}
+
+	c.logger.WithField("key", fingerprint).Info("Signed image files")
+
+	for _, file := range files {
+		err = shared.RecordArtifact(c.ctx, file+".asc")
+		if err != nil {
+			return fmt.Errorf("Failed to record artifact: %w", err)
+		}
+	}
+
+	return nil
+}
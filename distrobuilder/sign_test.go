@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
+func TestArtifactChecksums(t *testing.T) {
+	events := []shared.Event{
+		{Type: shared.EventArtifactWritten, Path: "/build/rootfs.squashfs", SHA256: "aaaa"},
+		{Type: shared.EventStageFinished, Stage: "pack"},
+		{Type: shared.EventArtifactWritten, Path: "/build/incus.tar.xz", SHA256: "bbbb"},
+		{Type: shared.EventArtifactWritten, Path: "/other/rootfs.squashfs", SHA256: "cccc"},
+		{Type: shared.EventArtifactWritten, Path: "/build/incus.tar.xz", SHA256: "dddd"},
+	}
+
+	checksums := artifactChecksums(events, "/build")
+	require.Equal(t, map[string]string{"incus.tar.xz": "dddd", "rootfs.squashfs": "aaaa"}, checksums)
+	require.Equal(t, "dddd  incus.tar.xz\naaaa  rootfs.squashfs\n", formatChecksums(checksums))
+}
+
+func TestSignFiles(t *testing.T) {
+	_, err := exec.LookPath("gpg")
+	if err != nil {
+		t.Skip("gpg isn't available")
+	}
+
+	dir := t.TempDir()
+	gpgDir := filepath.Join(dir, "gpg")
+	keyFile := filepath.Join(dir, "key.asc")
+
+	require.NoError(t, os.Mkdir(gpgDir, 0o700))
+
+	defer func() {
+		_ = exec.Command("gpgconf", "--homedir", gpgDir, "--kill", "gpg-agent").Run()
+	}()
+
+	err = shared.GPGCommand(context.Background(), gpgDir, "--batch", "--passphrase", "", "--quick-gen-key", "test@example.com", "ed25519", "sign", "never").Run()
+	require.NoError(t, err)
+
+	err = shared.GPGCommand(context.Background(), gpgDir, "--batch", "--armor", "--output", keyFile, "--export-secret-keys").Run()
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, "rootfs.squashfs")
+	require.NoError(t, os.WriteFile(file, []byte("rootfs"), 0o644))
+
+	fingerprint, err := signFiles(context.Background(), dir, keyFile, []string{file})
+	require.NoError(t, err)
+	require.Len(t, fingerprint, 40)
+
+	err = shared.GPGCommand(context.Background(), gpgDir, "--batch", "--verify", file+".asc", file).Run()
+	require.NoError(t, err)
+
+	// Public keys can't sign.
+	err = shared.GPGCommand(context.Background(), gpgDir, "--batch", "--yes", "--armor", "--output", keyFile, "--export").Run()
+	require.NoError(t, err)
+
+	_, err = signFiles(context.Background(), dir, keyFile, []string{file})
+	require.EqualError(t, err, `No secret key found in "`+keyFile+`"`)
+}
@@ -2,6 +2,7 @@ package generators
 
 import (
 	"errors"
+	"slices"
 
 	"github.com/sirupsen/logrus"
 
@@ -40,6 +41,19 @@ var generators = map[string]func() generator{
 	"template":    func() generator { return &template{} },
 }
 
+// Names returns the names of all generators.
+func Names() []string {
+	names := make([]string, 0, len(generators))
+
+	for name := range generators {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
 // Load loads and initializes a generator.
 func Load(generatorName string, logger *logrus.Logger, cacheDir string, sourceDir string, defFile shared.DefinitionFile, def shared.Definition) (Generator, error) {
 	df, ok := generators[generatorName]
@@ -6,7 +6,6 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
-	"time"
 
 	"github.com/lxc/incus/v7/shared/api"
 	"gopkg.in/yaml.v2"
@@ -158,7 +157,8 @@ func (l *IncusImage) Build(unified bool, compression string, vm bool) (string, s
 				args = append(args, "-comp", compression)
 			}
 
-			// Create rootfs as squashfs.
+			// Create rootfs as squashfs. In reproducible builds, mksquashfs
+			// uses SOURCE_DATE_EPOCH from the environment for all timestamps.
 			err = shared.RunCommand(l.ctx, nil, nil, "mksquashfs", args...)
 		}
 
@@ -174,6 +174,17 @@ func (l *IncusImage) Build(unified bool, compression string, vm bool) (string, s
 		}
 	}
 
+	for _, artifact := range []string{imageFile, rootfsFile} {
+		if artifact == "" {
+			continue
+		}
+
+		err = shared.RecordArtifact(l.ctx, artifact)
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to record artifact: %w", err)
+		}
+	}
+
 	return imageFile, rootfsFile, nil
 }
 
@@ -181,7 +192,7 @@ func (l *IncusImage) createMetadata() error {
 	var err error
 
 	l.Metadata.Architecture = l.definition.Image.Architecture
-	l.Metadata.CreationDate = time.Now().UTC().Unix()
+	l.Metadata.CreationDate = shared.BuildTime(l.ctx).UTC().Unix()
 	l.Metadata.Properties["architecture"] = l.definition.Image.ArchitectureMapped
 	l.Metadata.Properties["os"] = l.definition.Image.Distribution
 	l.Metadata.Properties["release"] = l.definition.Image.Release
@@ -200,7 +211,7 @@ func (l *IncusImage) createMetadata() error {
 		return fmt.Errorf("Failed to render template: %w", err)
 	}
 
-	l.Metadata.ExpiryDate = shared.GetExpiryDate(time.Now(),
+	l.Metadata.ExpiryDate = shared.GetExpiryDate(shared.BuildTime(l.ctx),
 		l.definition.Image.Expiry).Unix()
 
 	return nil
@@ -6,7 +6,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 
 	incus "github.com/lxc/incus/v7/shared/util"
 
@@ -75,11 +74,16 @@ func (l *LXCImage) Build(compression string) error {
 		return fmt.Errorf("Failed to pack metadata: %w", err)
 	}
 
-	_, err = shared.Pack(l.ctx, filepath.Join(l.targetDir, "rootfs.tar"), compression, l.sourceDir, ".")
+	file, err := shared.Pack(l.ctx, filepath.Join(l.targetDir, "rootfs.tar"), compression, l.sourceDir, ".")
 	if err != nil {
 		return fmt.Errorf("Failed to pack %q: %w", filepath.Join(l.targetDir, "rootfs.tar"), err)
 	}
 
+	err = shared.RecordArtifact(l.ctx, file)
+	if err != nil {
+		return fmt.Errorf("Failed to record artifact: %w", err)
+	}
+
 	return nil
 }
 
@@ -144,7 +148,7 @@ func (l *LXCImage) createMetadata() error {
 	}
 
 	err = l.writeMetadata(filepath.Join(metaDir, "expiry"),
-		fmt.Sprint(shared.GetExpiryDate(time.Now(), l.definition.Image.Expiry).Unix()),
+		fmt.Sprint(shared.GetExpiryDate(shared.BuildTime(l.ctx), l.definition.Image.Expiry).Unix()),
 		false)
 	if err != nil {
 		return fmt.Errorf("Error writing 'expiry': %w", err)
@@ -196,12 +200,17 @@ func (l *LXCImage) packMetadata() error {
 		files = append(files, "templates")
 	}
 
-	_, err = shared.Pack(l.ctx, filepath.Join(l.targetDir, "meta.tar"), "xz",
+	file, err := shared.Pack(l.ctx, filepath.Join(l.targetDir, "meta.tar"), "xz",
 		filepath.Join(l.cacheDir, "metadata"), files...)
 	if err != nil {
 		return fmt.Errorf("Failed to create metadata: %w", err)
 	}
 
+	err = shared.RecordArtifact(l.ctx, file)
+	if err != nil {
+		return fmt.Errorf("Failed to record artifact: %w", err)
+	}
+
 	return nil
 }
 
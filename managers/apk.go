@@ -1,7 +1,9 @@
 package managers
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -39,6 +41,11 @@ func (m *apk) load() error {
 		},
 	}
 
+	// Keep the downloaded packages in the package cache.
+	if m.packageCache {
+		m.flags.global = []string{"--cache-dir", PackageCacheDir("apk")}
+	}
+
 	return nil
 }
 
@@ -102,3 +109,55 @@ func (m *apk) writeKeyFile(repoAction shared.DefinitionPackagesRepository) error
 
 	return nil
 }
+
+func (m *apk) listPackages() ([]Package, error) {
+	f, err := os.Open("/lib/apk/db/installed")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open package database: %w", err)
+	}
+
+	defer f.Close()
+
+	return parseAPKInstalled(f)
+}
+
+// parseAPKInstalled parses the apk database of installed packages. Packages
+// are separated by empty lines, and each line holds a single-letter key
+// followed by a colon and the value.
+func parseAPKInstalled(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+	var pkg Package
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+
+		switch key {
+		case "":
+			if pkg.Name != "" {
+				pkgs = append(pkgs, pkg)
+			}
+
+			pkg = Package{}
+		case "P":
+			pkg.Name = value
+		case "V":
+			pkg.Version = value
+		case "A":
+			pkg.Architecture = value
+		case "o":
+			pkg.Source = value
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read package database: %w", err)
+	}
+
+	if pkg.Name != "" {
+		pkgs = append(pkgs, pkg)
+	}
+
+	return pkgs, nil
+}
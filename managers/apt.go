@@ -1,6 +1,7 @@
 package managers
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -152,3 +153,38 @@ func (m *apt) manageRepository(repoAction shared.DefinitionPackagesRepository) e
 
 	return nil
 }
+
+func (m *apt) listPackages() ([]Package, error) {
+	var out bytes.Buffer
+
+	err := shared.RunCommand(m.ctx, nil, &out, "dpkg-query", "--show",
+		"--showformat", "${db:Status-Abbrev}\t${Package}\t${Version}\t${Architecture}\t${source:Package}\n")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list packages: %w", err)
+	}
+
+	return parseDpkgQuery(&out), nil
+}
+
+// parseDpkgQuery parses the output of dpkg-query, skipping packages which
+// aren't installed.
+func parseDpkgQuery(r io.Reader) []Package {
+	var pkgs []Package
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 5 || len(fields[0]) < 2 || fields[0][1] != 'i' {
+			continue
+		}
+
+		pkgs = append(pkgs, Package{
+			Name:         fields[1],
+			Version:      fields[2],
+			Architecture: fields[3],
+			Source:       fields[4],
+		})
+	}
+
+	return pkgs
+}
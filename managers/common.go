@@ -2,25 +2,33 @@ package managers
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 
 	"github.com/lxc/distrobuilder/v3/shared"
 )
 
 type common struct {
-	commands   managerCommands
-	flags      managerFlags
-	hooks      managerHooks
-	logger     *logrus.Logger
-	definition shared.Definition
-	ctx        context.Context
+	commands     managerCommands
+	flags        managerFlags
+	hooks        managerHooks
+	logger       *logrus.Logger
+	definition   shared.Definition
+	ctx          context.Context
+	packageCache bool
 }
 
 func (c *common) init(ctx context.Context, logger *logrus.Logger, definition shared.Definition) {
 	c.logger = logger
 	c.definition = definition
 	c.ctx = ctx
+
+	cacheDir := PackageCacheDir(definition.Packages.Manager)
+	c.packageCache = cacheDir != "" && isMountPoint(cacheDir)
 }
 
 // Install installs packages to the rootfs.
@@ -53,6 +61,18 @@ func (c *common) remove(pkgs, flags []string) error {
 func (c *common) clean() error {
 	var err error
 
+	// The package cache is unmounted first, as it would be wiped otherwise.
+	if c.packageCache {
+		cacheDir := PackageCacheDir(c.definition.Packages.Manager)
+
+		err = unix.Unmount(cacheDir, 0)
+		if err != nil {
+			return fmt.Errorf("Failed to unmount package cache %q: %w", cacheDir, err)
+		}
+
+		c.packageCache = false
+	}
+
 	if len(c.flags.clean) == 0 {
 		return nil
 	}
@@ -103,3 +123,24 @@ func (c *common) update() error {
 func (c *common) manageRepository(repo shared.DefinitionPackagesRepository) error {
 	return nil
 }
+
+func (c *common) listPackages() ([]Package, error) {
+	return nil, ErrListPackagesUnsupported
+}
+
+// isMountPoint returns whether something is mounted on the path.
+func isMountPoint(path string) bool {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && fields[4] == path {
+			return true
+		}
+	}
+
+	return false
+}
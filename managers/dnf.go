@@ -41,9 +41,18 @@ func (m *dnf) load() error {
 		},
 	}
 
+	// Keep the downloaded packages in the package cache.
+	if m.packageCache {
+		m.flags.global = append(m.flags.global, "--setopt=keepcache=True")
+	}
+
 	return nil
 }
 
 func (m *dnf) manageRepository(repoAction shared.DefinitionPackagesRepository) error {
 	return yumManageRepository(repoAction)
 }
+
+func (m *dnf) listPackages() ([]Package, error) {
+	return rpmListPackages(m.ctx)
+}
@@ -33,3 +33,7 @@ func (m *egoportage) load() error {
 
 	return nil
 }
+
+func (m *egoportage) listPackages() ([]Package, error) {
+	return portageListPackages("/var/db/pkg")
+}
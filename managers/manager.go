@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -14,6 +15,9 @@ import (
 // ErrUnknownManager represents the unknown manager error.
 var ErrUnknownManager = errors.New("Unknown manager")
 
+// ErrListPackagesUnsupported is returned if a manager can't list the installed packages.
+var ErrListPackagesUnsupported = errors.New("Listing installed packages isn't supported")
+
 // managerFlags represents flags for all subcommands of a package manager.
 type managerFlags struct {
 	global  []string
@@ -39,6 +43,14 @@ type managerCommands struct {
 	update  string
 }
 
+// Package represents an installed package.
+type Package struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture,omitempty"`
+	Source       string `json:"source,omitempty"`
+}
+
 // Manager represents a package manager.
 type Manager struct {
 	mgr    manager
@@ -56,6 +68,7 @@ type manager interface {
 	clean() error
 	refresh() error
 	update() error
+	listPackages() ([]Package, error)
 }
 
 var managers = map[string]func() manager{
@@ -75,6 +88,40 @@ var managers = map[string]func() manager{
 	"zypper":     func() manager { return &zypper{} },
 }
 
+// packageCacheDirs are the directories in which the package managers keep the
+// downloaded packages.
+var packageCacheDirs = map[string]string{
+	"apk":    "/var/cache/apk",
+	"apt":    "/var/cache/apt/archives",
+	"dnf":    "/var/cache/dnf",
+	"pacman": "/var/cache/pacman/pkg",
+	"xbps":   "/var/cache/xbps",
+	"yum":    "/var/cache/yum",
+}
+
+// PackageCacheDir returns the directory in which the package manager keeps the
+// downloaded packages, or an empty string if they can't be cached.
+func PackageCacheDir(managerName string) string {
+	return packageCacheDirs[managerName]
+}
+
+// Names returns the names of all package managers, excluding the custom one.
+func Names() []string {
+	names := make([]string, 0, len(managers))
+
+	for name := range managers {
+		if name == "" {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
 // Load loads and initializes a downloader.
 func Load(ctx context.Context, managerName string, logger *logrus.Logger, definition shared.Definition) (*Manager, error) {
 	df, ok := managers[managerName]
@@ -96,19 +143,11 @@ func Load(ctx context.Context, managerName string, logger *logrus.Logger, defini
 
 // ManagePackages manages packages.
 func (m *Manager) ManagePackages(imageTarget shared.ImageTarget) error {
-	var validSets []shared.DefinitionPackagesSet
-
-	for _, set := range m.def.Packages.Sets {
-		if !shared.ApplyFilter(&set, m.def.Image.Release, m.def.Image.ArchitectureMapped, m.def.Image.Variant, m.def.Targets.Type, imageTarget) {
-			continue
-		}
-
-		validSets = append(validSets, set)
-	}
+	sets := GetPackageSets(m.def, imageTarget)
 
 	// If there's nothing to install or remove, and no updates need to be performed,
 	// we can exit here.
-	if len(validSets) == 0 && !m.def.Packages.Update {
+	if len(sets) == 0 && !m.def.Packages.Update {
 		return nil
 	}
 
@@ -123,25 +162,13 @@ func (m *Manager) ManagePackages(imageTarget shared.ImageTarget) error {
 			return fmt.Errorf("Failed to update: %w", err)
 		}
 
-		m.logger.WithField("trigger", "post-update").Info("Running hooks")
-
-		// Run post update hook
-		for _, action := range m.def.GetRunnableActions("post-update", imageTarget) {
-			if action.Pongo {
-				action.Action, err = shared.RenderTemplate(action.Action, m.def)
-				if err != nil {
-					return fmt.Errorf("Failed to render action: %w", err)
-				}
-			}
-
-			err = shared.RunScript(m.ctx, action.Action)
-			if err != nil {
-				return fmt.Errorf("Failed to run post-update: %w", err)
-			}
+		err = m.runPostUpdateActions(imageTarget)
+		if err != nil {
+			return err
 		}
 	}
 
-	for _, set := range optimizePackageSets(validSets) {
+	for _, set := range sets {
 		switch set.Action {
 		case "install":
 			err = m.mgr.install(set.Packages, set.Flags)
@@ -152,6 +179,8 @@ func (m *Manager) ManagePackages(imageTarget shared.ImageTarget) error {
 		if err != nil {
 			return fmt.Errorf("Failed to %s packages: %w", set.Action, err)
 		}
+
+		shared.RecordEvent(m.ctx, shared.Event{Type: shared.EventPackagesManaged, Action: set.Action, Packages: set.Packages})
 	}
 
 	if m.def.Packages.Cleanup {
@@ -164,6 +193,64 @@ func (m *Manager) ManagePackages(imageTarget shared.ImageTarget) error {
 	return nil
 }
 
+// runPostUpdateActions runs the post-update actions, with the definition mounts
+// of the trigger set up.
+func (m *Manager) runPostUpdateActions(imageTarget shared.ImageTarget) (err error) {
+	m.logger.WithField("trigger", "post-update").Info("Running hooks")
+
+	actions := m.def.GetRunnableActions("post-update", imageTarget)
+	if len(actions) == 0 {
+		return nil
+	}
+
+	unmount, err := shared.BindMounts(m.def.GetMounts("post-update", imageTarget))
+	if err != nil {
+		return fmt.Errorf("Failed to setup mounts: %w", err)
+	}
+
+	defer func() {
+		unmountErr := unmount()
+		if unmountErr != nil && err == nil {
+			err = fmt.Errorf("Failed to remove mounts: %w", unmountErr)
+		}
+	}()
+
+	for _, action := range actions {
+		if action.Pongo {
+			action.Action, err = shared.RenderTemplate(action.Action, m.def)
+			if err != nil {
+				return fmt.Errorf("Failed to render action: %w", err)
+			}
+		}
+
+		err = shared.RunAction(m.ctx, "post-update", action)
+		if err != nil {
+			if action.ContinueOnError {
+				m.logger.WithFields(logrus.Fields{"trigger": "post-update", "err": err}).Warn("Ignoring failed action")
+				continue
+			}
+
+			return fmt.Errorf("Failed to run post-update: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ListPackages returns the installed packages, sorted by name.
+func (m *Manager) ListPackages() ([]Package, error) {
+	pkgs, err := m.mgr.listPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(pkgs, func(a, b Package) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return pkgs, nil
+}
+
 // ManageRepositories manages repositories.
 func (m *Manager) ManageRepositories(imageTarget shared.ImageTarget) error {
 	var err error
@@ -198,6 +285,22 @@ func (m *Manager) ManageRepositories(imageTarget shared.ImageTarget) error {
 	return nil
 }
 
+// GetPackageSets returns the package sets matching the image target, in the
+// order they're handled by ManagePackages.
+func GetPackageSets(definition shared.Definition, imageTarget shared.ImageTarget) []shared.DefinitionPackagesSet {
+	var validSets []shared.DefinitionPackagesSet
+
+	for _, set := range definition.Packages.Sets {
+		if !shared.ApplyFilter(&set, definition.Image.Release, definition.Image.ArchitectureMapped, definition.Image.Variant, definition.Targets.Type, imageTarget) {
+			continue
+		}
+
+		validSets = append(validSets, set)
+	}
+
+	return optimizePackageSets(validSets)
+}
+
 // optimizePackageSets groups consecutive package sets with the same action to
 // reduce the amount of calls to manager.{Install,Remove}(). It still honors the
 // order of execution.
@@ -1,6 +1,9 @@
 package managers
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -58,3 +61,109 @@ func TestManagePackages(t *testing.T) {
 	optimizedSets = optimizePackageSets(sets)
 	require.Len(t, optimizedSets, 0)
 }
+
+func TestParsePackages(t *testing.T) {
+	tests := []struct {
+		name     string
+		parse    func(string) ([]Package, error)
+		input    string
+		expected []Package
+	}{
+		{
+			"dpkg-query",
+			func(s string) ([]Package, error) { return parseDpkgQuery(strings.NewReader(s)), nil },
+			"ii \tbash\t5.2.21-2ubuntu4\tamd64\tbash\n" +
+				"rc \told\t1.0\tamd64\told\n" +
+				"ii \tlibc6\t2.39-0ubuntu8\tamd64\tglibc\n",
+			[]Package{
+				{Name: "bash", Version: "5.2.21-2ubuntu4", Architecture: "amd64", Source: "bash"},
+				{Name: "libc6", Version: "2.39-0ubuntu8", Architecture: "amd64", Source: "glibc"},
+			},
+		},
+		{
+			"rpm",
+			func(s string) ([]Package, error) { return parseRPMQuery(strings.NewReader(s)), nil },
+			"bash\t5.2.26-3.fc40\tx86_64\tbash-5.2.26-3.fc40.src.rpm\n" +
+				"shadow-utils\t2:4.15.1-3.fc40\tx86_64\tshadow-utils-4.15.1-3.fc40.src.rpm\n" +
+				"gpg-pubkey\ta15b79cc-63d04c2c\t(none)\t(none)\n",
+			[]Package{
+				{Name: "bash", Version: "5.2.26-3.fc40", Architecture: "x86_64", Source: "bash"},
+				{Name: "shadow-utils", Version: "2:4.15.1-3.fc40", Architecture: "x86_64", Source: "shadow-utils"},
+				{Name: "gpg-pubkey", Version: "a15b79cc-63d04c2c"},
+			},
+		},
+		{
+			"apk",
+			func(s string) ([]Package, error) { return parseAPKInstalled(strings.NewReader(s)) },
+			"C:Q1abc=\nP:musl\nV:1.2.5-r0\nA:x86_64\no:musl\n\n" +
+				"P:busybox-binsh\nV:1.36.1-r29\nA:x86_64\no:busybox\n",
+			[]Package{
+				{Name: "musl", Version: "1.2.5-r0", Architecture: "x86_64", Source: "musl"},
+				{Name: "busybox-binsh", Version: "1.36.1-r29", Architecture: "x86_64", Source: "busybox"},
+			},
+		},
+		{
+			"opkg",
+			func(s string) ([]Package, error) { return parseOpkgStatus(strings.NewReader(s)) },
+			"Package: busybox\nVersion: 1.36.1-1\nDepends: libc\nStatus: install user installed\nArchitecture: x86_64\nConffiles:\n /etc/syslog.conf abc\n\n" +
+				"Package: removed\nVersion: 1.0\nStatus: deinstall ok not-installed\nArchitecture: x86_64\n",
+			[]Package{
+				{Name: "busybox", Version: "1.36.1-1", Architecture: "x86_64"},
+			},
+		},
+		{
+			"pacman",
+			func(s string) ([]Package, error) {
+				pkg, err := parsePacmanDesc(strings.NewReader(s))
+				return []Package{pkg}, err
+			},
+			"%NAME%\nlib32-glibc\n\n%VERSION%\n2.39+r52+gf8e4623421-1\n\n%BASE%\nglibc\n\n%ARCH%\nx86_64\n\n%DEPENDS%\nglibc\nlinux-api-headers\n",
+			[]Package{
+				{Name: "lib32-glibc", Version: "2.39+r52+gf8e4623421-1", Architecture: "x86_64", Source: "glibc"},
+			},
+		},
+		{
+			"xbps",
+			func(s string) ([]Package, error) { return parseXbpsQuery(strings.NewReader(s)), nil },
+			"ii base-files-0.143_1   Void Linux base system files\n" +
+				"ii xz-5.4.6_1           XZ-format compression utilities\n",
+			[]Package{
+				{Name: "base-files", Version: "0.143_1"},
+				{Name: "xz", Version: "5.4.6_1"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkgs, err := tt.parse(tt.input)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, pkgs)
+		})
+	}
+}
+
+func TestPortageListPackages(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, pkg := range []string{"sys-apps/portage-3.0.63-r1", "media-fonts/font-adobe-100dpi-1.0.4", "sys-devel/gcc-13.2.1_p20240210"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, pkg), 0o755))
+	}
+
+	pkgs, err := portageListPackages(dir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []Package{
+		{Name: "sys-apps/portage", Version: "3.0.63-r1"},
+		{Name: "media-fonts/font-adobe-100dpi", Version: "1.0.4"},
+		{Name: "sys-devel/gcc", Version: "13.2.1_p20240210"},
+	}, pkgs)
+}
+
+func TestPackageCacheDir(t *testing.T) {
+	require.Equal(t, "/var/cache/apt/archives", PackageCacheDir("apt"))
+	require.Empty(t, PackageCacheDir("slackpkg"))
+	require.Empty(t, PackageCacheDir(""))
+
+	require.True(t, isMountPoint("/proc"))
+	require.False(t, isMountPoint(t.TempDir()))
+}
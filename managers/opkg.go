@@ -1,7 +1,11 @@
 package managers
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 )
 
 type opkg struct {
@@ -44,3 +48,73 @@ func (m *opkg) load() error {
 
 	return nil
 }
+
+func (m *opkg) listPackages() ([]Package, error) {
+	f, err := os.Open("/usr/lib/opkg/status")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open package database: %w", err)
+	}
+
+	defer f.Close()
+
+	return parseOpkgStatus(f)
+}
+
+// parseOpkgStatus parses the opkg status file, skipping packages which aren't
+// installed. Packages are separated by empty lines, and each line holds a
+// field name followed by a colon and the value.
+func parseOpkgStatus(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+	var pkg Package
+
+	installed := false
+
+	add := func() {
+		if pkg.Name != "" && installed {
+			pkgs = append(pkgs, pkg)
+		}
+
+		pkg = Package{}
+		installed = false
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			add()
+			continue
+		}
+
+		// Skip continuation lines of multi-line fields.
+		if strings.HasPrefix(line, " ") {
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "Package":
+			pkg.Name = value
+		case "Version":
+			pkg.Version = value
+		case "Architecture":
+			pkg.Architecture = value
+		case "Source":
+			pkg.Source = value
+		case "Status":
+			installed = strings.HasSuffix(value, " installed")
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read package database: %w", err)
+	}
+
+	add()
+
+	return pkgs, nil
+}
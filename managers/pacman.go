@@ -1,11 +1,14 @@
 package managers
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
 	"slices"
+	"strings"
 
 	"github.com/lxc/distrobuilder/v3/shared"
 )
@@ -138,3 +141,75 @@ func (m *pacman) setMirrorlist() error {
 
 	return nil
 }
+
+func (m *pacman) listPackages() ([]Package, error) {
+	return pacmanListPackages("/var/lib/pacman/local")
+}
+
+// pacmanListPackages lists the packages of the pacman local database, which
+// has a directory with a desc file for each installed package.
+func pacmanListPackages(dbDir string) ([]Package, error) {
+	descFiles, err := filepath.Glob(filepath.Join(dbDir, "*", "desc"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list package database: %w", err)
+	}
+
+	pkgs := make([]Package, 0, len(descFiles))
+
+	for _, descFile := range descFiles {
+		f, err := os.Open(descFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open %q: %w", descFile, err)
+		}
+
+		pkg, err := parsePacmanDesc(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %q: %w", descFile, err)
+		}
+
+		pkgs = append(pkgs, pkg)
+	}
+
+	return pkgs, nil
+}
+
+// parsePacmanDesc parses a desc file of the pacman local database. Each field
+// starts with its name, like %NAME%, followed by its values, one per line.
+func parsePacmanDesc(r io.Reader) (Package, error) {
+	var pkg Package
+	var field string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+			field = line
+			continue
+		}
+
+		if line == "" {
+			field = ""
+			continue
+		}
+
+		switch field {
+		case "%NAME%":
+			pkg.Name = line
+		case "%VERSION%":
+			pkg.Version = line
+		case "%ARCH%":
+			pkg.Architecture = line
+		case "%BASE%":
+			pkg.Source = line
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return Package{}, err
+	}
+
+	return pkg, nil
+}
@@ -1,5 +1,13 @@
 package managers
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
 type portage struct {
 	common
 }
@@ -30,3 +38,48 @@ func (m *portage) load() error {
 
 	return nil
 }
+
+func (m *portage) listPackages() ([]Package, error) {
+	return portageListPackages("/var/db/pkg")
+}
+
+// portageVersion matches the version of a package, including the revision.
+var portageVersion = regexp.MustCompile(`-([0-9][^-]*(-r[0-9]+)?)$`)
+
+// portageListPackages lists the packages of the portage database, which has
+// a <category>/<name>-<version> directory for each installed package.
+func portageListPackages(dbDir string) ([]Package, error) {
+	dirs, err := filepath.Glob(filepath.Join(dbDir, "*", "*"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list package database: %w", err)
+	}
+
+	pkgs := make([]Package, 0, len(dirs))
+
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to stat %q: %w", dir, err)
+		}
+
+		// Skip temporary files of packages being merged.
+		if !info.IsDir() || strings.HasPrefix(filepath.Base(dir), "-MERGING-") {
+			continue
+		}
+
+		category := filepath.Base(filepath.Dir(dir))
+		name := filepath.Base(dir)
+
+		match := portageVersion.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		}
+
+		pkgs = append(pkgs, Package{
+			Name:    fmt.Sprintf("%s/%s", category, name[:match[0]]),
+			Version: name[match[2]:match[3]],
+		})
+	}
+
+	return pkgs, nil
+}
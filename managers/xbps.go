@@ -1,5 +1,15 @@
 package managers
 
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lxc/distrobuilder/v3/shared"
+)
+
 type xbps struct {
 	common
 }
@@ -38,3 +48,38 @@ func (m *xbps) load() error {
 
 	return nil
 }
+
+func (m *xbps) listPackages() ([]Package, error) {
+	var out bytes.Buffer
+
+	err := shared.RunCommand(m.ctx, nil, &out, "xbps-query", "--list-pkgs")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list packages: %w", err)
+	}
+
+	return parseXbpsQuery(&out), nil
+}
+
+// parseXbpsQuery parses the output of xbps-query --list-pkgs, where each line
+// holds the state, the package name and version as <name>-<version>_<revision>,
+// and the description.
+func parseXbpsQuery(r io.Reader) []Package {
+	var pkgs []Package
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "ii" {
+			continue
+		}
+
+		idx := strings.LastIndex(fields[1], "-")
+		if idx <= 0 {
+			continue
+		}
+
+		pkgs = append(pkgs, Package{Name: fields[1][:idx], Version: fields[1][idx+1:]})
+	}
+
+	return pkgs
+}
@@ -3,7 +3,9 @@ package managers
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -67,6 +69,11 @@ func (m *yum) load() error {
 		}
 	}
 
+	// Keep the downloaded packages in the package cache.
+	if m.packageCache {
+		m.flags.global = append(m.flags.global, "--setopt=keepcache=1")
+	}
+
 	return nil
 }
 
@@ -116,3 +123,53 @@ func yumManageRepository(repoAction shared.DefinitionPackagesRepository) error {
 
 	return nil
 }
+
+func (m *yum) listPackages() ([]Package, error) {
+	return rpmListPackages(m.ctx)
+}
+
+// rpmListPackages lists the installed packages using rpm.
+func rpmListPackages(ctx context.Context) ([]Package, error) {
+	var out bytes.Buffer
+
+	err := shared.RunCommand(ctx, nil, &out, "rpm", "--query", "--all",
+		"--queryformat", "%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\t%{ARCH}\t%{SOURCERPM}\n")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list packages: %w", err)
+	}
+
+	return parseRPMQuery(&out), nil
+}
+
+// parseRPMQuery parses the output of rpm --query. The source package name is
+// taken from the source rpm file name.
+func parseRPMQuery(r io.Reader) []Package {
+	var pkgs []Package
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 {
+			continue
+		}
+
+		pkg := Package{Name: fields[0], Version: fields[1]}
+
+		if fields[2] != "(none)" {
+			pkg.Architecture = fields[2]
+		}
+
+		// Source rpms are named <name>-<version>-<release>.src.rpm.
+		source := strings.TrimSuffix(fields[3], ".src.rpm")
+		if source != fields[3] {
+			parts := strings.Split(source, "-")
+			if len(parts) > 2 {
+				pkg.Source = strings.Join(parts[:len(parts)-2], "-")
+			}
+		}
+
+		pkgs = append(pkgs, pkg)
+	}
+
+	return pkgs
+}
@@ -62,3 +62,7 @@ func (m *zypper) manageRepository(repoAction shared.DefinitionPackagesRepository
 
 	return shared.RunCommand(m.ctx, nil, nil, "zypper", "ar", "--refresh", "--check", repoAction.URL, repoAction.Name)
 }
+
+func (m *zypper) listPackages() ([]Package, error) {
+	return rpmListPackages(m.ctx)
+}
@@ -0,0 +1,228 @@
+package shared
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	incusArch "github.com/lxc/incus/v7/shared/osarch"
+	"golang.org/x/sys/unix"
+)
+
+// binfmtPath is the mount point of binfmt_misc.
+const binfmtPath = "/proc/sys/fs/binfmt_misc"
+
+// A qemuArchitecture describes the qemu-user emulator of a kernel architecture,
+// and the ELF header its binfmt_misc handler matches.
+type qemuArchitecture struct {
+	Name  string
+	Magic string
+	Mask  string
+}
+
+// qemuArchitectures are the qemu-user emulators of the kernel architectures,
+// using the ELF headers of qemu-binfmt-conf.sh.
+var qemuArchitectures = map[string]qemuArchitecture{
+	"aarch64": {
+		Name:  "aarch64",
+		Magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`,
+		Mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"armv6l": {
+		Name:  "arm",
+		Magic: `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`,
+		Mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"armv7l": {
+		Name:  "arm",
+		Magic: `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`,
+		Mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"i686": {
+		Name:  "i386",
+		Magic: `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x03\x00`,
+		Mask:  `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"ppc64": {
+		Name:  "ppc64",
+		Magic: `\x7fELF\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x15`,
+		Mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`,
+	},
+	"ppc64le": {
+		Name:  "ppc64le",
+		Magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x15\x00`,
+		Mask:  `\xff\xff\xff\xff\xff\xff\xff\xfc\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\x00`,
+	},
+	"riscv64": {
+		Name:  "riscv64",
+		Magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`,
+		Mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"s390x": {
+		Name:  "s390x",
+		Magic: `\x7fELF\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x16`,
+		Mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`,
+	},
+	"x86_64": {
+		Name:  "x86_64",
+		Magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00`,
+		Mask:  `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+}
+
+// compatibleArchitectures are the architectures which hosts run natively
+// besides their own.
+var compatibleArchitectures = map[string][]string{
+	"aarch64": {"armv6l", "armv7l", "armv8l"},
+	"ppc64":   {"ppc"},
+	"x86_64":  {"i686"},
+}
+
+// needsEmulation returns whether binaries of the architecture need to be
+// emulated on the host.
+func needsEmulation(host string, arch string) bool {
+	return arch != "" && arch != host && !slices.Contains(compatibleArchitectures[host], arch)
+}
+
+// parseBinfmtHandler returns the interpreter and flags of a binfmt_misc
+// handler, and whether the handler is enabled.
+func parseBinfmtHandler(content string) (string, string, bool) {
+	var interpreter string
+	var flags string
+	var enabled bool
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "enabled" {
+			enabled = true
+		}
+
+		value, ok := strings.CutPrefix(line, "interpreter ")
+		if ok {
+			interpreter = value
+		}
+
+		value, ok = strings.CutPrefix(line, "flags: ")
+		if ok {
+			flags = value
+		}
+	}
+
+	return interpreter, flags, enabled
+}
+
+// isStaticELF returns whether the ELF binary at the path is statically
+// linked, which is the case if it doesn't request a program interpreter.
+func isStaticELF(path string) (bool, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// setupEmulation returns the path of the qemu-user emulator which needs to be
+// bind mounted into the chroot to run the binaries of the architecture, or an
+// empty path if the host runs them natively or the binfmt_misc handler keeps
+// the emulator open (F flag). The handler is registered if there's none yet,
+// using the static emulator of the host.
+func setupEmulation(arch string) (string, error) {
+	host, err := incusArch.ArchitectureGetLocal()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get host architecture: %w", err)
+	}
+
+	if !needsEmulation(host, arch) {
+		return "", nil
+	}
+
+	qemuArch, ok := qemuArchitectures[arch]
+	if !ok {
+		return "", fmt.Errorf("Architecture %q can't be emulated", arch)
+	}
+
+	// binfmt_misc isn't always mounted.
+	_, err = os.Stat(filepath.Join(binfmtPath, "register"))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = unix.Mount("binfmt_misc", binfmtPath, "binfmt_misc", 0, "")
+		if err != nil {
+			return "", fmt.Errorf("Failed to mount binfmt_misc: %w", err)
+		}
+	}
+
+	handler := filepath.Join(binfmtPath, fmt.Sprintf("qemu-%s", qemuArch.Name))
+
+	content, err := os.ReadFile(handler)
+	if err == nil {
+		interpreter, flags, enabled := parseBinfmtHandler(string(content))
+
+		if !enabled {
+			err = os.WriteFile(handler, []byte("1"), 0o644)
+			if err != nil {
+				return "", fmt.Errorf("Failed to enable binfmt_misc handler %q: %w", handler, err)
+			}
+		}
+
+		// The kernel opens the emulator when the handler is registered, so it
+		// doesn't need to exist in the chroot.
+		if strings.Contains(flags, "F") {
+			return "", nil
+		}
+
+		// Otherwise, the emulator is bind mounted into the chroot, where it
+		// can't load any shared libraries.
+		static, err := isStaticELF(interpreter)
+		if err != nil {
+			return "", fmt.Errorf("Failed to check qemu-user emulator %q: %w", interpreter, err)
+		}
+
+		if !static {
+			return "", fmt.Errorf("Emulator %q of binfmt_misc handler %q is dynamically linked, which requires the F flag", interpreter, handler)
+		}
+
+		return interpreter, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("Failed to read binfmt_misc handler %q: %w", handler, err)
+	}
+
+	// The emulator runs in the chroot, so it needs to be static.
+	emulator, err := exec.LookPath(fmt.Sprintf("qemu-%s-static", qemuArch.Name))
+	if err != nil {
+		return "", fmt.Errorf("Failed to find static qemu-user emulator for %q: %w", arch, err)
+	}
+
+	emulator, err = filepath.Abs(emulator)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get absolute path of %q: %w", emulator, err)
+	}
+
+	// The handler keeps the emulator open, so that it's found in any chroot.
+	rule := fmt.Sprintf(":qemu-%s:M::%s:%s:%s:F", qemuArch.Name, qemuArch.Magic, qemuArch.Mask, emulator)
+
+	err = os.WriteFile(filepath.Join(binfmtPath, "register"), []byte(rule), 0o200)
+	if err != nil {
+		return "", fmt.Errorf("Failed to register binfmt_misc handler for %q: %w", arch, err)
+	}
+
+	return "", nil
+}
@@ -0,0 +1,96 @@
+package shared
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNeedsEmulation(t *testing.T) {
+	tests := []struct {
+		host     string
+		arch     string
+		expected bool
+	}{
+		{"x86_64", "x86_64", false},
+		{"x86_64", "i686", false},
+		{"x86_64", "aarch64", true},
+		{"x86_64", "riscv64", true},
+		{"aarch64", "armv7l", false},
+		{"aarch64", "x86_64", true},
+		{"x86_64", "", false},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, needsEmulation(tt.host, tt.arch), "%s on %s", tt.arch, tt.host)
+	}
+}
+
+func TestParseBinfmtHandler(t *testing.T) {
+	interpreter, flags, enabled := parseBinfmtHandler(`enabled
+interpreter /usr/libexec/qemu-binfmt/aarch64-binfmt-P
+flags: POCF
+offset 0
+magic 7f454c460201010000000000000000000200b700
+mask ffffffffffffff00fffffffffffffffffeffffff
+`)
+	require.Equal(t, "/usr/libexec/qemu-binfmt/aarch64-binfmt-P", interpreter)
+	require.Equal(t, "POCF", flags)
+	require.True(t, enabled)
+
+	interpreter, flags, enabled = parseBinfmtHandler("disabled\ninterpreter /usr/bin/qemu-riscv64-static\nflags: \n")
+	require.Equal(t, "/usr/bin/qemu-riscv64-static", interpreter)
+	require.Empty(t, flags)
+	require.False(t, enabled)
+}
+
+func TestIsStaticELF(t *testing.T) {
+	dir := t.TempDir()
+
+	// writeELF writes an ELF header followed by a single program header.
+	writeELF := func(name string, progType elf.ProgType) string {
+		var buf bytes.Buffer
+
+		header := elf.Header64{
+			Type:      uint16(elf.ET_EXEC),
+			Machine:   uint16(elf.EM_AARCH64),
+			Version:   uint32(elf.EV_CURRENT),
+			Phoff:     64,
+			Ehsize:    64,
+			Phentsize: 56,
+			Phnum:     1,
+		}
+
+		copy(header.Ident[:], elf.ELFMAG)
+		header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+		header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+		header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+		require.NoError(t, binary.Write(&buf, binary.LittleEndian, header))
+		require.NoError(t, binary.Write(&buf, binary.LittleEndian, elf.Prog64{Type: uint32(progType)}))
+
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o755))
+
+		return path
+	}
+
+	static, err := isStaticELF(writeELF("static", elf.PT_LOAD))
+	require.NoError(t, err)
+	require.True(t, static)
+
+	static, err = isStaticELF(writeELF("dynamic", elf.PT_INTERP))
+	require.NoError(t, err)
+	require.False(t, static)
+
+	path := filepath.Join(dir, "script")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"), 0o755))
+
+	_, err = isStaticELF(path)
+	require.Error(t, err)
+}
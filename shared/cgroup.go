@@ -0,0 +1,512 @@
+package shared
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupPath is the mount point of the cgroup v2 hierarchy.
+const cgroupPath = "/sys/fs/cgroup"
+
+// ResourceUsage is the resource usage of the commands in a cgroup during a
+// build stage. The CPU time is in seconds, the other values in bytes.
+type ResourceUsage struct {
+	MemoryPeak uint64  `json:"memory_peak,omitempty"`
+	CPUTime    float64 `json:"cpu_time,omitempty"`
+	IORead     uint64  `json:"io_read,omitempty"`
+	IOWritten  uint64  `json:"io_written,omitempty"`
+}
+
+// A Cgroup is the cgroup v2 of a build, which limits the resources of the
+// commands run in the chroot.
+type Cgroup struct {
+	path       string
+	parent     string
+	supervisor string
+	enabled    []string
+	dir        *os.File
+	peak       *os.File
+	start      ResourceUsage
+}
+
+// NewCgroup creates the cgroup of a build in the cgroup of distrobuilder, and
+// applies the limits to it.
+func NewCgroup(limits DefinitionLimits) (*Cgroup, error) {
+	_, err := os.Stat(filepath.Join(cgroupPath, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("Resource limits require cgroup v2 mounted at %q", cgroupPath)
+	}
+
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read cgroup: %w", err)
+	}
+
+	own, err := parseProcCgroup(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := cgroupLimitFiles(limits)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cgroup{parent: filepath.Join(cgroupPath, own)}
+
+	// The memory and io controllers are also used to report the resource
+	// usage, if available.
+	err = c.enableControllers(cgroupControllers(limits), []string{"memory", "io"})
+	if err != nil {
+		_ = c.Remove()
+		return nil, err
+	}
+
+	err = c.create(files)
+	if err != nil {
+		_ = c.Remove()
+		return nil, err
+	}
+
+	// The cgroup is accessed through its file descriptor, as the commands are
+	// started and measured from within the chroot.
+	c.dir, err = os.Open(c.path)
+	if err != nil {
+		_ = c.Remove()
+		return nil, fmt.Errorf("Failed to open cgroup %q: %w", c.path, err)
+	}
+
+	err = c.StartStage()
+	if err != nil {
+		_ = c.Remove()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// create creates the cgroup in the parent cgroup, and writes the limit files.
+// The cgroup gets a unique name, as distrobuilder runs as PID 1 of its own PID
+// namespace, and builds may share the parent cgroup. The path is only set once
+// the cgroup exists, so that Remove never touches the cgroup of another build.
+func (c *Cgroup) create(files map[string]string) error {
+	path, err := os.MkdirTemp(c.parent, "distrobuilder.")
+	if err != nil {
+		return fmt.Errorf("Failed to create cgroup in %q: %w", c.parent, err)
+	}
+
+	c.path = path
+
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		err = os.WriteFile(filepath.Join(c.path, name), []byte(files[name]), 0o644)
+		if err != nil {
+			return fmt.Errorf("Failed to set %q of cgroup %q: %w", name, c.path, err)
+		}
+	}
+
+	return nil
+}
+
+// enableControllers enables the required and the available optional
+// controllers for the sub-cgroups of the parent cgroup.
+func (c *Cgroup) enableControllers(required []string, optional []string) error {
+	content, err := os.ReadFile(filepath.Join(c.parent, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("Failed to read cgroup controllers: %w", err)
+	}
+
+	available := strings.Fields(string(content))
+
+	content, err = os.ReadFile(filepath.Join(c.parent, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("Failed to read cgroup controllers: %w", err)
+	}
+
+	enabled := strings.Fields(string(content))
+
+	var controllers []string
+
+	for _, controller := range required {
+		if !slices.Contains(available, controller) {
+			return fmt.Errorf("Cgroup controller %q isn't available", controller)
+		}
+	}
+
+	for _, controller := range append(required, optional...) {
+		if slices.Contains(available, controller) && !slices.Contains(enabled, controller) && !slices.Contains(controllers, controller) {
+			controllers = append(controllers, controller)
+		}
+	}
+
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	err = c.writeSubtreeControl("+", controllers)
+	if errors.Is(err, unix.EBUSY) {
+		// Controllers can't be enabled for the sub-cgroups of a cgroup with
+		// processes, so distrobuilder moves itself into a sub-cgroup first.
+		supervisor, err := os.MkdirTemp(c.parent, "distrobuilder.*.supervisor")
+		if err != nil {
+			return fmt.Errorf("Failed to create cgroup in %q: %w", c.parent, err)
+		}
+
+		c.supervisor = supervisor
+
+		err = os.WriteFile(filepath.Join(c.supervisor, "cgroup.procs"), []byte("0"), 0o644)
+		if err != nil {
+			return fmt.Errorf("Failed to move distrobuilder to cgroup %q: %w", c.supervisor, err)
+		}
+
+		err = c.writeSubtreeControl("+", controllers)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to enable cgroup controllers %v in %q: %w", controllers, c.parent, err)
+	}
+
+	c.enabled = controllers
+
+	return nil
+}
+
+// writeSubtreeControl enables or disables the controllers for the sub-cgroups
+// of the parent cgroup.
+func (c *Cgroup) writeSubtreeControl(op string, controllers []string) error {
+	var values []string
+
+	for _, controller := range controllers {
+		values = append(values, op+controller)
+	}
+
+	return os.WriteFile(filepath.Join(c.parent, "cgroup.subtree_control"), []byte(strings.Join(values, " ")), 0o644)
+}
+
+// Remove kills the processes left in the cgroup of the build, and removes it.
+// The cgroup of distrobuilder is restored.
+func (c *Cgroup) Remove() error {
+	if c.peak != nil {
+		_ = c.peak.Close()
+		c.peak = nil
+	}
+
+	if c.dir != nil {
+		_ = c.dir.Close()
+		c.dir = nil
+	}
+
+	_, err := os.Stat(c.path)
+	if err == nil {
+		// Processes which are left, like daemons started by packages, keep the
+		// cgroup busy.
+		_ = os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0o644)
+
+		err = RetryBackoff(func() error {
+			return os.Remove(c.path)
+		}, 5, 100*time.Millisecond)
+		if err != nil {
+			return fmt.Errorf("Failed to remove cgroup %q: %w", c.path, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed to stat %q: %w", c.path, err)
+	}
+
+	if c.supervisor != "" {
+		// Processes can't be moved into a cgroup which has controllers enabled
+		// for its sub-cgroups.
+		if len(c.enabled) > 0 {
+			err = c.writeSubtreeControl("-", c.enabled)
+			if err != nil {
+				return fmt.Errorf("Failed to disable cgroup controllers %v in %q: %w", c.enabled, c.parent, err)
+			}
+
+			c.enabled = nil
+		}
+
+		err = os.WriteFile(filepath.Join(c.parent, "cgroup.procs"), []byte("0"), 0o644)
+		if err != nil {
+			return fmt.Errorf("Failed to move distrobuilder to cgroup %q: %w", c.parent, err)
+		}
+
+		err = os.Remove(c.supervisor)
+		if err != nil {
+			return fmt.Errorf("Failed to remove cgroup %q: %w", c.supervisor, err)
+		}
+
+		c.supervisor = ""
+	}
+
+	return nil
+}
+
+// StartStage starts measuring the resource usage of a new build stage.
+func (c *Cgroup) StartStage() error {
+	usage, err := c.usage()
+	if err != nil {
+		return err
+	}
+
+	c.start = usage
+
+	if c.peak != nil {
+		_ = c.peak.Close()
+		c.peak = nil
+	}
+
+	// Writing to memory.peak resets the peak seen through the same file
+	// descriptor. On older kernels, the peak is the one of the whole build.
+	peak, err := c.openFile("memory.peak", unix.O_RDWR)
+	if err == nil {
+		_, err = peak.WriteString("reset\n")
+		if err != nil {
+			_ = peak.Close()
+		}
+	}
+
+	if err != nil {
+		peak, err = c.openFile("memory.peak", unix.O_RDONLY)
+	}
+
+	// Without the memory controller, there's no peak.
+	if err == nil {
+		c.peak = peak
+	}
+
+	return nil
+}
+
+// StageUsage returns the resource usage since the start of the build stage.
+func (c *Cgroup) StageUsage() (ResourceUsage, error) {
+	current, err := c.usage()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+
+	usage := ResourceUsage{
+		CPUTime:   current.CPUTime - c.start.CPUTime,
+		IORead:    current.IORead - c.start.IORead,
+		IOWritten: current.IOWritten - c.start.IOWritten,
+	}
+
+	if c.peak != nil {
+		content := make([]byte, 64)
+
+		n, err := c.peak.ReadAt(content, 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return ResourceUsage{}, fmt.Errorf("Failed to read memory peak: %w", err)
+		}
+
+		usage.MemoryPeak, err = strconv.ParseUint(strings.TrimSpace(string(content[:n])), 10, 64)
+		if err != nil {
+			return ResourceUsage{}, fmt.Errorf("Failed to parse memory peak: %w", err)
+		}
+	}
+
+	return usage, nil
+}
+
+// usage returns the CPU time and I/O of the cgroup since its creation.
+func (c *Cgroup) usage() (ResourceUsage, error) {
+	var usage ResourceUsage
+
+	content, err := c.readFile("cpu.stat")
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+
+	usage.CPUTime = float64(parseCgroupStat(content)["usage_usec"]) / 1e6
+
+	// Without the io controller, there's no io.stat.
+	content, err = c.readFile("io.stat")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return ResourceUsage{}, err
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		// The first field is the device.
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		stat := parseCgroupStat(strings.Join(fields[1:], "\n"))
+		usage.IORead += stat["rbytes"]
+		usage.IOWritten += stat["wbytes"]
+	}
+
+	return usage, nil
+}
+
+// openFile opens a file of the cgroup.
+func (c *Cgroup) openFile(name string, flags int) (*os.File, error) {
+	fd, err := unix.Openat(int(c.dir.Fd()), name, flags|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: filepath.Join(c.path, name), Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), filepath.Join(c.path, name)), nil
+}
+
+// readFile reads a file of the cgroup.
+func (c *Cgroup) readFile(name string) (string, error) {
+	file, err := c.openFile(name, unix.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %q: %w", file.Name(), err)
+	}
+
+	return string(content), nil
+}
+
+// parseProcCgroup returns the cgroup v2 path in the content of
+// /proc/self/cgroup.
+func parseProcCgroup(content string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		path, ok := strings.CutPrefix(scanner.Text(), "0::")
+		if ok {
+			return path, nil
+		}
+	}
+
+	return "", errors.New("Resource limits require cgroup v2")
+}
+
+// parseCgroupStat parses the flat keyed content of cgroup files, like
+// cpu.stat.
+func parseCgroupStat(content string) map[string]uint64 {
+	stat := map[string]uint64{}
+
+	for _, line := range strings.Split(content, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			key, value, ok = strings.Cut(line, "=")
+		}
+
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err == nil {
+			stat[key] = n
+		}
+	}
+
+	return stat
+}
+
+// cgroupControllers returns the controllers which the limits need.
+func cgroupControllers(limits DefinitionLimits) []string {
+	var controllers []string
+
+	if limits.MemoryMax != "" {
+		controllers = append(controllers, "memory")
+	}
+
+	if limits.CPUWeight > 0 || limits.CPUQuota != "" {
+		controllers = append(controllers, "cpu")
+	}
+
+	if limits.PidsMax > 0 {
+		controllers = append(controllers, "pids")
+	}
+
+	if limits.IOWeight > 0 {
+		controllers = append(controllers, "io")
+	}
+
+	return controllers
+}
+
+// cgroupLimitFiles returns the content of the cgroup files which apply the
+// limits, keyed by file name.
+func cgroupLimitFiles(limits DefinitionLimits) (map[string]string, error) {
+	files := map[string]string{}
+
+	if limits.MemoryMax != "" {
+		size, err := memoryMax(limits.MemoryMax)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse memory limit %q: %w", limits.MemoryMax, err)
+		}
+
+		files["memory.max"] = strconv.FormatInt(size, 10)
+	}
+
+	if limits.CPUWeight > 0 {
+		files["cpu.weight"] = strconv.FormatUint(limits.CPUWeight, 10)
+	}
+
+	if limits.CPUQuota != "" {
+		value, err := cpuMax(limits.CPUQuota)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse CPU quota %q: %w", limits.CPUQuota, err)
+		}
+
+		files["cpu.max"] = value
+	}
+
+	if limits.PidsMax > 0 {
+		files["pids.max"] = strconv.FormatUint(limits.PidsMax, 10)
+	}
+
+	if limits.IOWeight > 0 {
+		files["io.weight"] = fmt.Sprintf("default %d", limits.IOWeight)
+	}
+
+	return files, nil
+}
+
+// memoryMax returns the bytes of a memory size, like 4GiB.
+func memoryMax(size string) (int64, error) {
+	bytes, err := units.RAMInBytes(size)
+	if err != nil {
+		return 0, err
+	}
+
+	if bytes <= 0 {
+		return 0, errors.New("Size must be positive")
+	}
+
+	return bytes, nil
+}
+
+// cpuMax returns the content of cpu.max for a percentage of one CPU, which is
+// the quota per period of 100ms in microseconds.
+func cpuMax(quota string) (string, error) {
+	value, ok := strings.CutSuffix(quota, "%")
+	if !ok {
+		return "", errors.New("Quota must be a percentage")
+	}
+
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", err
+	}
+
+	// The kernel requires a quota of at least 1ms.
+	if percent < 1 {
+		return "", errors.New("Quota must be at least 1%")
+	}
+
+	return fmt.Sprintf("%d 100000", int64(percent*1000)), nil
+}
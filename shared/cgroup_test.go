@@ -0,0 +1,109 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcCgroup(t *testing.T) {
+	path, err := parseProcCgroup("0::/user.slice/user-1000.slice/session-1.scope\n")
+	require.NoError(t, err)
+	require.Equal(t, "/user.slice/user-1000.slice/session-1.scope", path)
+
+	// Hybrid hierarchies have a cgroup v2 entry as well.
+	path, err = parseProcCgroup("4:memory:/build\n1:cpu:/\n0::/\n")
+	require.NoError(t, err)
+	require.Equal(t, "/", path)
+
+	_, err = parseProcCgroup("4:memory:/build\n1:cpu:/\n")
+	require.Error(t, err)
+}
+
+func TestParseCgroupStat(t *testing.T) {
+	stat := parseCgroupStat("usage_usec 1500000\nuser_usec 1000000\nsystem_usec 500000\n")
+	require.Equal(t, uint64(1500000), stat["usage_usec"])
+	require.Equal(t, uint64(500000), stat["system_usec"])
+
+	stat = parseCgroupStat("rbytes=4096\nwbytes=8192\nrios=1")
+	require.Equal(t, uint64(4096), stat["rbytes"])
+	require.Equal(t, uint64(8192), stat["wbytes"])
+}
+
+func TestCgroupLimitFiles(t *testing.T) {
+	tests := []struct {
+		limits     DefinitionLimits
+		expected   map[string]string
+		shouldFail bool
+	}{
+		{
+			DefinitionLimits{},
+			map[string]string{},
+			false,
+		},
+		{
+			DefinitionLimits{MemoryMax: "4GiB", PidsMax: 1024},
+			map[string]string{"memory.max": "4294967296", "pids.max": "1024"},
+			false,
+		},
+		{
+			DefinitionLimits{CPUWeight: 50, CPUQuota: "150%", IOWeight: 200},
+			map[string]string{"cpu.weight": "50", "cpu.max": "150000 100000", "io.weight": "default 200"},
+			false,
+		},
+		{
+			DefinitionLimits{CPUQuota: "0.5%"},
+			nil,
+			true,
+		},
+		{
+			DefinitionLimits{MemoryMax: "0"},
+			nil,
+			true,
+		},
+	}
+
+	for i, tt := range tests {
+		files, err := cgroupLimitFiles(tt.limits)
+		if tt.shouldFail {
+			require.Error(t, err, "test %d", i)
+			continue
+		}
+
+		require.NoError(t, err, "test %d", i)
+		require.Equal(t, tt.expected, files, "test %d", i)
+	}
+}
+
+func TestCgroupControllers(t *testing.T) {
+	require.Empty(t, cgroupControllers(DefinitionLimits{}))
+	require.Equal(t, []string{"memory", "cpu", "pids", "io"}, cgroupControllers(DefinitionLimits{MemoryMax: "1G", CPUQuota: "100%", PidsMax: 10, IOWeight: 100}))
+	require.Equal(t, []string{"cpu"}, cgroupControllers(DefinitionLimits{CPUWeight: 100}))
+}
+
+func TestCgroupCreate(t *testing.T) {
+	parent := t.TempDir()
+
+	// Builds sharing the parent cgroup get their own cgroups.
+	first := &Cgroup{parent: parent}
+	require.NoError(t, first.create(map[string]string{"pids.max": "1024"}))
+
+	second := &Cgroup{parent: parent}
+	require.NoError(t, second.create(map[string]string{"pids.max": "512"}))
+
+	require.NotEqual(t, first.path, second.path)
+
+	content, err := os.ReadFile(filepath.Join(first.path, "pids.max"))
+	require.NoError(t, err)
+	require.Equal(t, "1024", string(content))
+
+	// A cgroup which couldn't be created doesn't remove the other ones.
+	failed := &Cgroup{parent: filepath.Join(parent, "missing")}
+	require.Error(t, failed.create(nil))
+	require.Empty(t, failed.path)
+	require.NoError(t, failed.Remove())
+	require.DirExists(t, first.path)
+	require.NoFileExists(t, filepath.Join(first.path, "cgroup.kill"))
+}
@@ -1,10 +1,14 @@
 package shared
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 
 	incus "github.com/lxc/incus/v7/shared/util"
@@ -24,6 +28,14 @@ type ChrootMount struct {
 // ActiveChroots is a map of all active chroots and their exit functions.
 var ActiveChroots = make(map[string]func() error)
 
+// chrootHost keeps the host rootfs and cwd while in a chroot, which allows
+// running host actions from within the chroot.
+var chrootHost struct {
+	root   *os.File
+	cwd    string
+	rootfs string
+}
+
 func setupMounts(rootfs string, mounts []ChrootMount) error {
 	// Create a temporary mount path
 	err := os.MkdirAll(filepath.Join(rootfs, ".distrobuilder"), 0o700)
@@ -52,6 +64,12 @@ func setupMounts(rootfs string, mounts []ChrootMount) error {
 
 		// Mount to the temporary path
 		err := unix.Mount(mount.Source, tmpTarget, mount.FSType, mount.Flags, mount.Data)
+		if errors.Is(err, unix.EPERM) && mount.FSType == "sysfs" {
+			// In user namespaces, sysfs can only be mounted with a new network
+			// namespace, so the host's is used instead.
+			err = unix.Mount("/sys", tmpTarget, "", unix.MS_BIND|unix.MS_REC, "")
+		}
+
 		if err != nil {
 			return fmt.Errorf("Failed to mount '%s': %w", mount.Source, err)
 		}
@@ -178,8 +196,23 @@ func killChrootProcesses(rootfs string) error {
 
 // SetupChroot sets up mount and files, a reverter and then chroots for you.
 func SetupChroot(rootfs string, definition Definition, m []ChrootMount) (func() error, error) {
+	hostRootfs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get absolute path of %q: %w", rootfs, err)
+	}
+
+	// Bind mount the emulator if the host can't run the binaries natively
+	emulator, err := setupEmulation(definition.Image.ArchitectureKernel)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to setup emulation: %w", err)
+	}
+
+	if emulator != "" {
+		m = append(slices.Clone(m), ChrootMount{emulator, emulator, "", unix.MS_BIND, "", false})
+	}
+
 	// Mount the rootfs
-	err := unix.Mount(rootfs, rootfs, "", unix.MS_BIND, "")
+	err = unix.Mount(rootfs, rootfs, "", unix.MS_BIND, "")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to mount '%s': %w", rootfs, err)
 	}
@@ -229,6 +262,17 @@ func SetupChroot(rootfs string, definition Definition, m []ChrootMount) (func()
 		return nil, err
 	}
 
+	chrootHost.root = root
+	chrootHost.cwd = cwd
+	chrootHost.rootfs = hostRootfs
+
+	// The emulator is removed again if it's not part of the rootfs.
+	var emulatorPaths []string
+
+	if emulator != "" {
+		emulatorPaths = missingPaths(emulator)
+	}
+
 	// Move all the mounts into place
 	err = moveMounts(append(mounts, m...))
 	if err != nil {
@@ -328,6 +372,21 @@ exit 101
 			}
 		}
 
+		// Remove the emulator while its path is resolved in the chroot
+		if len(emulatorPaths) > 0 {
+			err = unix.Unmount(emulator, unix.MNT_DETACH)
+			if err != nil {
+				return fmt.Errorf("Failed unmounting %q: %w", emulator, err)
+			}
+
+			for i := len(emulatorPaths) - 1; i >= 0; i-- {
+				err = os.Remove(emulatorPaths[i])
+				if err != nil {
+					return fmt.Errorf("Failed to remove %q: %w", emulatorPaths[i], err)
+				}
+			}
+		}
+
 		// Reset old environment variables
 		SetEnvVariables(oldEnv)
 
@@ -347,6 +406,8 @@ exit 101
 			return fmt.Errorf("Failed to chdir: %w", err)
 		}
 
+		chrootHost.root = nil
+
 		// This will kill all processes in the chroot and allow to cleanly
 		// unmount everything.
 		err = killChrootProcesses(rootfs)
@@ -378,6 +439,140 @@ exit 101
 	return exitFunc, nil
 }
 
+// hostPath returns the path under which a path of the host is reached from
+// within the active chroot, through the file descriptor of the host rootfs.
+func hostPath(path string) string {
+	return filepath.Join(fmt.Sprintf("/proc/self/fd/%d", chrootHost.root.Fd()), path)
+}
+
+// runOnHost makes the command run on the host rather than in the active
+// chroot, and sets the path of the chroot on the host in its environment.
+func runOnHost(cmd *exec.Cmd) {
+	if chrootHost.root == nil {
+		return
+	}
+
+	// The process is chrooted back into the host rootfs through the
+	// inherited file descriptor, before changing its working directory.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &unix.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Chroot = hostPath("/")
+
+	cmd.Dir = chrootHost.cwd
+	cmd.Env = append(cmd.Environ(), fmt.Sprintf("%s=%s", EnvRootfs, chrootHost.rootfs))
+}
+
+// BindMounts bind mounts the sources of the definition mounts from the host
+// into the active chroot. It returns a function which unmounts them again and
+// removes the mount points it created, so that they don't end up in the image.
+func BindMounts(mounts []DefinitionMount) (func() error, error) {
+	var mounted []string
+	var created []string
+
+	unmount := func() error {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			err := unix.Unmount(mounted[i], unix.MNT_DETACH)
+			if err != nil {
+				return fmt.Errorf("Failed unmounting %q: %w", mounted[i], err)
+			}
+		}
+
+		mounted = nil
+
+		for i := len(created) - 1; i >= 0; i-- {
+			err := os.Remove(created[i])
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("Failed to remove %q: %w", created[i], err)
+			}
+		}
+
+		created = nil
+
+		return nil
+	}
+
+	if len(mounts) == 0 {
+		return unmount, nil
+	}
+
+	if chrootHost.root == nil {
+		return nil, errors.New("Bind mounts require an active chroot")
+	}
+
+	for _, mount := range mounts {
+		err := bindMount(mount, &mounted, &created)
+		if err != nil {
+			_ = unmount()
+			return nil, err
+		}
+	}
+
+	return unmount, nil
+}
+
+// bindMount bind mounts a host path into the active chroot, recording the
+// mount and the created paths.
+func bindMount(mount DefinitionMount, mounted *[]string, created *[]string) error {
+	source := hostPath(mount.Source)
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("Failed to stat %q: %w", mount.Source, err)
+	}
+
+	missing := missingPaths(mount.Target)
+
+	if info.IsDir() {
+		err = os.MkdirAll(mount.Target, 0o755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(mount.Target), 0o755)
+		if err == nil && !incus.PathExists(mount.Target) {
+			err = os.WriteFile(mount.Target, nil, 0o644)
+		}
+	}
+
+	*created = append(*created, missing...)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create %q: %w", mount.Target, err)
+	}
+
+	err = unix.Mount(source, mount.Target, "", unix.MS_BIND|unix.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("Failed to mount %q: %w", mount.Source, err)
+	}
+
+	*mounted = append(*mounted, mount.Target)
+
+	// Bind mounts can only be made read-only by remounting them.
+	if !mount.Writable {
+		err = unix.Mount("", mount.Target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, "")
+		if err != nil {
+			return fmt.Errorf("Failed to remount %q read-only: %w", mount.Target, err)
+		}
+	}
+
+	return nil
+}
+
+// missingPaths returns the missing paths up to the path, from the top-most one
+// down to the path itself.
+func missingPaths(path string) []string {
+	var missing []string
+
+	for ; path != "/"; path = filepath.Dir(path) {
+		if incus.PathExists(path) {
+			break
+		}
+
+		missing = append([]string{path}, missing...)
+	}
+
+	return missing
+}
+
 func populateDev() error {
 	devs := []struct {
 		Path  string
@@ -402,6 +597,22 @@ func populateDev() error {
 		dev := unix.Mkdev(d.Major, d.Minor)
 
 		err := unix.Mknod(d.Path, d.Mode, int(dev))
+		if errors.Is(err, unix.EPERM) && chrootHost.root != nil {
+			// Devices can't be created in user namespaces, so the host's are
+			// bind mounted instead.
+			err = os.WriteFile(d.Path, nil, 0o644)
+			if err != nil {
+				return fmt.Errorf("Failed to create %q: %w", d.Path, err)
+			}
+
+			err = unix.Mount(hostPath(d.Path), d.Path, "", unix.MS_BIND, "")
+			if err != nil {
+				return fmt.Errorf("Failed to mount %q: %w", d.Path, err)
+			}
+
+			continue
+		}
+
 		if err != nil {
 			return fmt.Errorf("Failed to create %q: %w", d.Path, err)
 		}
@@ -3,6 +3,8 @@ package shared
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"slices"
 	"strconv"
@@ -10,6 +12,7 @@ import (
 	"time"
 
 	incusArch "github.com/lxc/incus/v7/shared/osarch"
+	"gopkg.in/yaml.v2"
 )
 
 // ImageTarget represents the image target.
@@ -64,6 +67,7 @@ type Filter interface {
 	GetArchitectures() []string
 	GetVariants() []string
 	GetTypes() []DefinitionFilterType
+	GetExcept() *DefinitionFilter
 }
 
 // A DefinitionFilter defines filters for various actions.
@@ -72,6 +76,7 @@ type DefinitionFilter struct {
 	Architectures []string               `yaml:"architectures,omitempty"`
 	Variants      []string               `yaml:"variants,omitempty"`
 	Types         []DefinitionFilterType `yaml:"types,omitempty"`
+	Except        *DefinitionFilter      `yaml:"except,omitempty"`
 }
 
 // GetReleases returns a list of releases.
@@ -94,6 +99,17 @@ func (d *DefinitionFilter) GetTypes() []DefinitionFilterType {
 	return d.Types
 }
 
+// GetExcept returns the filter of excluded images.
+func (d *DefinitionFilter) GetExcept() *DefinitionFilter {
+	return d.Except
+}
+
+// PackageActions are the actions of package sets.
+var PackageActions = []string{
+	"install",
+	"remove",
+}
+
 // A DefinitionPackagesSet is a set of packages which are to be installed
 // or removed.
 type DefinitionPackagesSet struct {
@@ -224,13 +240,79 @@ type DefinitionFileTemplate struct {
 	When       []string          `yaml:"when,omitempty"`
 }
 
+// ActionTriggers are the triggers of actions.
+var ActionTriggers = []string{
+	"post-files",
+	"post-generators",
+	"post-pack",
+	"post-packages",
+	"post-unpack",
+	"post-update",
+	"pre-pack",
+	"pre-unpack",
+}
+
+// HostActionTriggers are the triggers of actions which run while there's no
+// chroot, and therefore need to run on the host.
+var HostActionTriggers = []string{
+	"post-pack",
+	"pre-pack",
+	"pre-unpack",
+}
+
+// Network modes of actions.
+const (
+	ActionNetworkHost = "host"
+	ActionNetworkNone = "none"
+)
+
+// ActionNetworks are the network modes of actions.
+var ActionNetworks = []string{ActionNetworkHost, ActionNetworkNone}
+
 // A DefinitionAction specifies a custom action (script) which is to be run after
 // a certain action.
 type DefinitionAction struct {
 	DefinitionFilter `yaml:",inline"`
-	Trigger          string `yaml:"trigger"`
-	Action           string `yaml:"action"`
-	Pongo            bool   `yaml:"pongo,omitempty"`
+	Trigger          string            `yaml:"trigger"`
+	Action           string            `yaml:"action"`
+	File             string            `yaml:"file,omitempty"`
+	Interpreter      string            `yaml:"interpreter,omitempty"`
+	Pongo            bool              `yaml:"pongo,omitempty"`
+	Host             bool              `yaml:"host,omitempty"`
+	Network          string            `yaml:"network,omitempty"`
+	Env              map[string]string `yaml:"env,omitempty"`
+	Timeout          string            `yaml:"timeout,omitempty"`
+	Retries          uint              `yaml:"retries,omitempty"`
+	ContinueOnError  bool              `yaml:"continue_on_error,omitempty"`
+}
+
+// MountTriggers are the triggers of actions which mounts can be limited to.
+var MountTriggers = []string{
+	"post-packages",
+	"post-unpack",
+	"post-update",
+}
+
+// A DefinitionMount specifies a host path which is bind mounted into the chroot
+// before the generators run. Without triggers, it's mounted while managing
+// repositories and packages, and otherwise only while running the actions of
+// the triggers.
+type DefinitionMount struct {
+	DefinitionFilter `yaml:",inline"`
+	Source           string   `yaml:"source"`
+	Target           string   `yaml:"target"`
+	Writable         bool     `yaml:"writable,omitempty"`
+	Triggers         []string `yaml:"triggers,omitempty"`
+}
+
+// DefinitionLimits specifies the cgroup v2 resource limits of the commands run
+// in the chroot. The CPU quota is a percentage of one CPU, like 150%.
+type DefinitionLimits struct {
+	MemoryMax string `yaml:"memory_max,omitempty"`
+	CPUWeight uint64 `yaml:"cpu_weight,omitempty"`
+	CPUQuota  string `yaml:"cpu_quota,omitempty"`
+	PidsMax   uint64 `yaml:"pids_max,omitempty"`
+	IOWeight  uint64 `yaml:"io_weight,omitempty"`
 }
 
 // DefinitionMappings defines custom mappings.
@@ -252,22 +334,140 @@ type DefinitionEnv struct {
 	EnvVariables  []DefinitionEnvVars `yaml:"variables,omitempty"`
 }
 
+// A DefinitionVariableValue is a value of a user-defined variable.
+type DefinitionVariableValue struct {
+	DefinitionFilter `yaml:",inline"`
+	Value            string `yaml:"value"`
+}
+
+// A DefinitionVariable is a list of values of which the last one matching the
+// filters is used. A plain scalar is a single value without filters.
+type DefinitionVariable []DefinitionVariableValue
+
+// UnmarshalYAML accepts both a scalar and a list of values.
+func (d *DefinitionVariable) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+
+	err := unmarshal(&value)
+	if err == nil {
+		*d = DefinitionVariable{{Value: value}}
+		return nil
+	}
+
+	var values []DefinitionVariableValue
+
+	err = unmarshal(&values)
+	if err != nil {
+		return err
+	}
+
+	*d = values
+
+	return nil
+}
+
+// MarshalYAML returns a scalar for variables with a single value without filters.
+func (d DefinitionVariable) MarshalYAML() (interface{}, error) {
+	if len(d) == 1 && reflect.ValueOf(d[0].DefinitionFilter).IsZero() {
+		return d[0].Value, nil
+	}
+
+	return []DefinitionVariableValue(d), nil
+}
+
+// DefinitionMatrix defines the releases, architectures and variants built by build-matrix.
+type DefinitionMatrix struct {
+	Releases      []string `yaml:"releases,omitempty"`
+	Architectures []string `yaml:"architectures,omitempty"`
+	Variants      []string `yaml:"variants,omitempty"`
+	Output        string   `yaml:"output,omitempty"`
+}
+
+// A DefinitionMatrixEntry represents a single image of the matrix.
+type DefinitionMatrixEntry struct {
+	Release      string
+	Architecture string
+	Variant      string
+}
+
+// Options returns the entry as list of key=value options.
+func (e *DefinitionMatrixEntry) Options() []string {
+	var options []string
+
+	if e.Release != "" {
+		options = append(options, fmt.Sprintf("image.release=%s", e.Release))
+	}
+
+	if e.Architecture != "" {
+		options = append(options, fmt.Sprintf("image.architecture=%s", e.Architecture))
+	}
+
+	if e.Variant != "" {
+		options = append(options, fmt.Sprintf("image.variant=%s", e.Variant))
+	}
+
+	return options
+}
+
+// Expand returns all combinations of the matrix. Empty dimensions keep the
+// value from the image section.
+func (d *DefinitionMatrix) Expand() []DefinitionMatrixEntry {
+	releases := d.Releases
+	if len(releases) == 0 {
+		releases = []string{""}
+	}
+
+	architectures := d.Architectures
+	if len(architectures) == 0 {
+		architectures = []string{""}
+	}
+
+	variants := d.Variants
+	if len(variants) == 0 {
+		variants = []string{""}
+	}
+
+	var entries []DefinitionMatrixEntry
+
+	for _, release := range releases {
+		for _, architecture := range architectures {
+			for _, variant := range variants {
+				entries = append(entries, DefinitionMatrixEntry{
+					Release:      release,
+					Architecture: architecture,
+					Variant:      variant,
+				})
+			}
+		}
+	}
+
+	return entries
+}
+
 // A Definition a definition.
 type Definition struct {
-	Image       DefinitionImage    `yaml:"image"`
-	Source      DefinitionSource   `yaml:"source"`
-	Targets     DefinitionTarget   `yaml:"targets,omitempty"`
-	Files       []DefinitionFile   `yaml:"files,omitempty"`
-	Packages    DefinitionPackages `yaml:"packages,omitempty"`
-	Actions     []DefinitionAction `yaml:"actions,omitempty"`
-	Mappings    DefinitionMappings `yaml:"mappings,omitempty"`
-	Environment DefinitionEnv      `yaml:"environment,omitempty"`
+	Extends     []string                      `yaml:"extends,omitempty"`
+	Image       DefinitionImage               `yaml:"image"`
+	Source      DefinitionSource              `yaml:"source"`
+	Targets     DefinitionTarget              `yaml:"targets,omitempty"`
+	Files       []DefinitionFile              `yaml:"files,omitempty"`
+	Packages    DefinitionPackages            `yaml:"packages,omitempty"`
+	Actions     []DefinitionAction            `yaml:"actions,omitempty"`
+	Mounts      []DefinitionMount             `yaml:"mounts,omitempty"`
+	Limits      DefinitionLimits              `yaml:"limits,omitempty"`
+	Mappings    DefinitionMappings            `yaml:"mappings,omitempty"`
+	Environment DefinitionEnv                 `yaml:"environment,omitempty"`
+	Matrix      DefinitionMatrix              `yaml:"matrix,omitempty"`
+	Variables   map[string]DefinitionVariable `yaml:"variables,omitempty"`
 }
 
 // SetValue writes the provided value to a field represented by the yaml tag 'key'.
+// Slice elements are selected by their index, where negative indexes count from
+// the end and '+' appends a new element. Maps, pointers, slices and structs are
+// set using YAML or JSON values.
 func (d *Definition) SetValue(key string, value string) error {
 	// Walk through the definition and find the field with the given key
-	field, err := getFieldByTag(reflect.ValueOf(d).Elem(), reflect.TypeOf(d).Elem(), key)
+	field, commit, err := getFieldByTag(reflect.ValueOf(d).Elem(), reflect.TypeOf(d).Elem(), key)
 	if err != nil {
 		return fmt.Errorf("Failed to get field by tag: %w", err)
 	}
@@ -277,6 +477,14 @@ func (d *Definition) SetValue(key string, value string) error {
 		return fmt.Errorf("Cannot set value for %s", key)
 	}
 
+	// Values given on the command line don't have any filters.
+	if field.Type() == reflect.TypeOf(DefinitionVariable{}) {
+		field.Set(reflect.ValueOf(DefinitionVariable{{Value: value}}))
+		commit()
+
+		return nil
+	}
+
 	switch field.Kind() {
 	case reflect.Bool:
 		v, err := strconv.ParseBool(value)
@@ -301,15 +509,42 @@ func (d *Definition) SetValue(key string, value string) error {
 		}
 
 		field.SetUint(v)
+	case reflect.Map, reflect.Ptr, reflect.Slice, reflect.Struct:
+		// Complex values are given as YAML or JSON, e.g. '{"name": "foo"}'
+		v := reflect.New(field.Type())
+
+		err := yaml.UnmarshalStrict([]byte(value), v.Interface())
+		if err != nil && field.Kind() == reflect.Slice {
+			// A single element can be given without a list, e.g. 'foo' instead of '[foo]'
+			elem := reflect.New(field.Type().Elem())
+
+			if yaml.UnmarshalStrict([]byte(value), elem.Interface()) == nil {
+				v.Elem().Set(reflect.Append(reflect.MakeSlice(field.Type(), 0, 1), elem.Elem()))
+				err = nil
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse %s %q: %w", field.Kind(), value, err)
+		}
+
+		field.Set(v.Elem())
 	default:
 		return fmt.Errorf("Unsupported type '%s'", field.Kind())
 	}
 
+	commit()
+
 	return nil
 }
 
 // SetDefaults sets some default values.
 func (d *Definition) SetDefaults() {
+	d.SetDefaultsAt(time.Now())
+}
+
+// SetDefaultsAt sets some default values, using the given time for the serial.
+func (d *Definition) SetDefaultsAt(now time.Time) {
 	// default to local arch
 	if d.Image.Architecture == "" {
 		localArch, _ := incusArch.ArchitectureGetLocal()
@@ -323,7 +558,7 @@ func (d *Definition) SetDefaults() {
 
 	// Set default serial number
 	if d.Image.Serial == "" {
-		d.Image.Serial = time.Now().UTC().Format("20060102_1504")
+		d.Image.Serial = now.UTC().Format("20060102_1504")
 	}
 
 	// Set default variant
@@ -480,27 +715,71 @@ func (d *Definition) Validate() error {
 		}
 	}
 
-	validTriggers := []string{
-		"post-files",
-		"post-packages",
-		"post-unpack",
-		"post-update",
+	for _, action := range d.Actions {
+		if !slices.Contains(ActionTriggers, action.Trigger) {
+			return fmt.Errorf("actions.*.trigger must be one of %v", ActionTriggers)
+		}
+
+		if !action.Host && slices.Contains(HostActionTriggers, action.Trigger) {
+			return fmt.Errorf("actions.*.host must be true for the triggers %v", HostActionTriggers)
+		}
+
+		if action.Network != "" && !slices.Contains(ActionNetworks, action.Network) {
+			return fmt.Errorf("actions.*.network must be one of %v", ActionNetworks)
+		}
+
+		if action.Timeout != "" {
+			timeout, err := time.ParseDuration(action.Timeout)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("actions.*.timeout must be a positive duration like %q", "10m")
+			}
+		}
 	}
 
-	for _, action := range d.Actions {
-		if !slices.Contains(validTriggers, action.Trigger) {
-			return fmt.Errorf("actions.*.trigger must be one of %v", validTriggers)
+	for _, mount := range d.Mounts {
+		if !filepath.IsAbs(mount.Source) || !filepath.IsAbs(mount.Target) {
+			return errors.New("mounts.*.source and mounts.*.target must be absolute paths")
+		}
+
+		for _, trigger := range mount.Triggers {
+			if !slices.Contains(MountTriggers, trigger) {
+				return fmt.Errorf("mounts.*.triggers must be some of %v", MountTriggers)
+			}
 		}
 	}
 
-	validPackageActions := []string{
-		"install",
-		"remove",
+	if d.Limits.MemoryMax != "" {
+		_, err := memoryMax(d.Limits.MemoryMax)
+		if err != nil {
+			return errors.New("limits.memory_max must be a size, like 4GiB")
+		}
+	}
+
+	if d.Limits.CPUQuota != "" {
+		_, err := cpuMax(d.Limits.CPUQuota)
+		if err != nil {
+			return errors.New("limits.cpu_quota must be a percentage of one CPU, like 150%")
+		}
+	}
+
+	if d.Limits.CPUWeight > 10000 {
+		return errors.New("limits.cpu_weight must be between 1 and 10000")
+	}
+
+	if d.Limits.IOWeight > 10000 {
+		return errors.New("limits.io_weight must be between 1 and 10000")
+	}
+
+	for _, filter := range d.filters() {
+		err := validateFilter(filter)
+		if err != nil {
+			return fmt.Errorf("Invalid filter: %w", err)
+		}
 	}
 
 	for _, set := range d.Packages.Sets {
-		if !slices.Contains(validPackageActions, set.Action) {
-			return fmt.Errorf("packages.*.set.*.action must be one of %v", validPackageActions)
+		if !slices.Contains(PackageActions, set.Action) {
+			return fmt.Errorf("packages.*.set.*.action must be one of %v", PackageActions)
 		}
 	}
 
@@ -555,6 +834,55 @@ func (d *Definition) GetRunnableActions(trigger string, imageTarget ImageTarget)
 	return out
 }
 
+// GetMounts returns the mounts of the trigger, or the mounts without triggers
+// if the trigger is empty.
+func (d *Definition) GetMounts(trigger string, imageTarget ImageTarget) []DefinitionMount {
+	out := []DefinitionMount{}
+
+	for _, mount := range d.Mounts {
+		if trigger == "" && len(mount.Triggers) > 0 || trigger != "" && !slices.Contains(mount.Triggers, trigger) {
+			continue
+		}
+
+		if !ApplyFilter(&mount, d.Image.Release, d.Image.ArchitectureMapped, d.Image.Variant, d.Targets.Type, imageTarget) {
+			continue
+		}
+
+		out = append(out, mount)
+	}
+
+	return out
+}
+
+// LoadActionFiles loads the scripts of the actions which are set in files
+// rather than inline. Relative paths are resolved relative to baseDir.
+func (d *Definition) LoadActionFiles(baseDir string) error {
+	for i, action := range d.Actions {
+		if action.File == "" {
+			continue
+		}
+
+		if action.Action != "" {
+			return fmt.Errorf("actions.%d can't have both action and file", i)
+		}
+
+		path := action.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Failed to read action file %q: %w", path, err)
+		}
+
+		d.Actions[i].Action = string(content)
+		d.Actions[i].File = ""
+	}
+
+	return nil
+}
+
 // GetEarlyPackages returns a list of packages which are to be installed or removed earlier than the actual package handling
 // Also removes them from the package set so they aren't attempted to be re-installed again as normal packages.
 func (d *Definition) GetEarlyPackages(action string) []string {
@@ -575,6 +903,24 @@ func (d *Definition) GetEarlyPackages(action string) []string {
 	return early
 }
 
+// GetVariables returns the value of each user-defined variable. If several
+// values match the filters, the last one is used.
+func (d *Definition) GetVariables() map[string]string {
+	variables := make(map[string]string, len(d.Variables))
+
+	for name, values := range d.Variables {
+		for _, value := range values {
+			if !ApplyFilter(&value, d.Image.Release, d.Image.ArchitectureMapped, d.Image.Variant, d.Targets.Type, ImageTargetUndefined|ImageTargetAll|ImageTargetContainer|ImageTargetVM) {
+				continue
+			}
+
+			variables[name] = value.Value
+		}
+	}
+
+	return variables
+}
+
 func (d *Definition) getMappedArchitecture() (string, error) {
 	var arch string
 
@@ -601,27 +947,119 @@ func (d *Definition) getMappedArchitecture() (string, error) {
 	return arch, nil
 }
 
-func getFieldByTag(v reflect.Value, t reflect.Type, tag string) (reflect.Value, error) {
+// getFieldByTag returns the field represented by the yaml tag. Map values
+// aren't addressable, so a copy is returned for them and commit needs to be
+// called to store it after modifying the field.
+func getFieldByTag(v reflect.Value, t reflect.Type, tag string) (reflect.Value, func(), error) {
 	parts := strings.SplitN(tag, ".", 2)
+	noop := func() {}
 
 	if t.Kind() == reflect.Slice {
+		if parts[0] == "+" {
+			// Append a new element, e.g. 'foo.+'
+			if !v.CanSet() {
+				return reflect.Value{}, nil, errors.New("Cannot append to slice")
+			}
+
+			// Work on a new element, and only append it on commit, so that
+			// values which fail to parse don't leave an empty element.
+			elem := reflect.New(t.Elem()).Elem()
+
+			store := func() {
+				v.Set(reflect.Append(v, elem))
+			}
+
+			if len(parts) == 1 {
+				return elem, store, nil
+			}
+
+			field, commit, err := getFieldByTag(elem, t.Elem(), parts[1])
+			if err != nil {
+				return reflect.Value{}, nil, err
+			}
+
+			return field, func() {
+				commit()
+				store()
+			}, nil
+		}
+
 		// Get index, e.g. '0' from tag 'foo.0'
 		value, err := strconv.Atoi(parts[0])
 		if err != nil {
-			return reflect.Value{}, err
+			return reflect.Value{}, nil, err
 		}
 
-		if t.Elem().Kind() == reflect.Struct {
-			// Make sure we are in range, otherwise return error
-			if value < 0 || value >= v.Len() {
-				return reflect.Value{}, errors.New("Index out of range")
+		// Negative indexes count from the end, e.g. '-1' is the last element
+		if value < 0 {
+			value += v.Len()
+		}
+
+		// Make sure we are in range, otherwise return error
+		if value < 0 || value >= v.Len() {
+			return reflect.Value{}, nil, errors.New("Index out of range")
+		}
+
+		if len(parts) == 1 {
+			return v.Index(value), noop, nil
+		}
+
+		return getFieldByTag(v.Index(value), t.Elem(), parts[1])
+	}
+
+	if t.Kind() == reflect.Ptr {
+		// Create the element if needed, e.g. 'packages.custom_manager'
+		if v.IsNil() {
+			if !v.CanSet() {
+				return reflect.Value{}, nil, errors.New("Cannot create element")
 			}
 
-			return getFieldByTag(v.Index(value), t.Elem(), parts[1])
+			v.Set(reflect.New(t.Elem()))
 		}
 
-		// Primitive type
-		return v.Index(value), nil
+		return getFieldByTag(v.Elem(), t.Elem(), tag)
+	}
+
+	if t.Kind() == reflect.Map {
+		if t.Key().Kind() != reflect.String {
+			return reflect.Value{}, nil, fmt.Errorf("Unsupported map key type '%s'", t.Key().Kind())
+		}
+
+		if v.IsNil() {
+			if !v.CanSet() {
+				return reflect.Value{}, nil, errors.New("Cannot create map")
+			}
+
+			v.Set(reflect.MakeMap(t))
+		}
+
+		key := reflect.ValueOf(parts[0]).Convert(t.Key())
+
+		// Work on a copy of the map value, and store it on commit.
+		elem := reflect.New(t.Elem()).Elem()
+
+		existing := v.MapIndex(key)
+		if existing.IsValid() {
+			elem.Set(existing)
+		}
+
+		store := func() {
+			v.SetMapIndex(key, elem)
+		}
+
+		if len(parts) == 1 {
+			return elem, store, nil
+		}
+
+		field, commit, err := getFieldByTag(elem, t.Elem(), parts[1])
+		if err != nil {
+			return reflect.Value{}, nil, err
+		}
+
+		return field, func() {
+			commit()
+			store()
+		}, nil
 	}
 
 	if t.Kind() == reflect.Struct {
@@ -630,7 +1068,7 @@ func getFieldByTag(v reflect.Value, t reflect.Type, tag string) (reflect.Value,
 			value := t.Field(i).Tag.Get("yaml")
 			if value != "" && strings.Split(value, ",")[0] == parts[0] {
 				if len(parts) == 1 {
-					return v.Field(i), nil
+					return v.Field(i), noop, nil
 				}
 
 				return getFieldByTag(v.Field(i), t.Field(i).Type, parts[1])
@@ -639,20 +1077,25 @@ func getFieldByTag(v reflect.Value, t reflect.Type, tag string) (reflect.Value,
 	}
 
 	// Return its value if it's a primitive type
-	return v, nil
+	return v, noop, nil
 }
 
 // ApplyFilter returns true if the filter matches.
 func ApplyFilter(filter Filter, release string, architecture string, variant string, targetType DefinitionFilterType, acceptedImageTargets ImageTarget) bool {
-	if len(filter.GetReleases()) > 0 && !slices.Contains(filter.GetReleases(), release) {
+	if !matchFilterValues(filter.GetReleases(), release, true) {
+		return false
+	}
+
+	if !matchFilterValues(filter.GetArchitectures(), architecture, false) {
 		return false
 	}
 
-	if len(filter.GetArchitectures()) > 0 && !slices.Contains(filter.GetArchitectures(), architecture) {
+	if !matchFilterValues(filter.GetVariants(), variant, false) {
 		return false
 	}
 
-	if len(filter.GetVariants()) > 0 && !slices.Contains(filter.GetVariants(), variant) {
+	except := filter.GetExcept()
+	if except != nil && except.excludes(release, architecture, variant, targetType) {
 		return false
 	}
 
@@ -0,0 +1,194 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// definitionAppendKeys lists the sequences which are appended to when merging a
+// definition on top of its bases. All other sequences are replaced.
+var definitionAppendKeys = []string{
+	"actions",
+	"environment.variables",
+	"files",
+	"mounts",
+	"packages.repositories",
+	"packages.sets",
+	"targets.lxc.config",
+}
+
+// ResolveDefinitionExtends merges the definitions listed in the "extends" key
+// of the provided YAML document, and returns the resulting YAML document.
+// Relative paths are resolved relative to baseDir. If there is nothing to
+// extend, the document is returned as is.
+func ResolveDefinitionExtends(data []byte, baseDir string) ([]byte, error) {
+	var doc map[interface{}]interface{}
+
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok := doc["extends"]
+	if !ok {
+		return data, nil
+	}
+
+	merged, err := resolveDefinitionTree(doc, baseDir, nil, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(merged)
+}
+
+// resolveDefinitionTree merges the base definitions into doc. The seen paths
+// are the definitions being resolved, to detect circular extends, and included
+// holds the base definitions which were already merged, so that a base shared
+// by several others is only merged once.
+func resolveDefinitionTree(doc map[interface{}]interface{}, baseDir string, seen []string, included map[string]bool) (map[interface{}]interface{}, error) {
+	if doc == nil {
+		doc = map[interface{}]interface{}{}
+	}
+
+	value, ok := doc["extends"]
+	if !ok {
+		return doc, nil
+	}
+
+	delete(doc, "extends")
+
+	var bases []string
+
+	switch v := value.(type) {
+	case nil:
+	case string:
+		bases = []string{v}
+	case []interface{}:
+		for _, base := range v {
+			path, ok := base.(string)
+			if !ok {
+				return nil, errors.New("extends must be a list of paths")
+			}
+
+			bases = append(bases, path)
+		}
+
+	default:
+		return nil, errors.New("extends must be a list of paths")
+	}
+
+	merged := map[interface{}]interface{}{}
+
+	for _, base := range bases {
+		path := base
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get absolute path of %q: %w", base, err)
+		}
+
+		if slices.Contains(seen, path) {
+			return nil, fmt.Errorf("Circular extends of %q", path)
+		}
+
+		if included[path] {
+			continue
+		}
+
+		included[path] = true
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read base definition %q: %w", path, err)
+		}
+
+		var baseDoc map[interface{}]interface{}
+
+		err = yaml.Unmarshal(content, &baseDoc)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse base definition %q: %w", path, err)
+		}
+
+		resolveActionFiles(baseDoc, filepath.Dir(path))
+
+		baseDoc, err = resolveDefinitionTree(baseDoc, filepath.Dir(path), append(slices.Clone(seen), path), included)
+		if err != nil {
+			return nil, err
+		}
+
+		merged = mergeDefinitionTree(merged, baseDoc, "")
+	}
+
+	return mergeDefinitionTree(merged, doc, ""), nil
+}
+
+// resolveActionFiles makes the relative action files of a base definition
+// absolute, as they are relative to the base definition rather than to the
+// definition extending it.
+func resolveActionFiles(doc map[interface{}]interface{}, baseDir string) {
+	actions, ok := doc["actions"].([]interface{})
+	if !ok {
+		return
+	}
+
+	for _, action := range actions {
+		fields, ok := action.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		file, ok := fields["file"].(string)
+		if !ok || file == "" || filepath.IsAbs(file) {
+			continue
+		}
+
+		fields["file"] = filepath.Join(baseDir, file)
+	}
+}
+
+// mergeDefinitionTree merges src into dst. Maps are merged recursively, the
+// sequences listed in definitionAppendKeys are appended to, and everything else
+// in src replaces the value in dst.
+func mergeDefinitionTree(dst map[interface{}]interface{}, src map[interface{}]interface{}, prefix string) map[interface{}]interface{} {
+	for k, v := range src {
+		path := fmt.Sprint(k)
+		if prefix != "" {
+			path = fmt.Sprintf("%s.%s", prefix, path)
+		}
+
+		cur, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			continue
+		}
+
+		curMap, curIsMap := cur.(map[interface{}]interface{})
+		srcMap, srcIsMap := v.(map[interface{}]interface{})
+
+		if curIsMap && srcIsMap {
+			dst[k] = mergeDefinitionTree(curMap, srcMap, path)
+			continue
+		}
+
+		curList, curIsList := cur.([]interface{})
+		srcList, srcIsList := v.([]interface{})
+
+		if curIsList && srcIsList && slices.Contains(definitionAppendKeys, path) {
+			dst[k] = slices.Concat(curList, srcList)
+			continue
+		}
+
+		dst[k] = v
+	}
+
+	return dst
+}
@@ -0,0 +1,145 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestResolveDefinitionExtends(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "common"), 0o755)
+	require.NoError(t, err)
+
+	base := `image:
+  distribution: ubuntu
+  release: jammy
+source:
+  downloader: debootstrap
+  url: http://archive.ubuntu.com/ubuntu
+  keys:
+  - 0xBASE
+packages:
+  manager: apt
+  update: true
+  sets:
+  - packages:
+    - vim
+    action: install
+actions:
+- trigger: post-unpack
+  action: echo base
+- trigger: post-files
+  file: base.sh
+`
+
+	err = os.WriteFile(filepath.Join(dir, "common", "base.yaml"), []byte(base), 0o644)
+	require.NoError(t, err)
+
+	extra := `extends: base.yaml
+packages:
+  sets:
+  - packages:
+    - curl
+    action: install
+`
+
+	err = os.WriteFile(filepath.Join(dir, "common", "extra.yaml"), []byte(extra), 0o644)
+	require.NoError(t, err)
+
+	child := `extends:
+- common/extra.yaml
+image:
+  release: noble
+source:
+  keys:
+  - 0xCHILD
+packages:
+  sets:
+  - packages:
+    - git
+    action: install
+actions:
+- trigger: post-packages
+  action: echo child
+`
+
+	data, err := ResolveDefinitionExtends([]byte(child), dir)
+	require.NoError(t, err)
+
+	var def Definition
+
+	err = yaml.UnmarshalStrict(data, &def)
+	require.NoError(t, err)
+
+	require.Empty(t, def.Extends)
+
+	// Scalars are overridden
+	require.Equal(t, "ubuntu", def.Image.Distribution)
+	require.Equal(t, "noble", def.Image.Release)
+	require.Equal(t, "http://archive.ubuntu.com/ubuntu", def.Source.URL)
+	require.Equal(t, "apt", def.Packages.Manager)
+	require.True(t, def.Packages.Update)
+
+	// Regular lists are replaced
+	require.Equal(t, []string{"0xCHILD"}, def.Source.Keys)
+
+	// Package sets and actions are appended
+	require.Len(t, def.Packages.Sets, 3)
+	require.Equal(t, []string{"vim"}, def.Packages.Sets[0].Packages)
+	require.Equal(t, []string{"curl"}, def.Packages.Sets[1].Packages)
+	require.Equal(t, []string{"git"}, def.Packages.Sets[2].Packages)
+
+	require.Len(t, def.Actions, 3)
+	require.Equal(t, "post-unpack", def.Actions[0].Trigger)
+	require.Equal(t, "post-packages", def.Actions[2].Trigger)
+
+	// Action files are relative to the base definition
+	require.Equal(t, filepath.Join(dir, "common", "base.sh"), def.Actions[1].File)
+
+	// Bases shared by several others are only merged once
+	other := `extends: base.yaml
+packages:
+  sets:
+  - packages:
+    - htop
+    action: install
+`
+
+	err = os.WriteFile(filepath.Join(dir, "common", "other.yaml"), []byte(other), 0o644)
+	require.NoError(t, err)
+
+	data, err = ResolveDefinitionExtends([]byte("extends: [common/extra.yaml, common/other.yaml]\n"), dir)
+	require.NoError(t, err)
+
+	def = Definition{}
+
+	err = yaml.UnmarshalStrict(data, &def)
+	require.NoError(t, err)
+
+	require.Len(t, def.Packages.Sets, 3)
+	require.Equal(t, []string{"vim"}, def.Packages.Sets[0].Packages)
+	require.Equal(t, []string{"curl"}, def.Packages.Sets[1].Packages)
+	require.Equal(t, []string{"htop"}, def.Packages.Sets[2].Packages)
+	require.Len(t, def.Actions, 2)
+
+	// Nothing to extend
+	data, err = ResolveDefinitionExtends([]byte(base), dir)
+	require.NoError(t, err)
+	require.Equal(t, base, string(data))
+
+	// Circular extends
+	err = os.WriteFile(filepath.Join(dir, "loop.yaml"), []byte("extends: [loop.yaml]\n"), 0o644)
+	require.NoError(t, err)
+
+	_, err = ResolveDefinitionExtends([]byte("extends: [loop.yaml]\n"), dir)
+	require.ErrorContains(t, err, "Circular extends")
+
+	// Missing base
+	_, err = ResolveDefinitionExtends([]byte("extends: [missing.yaml]\n"), dir)
+	require.ErrorContains(t, err, "Failed to read base definition")
+}
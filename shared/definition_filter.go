@@ -0,0 +1,277 @@
+package shared
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// versionOperators are the comparison operators allowed in release filters.
+// Longer operators come first so that they're matched before their prefixes.
+var versionOperators = []string{">=", "<=", ">", "<", "="}
+
+// excludes returns true if all criteria of the except filter match. An except
+// filter without any criteria never matches.
+func (d *DefinitionFilter) excludes(release string, architecture string, variant string, targetType DefinitionFilterType) bool {
+	if len(d.Releases) == 0 && len(d.Architectures) == 0 && len(d.Variants) == 0 && len(d.Types) == 0 {
+		return false
+	}
+
+	if !matchFilterValues(d.Releases, release, true) ||
+		!matchFilterValues(d.Architectures, architecture, false) ||
+		!matchFilterValues(d.Variants, variant, false) {
+		return false
+	}
+
+	if len(d.Types) > 0 && !slices.Contains(d.Types, targetType) {
+		return false
+	}
+
+	// A nested except filter includes images again.
+	if d.Except != nil && d.Except.excludes(release, architecture, variant, targetType) {
+		return false
+	}
+
+	return true
+}
+
+// filters returns all filterable entries of the definition.
+func (d *Definition) filters() []Filter {
+	var filters []Filter
+
+	for i := range d.Files {
+		filters = append(filters, &d.Files[i])
+	}
+
+	for i := range d.Actions {
+		filters = append(filters, &d.Actions[i])
+	}
+
+	for i := range d.Mounts {
+		filters = append(filters, &d.Mounts[i])
+	}
+
+	for i := range d.Packages.Sets {
+		filters = append(filters, &d.Packages.Sets[i])
+	}
+
+	for i := range d.Packages.Repositories {
+		filters = append(filters, &d.Packages.Repositories[i])
+	}
+
+	for i := range d.Environment.EnvVariables {
+		filters = append(filters, &d.Environment.EnvVariables[i])
+	}
+
+	for i := range d.Targets.LXC.Config {
+		filters = append(filters, &d.Targets.LXC.Config[i])
+	}
+
+	for _, values := range d.Variables {
+		for i := range values {
+			filters = append(filters, &values[i])
+		}
+	}
+
+	return filters
+}
+
+// matchFilterValues returns true if the value is allowed by the list of
+// patterns. Patterns starting with "!" exclude matching values. If there are
+// only excluding patterns, all other values are allowed.
+func matchFilterValues(patterns []string, value string, versions bool) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	hasAllowed := false
+	allowed := false
+
+	for _, pattern := range patterns {
+		negated, found := strings.CutPrefix(pattern, "!")
+		if found {
+			if matchFilterPattern(negated, value, versions) {
+				return false
+			}
+
+			continue
+		}
+
+		hasAllowed = true
+
+		if matchFilterPattern(pattern, value, versions) {
+			allowed = true
+		}
+	}
+
+	return allowed || !hasAllowed
+}
+
+// matchFilterPattern matches a value against a single pattern. A pattern is
+// either an exact value, a glob, or, for releases, a comma separated list of
+// version comparisons like ">=20.04,<24.04".
+func matchFilterPattern(pattern string, value string, versions bool) bool {
+	if pattern == value {
+		return true
+	}
+
+	if versions && isVersionConstraint(pattern) {
+		return matchVersionConstraints(pattern, value)
+	}
+
+	matched, err := path.Match(pattern, value)
+
+	return err == nil && matched
+}
+
+func isVersionConstraint(pattern string) bool {
+	return strings.HasPrefix(pattern, ">") || strings.HasPrefix(pattern, "<") || strings.HasPrefix(pattern, "=")
+}
+
+func parseVersionConstraint(constraint string) (string, string, error) {
+	for _, op := range versionOperators {
+		version, found := strings.CutPrefix(constraint, op)
+		if !found {
+			continue
+		}
+
+		if !isVersion(version) {
+			return "", "", fmt.Errorf("Invalid version %q in %q", version, constraint)
+		}
+
+		return op, version, nil
+	}
+
+	return "", "", fmt.Errorf("Invalid version constraint %q", constraint)
+}
+
+// isVersion returns true if the value starts with a number.
+func isVersion(value string) bool {
+	return value != "" && unicode.IsDigit(rune(value[0]))
+}
+
+func matchVersionConstraints(pattern string, value string) bool {
+	// Releases like "bookworm" or "edge" can't be compared.
+	if !isVersion(value) {
+		return false
+	}
+
+	for _, constraint := range strings.Split(pattern, ",") {
+		op, version, err := parseVersionConstraint(strings.TrimSpace(constraint))
+		if err != nil {
+			return false
+		}
+
+		cmp := compareVersions(value, version)
+
+		var ok bool
+
+		switch op {
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		case "=":
+			ok = cmp == 0
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareVersions compares two versions segment by segment. Numeric segments
+// are compared as numbers, all others as strings. It returns -1, 0 or 1.
+func compareVersions(a string, b string) int {
+	isSeparator := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+
+	partsA := strings.FieldsFunc(a, isSeparator)
+	partsB := strings.FieldsFunc(b, isSeparator)
+
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		if i >= len(partsA) {
+			return -1
+		}
+
+		if i >= len(partsB) {
+			return 1
+		}
+
+		numA, errA := strconv.Atoi(partsA[i])
+		numB, errB := strconv.Atoi(partsB[i])
+
+		var cmp int
+
+		if errA == nil && errB == nil {
+			cmp = numA - numB
+		} else {
+			cmp = strings.Compare(partsA[i], partsB[i])
+		}
+
+		if cmp < 0 {
+			return -1
+		}
+
+		if cmp > 0 {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// validateFilter checks the syntax of the filter patterns.
+func validateFilter(filter Filter) error {
+	fields := []struct {
+		patterns []string
+		versions bool
+	}{
+		{filter.GetReleases(), true},
+		{filter.GetArchitectures(), false},
+		{filter.GetVariants(), false},
+	}
+
+	for _, field := range fields {
+		for _, pattern := range field.patterns {
+			pattern = strings.TrimPrefix(pattern, "!")
+
+			if field.versions && isVersionConstraint(pattern) {
+				for _, constraint := range strings.Split(pattern, ",") {
+					_, _, err := parseVersionConstraint(strings.TrimSpace(constraint))
+					if err != nil {
+						return err
+					}
+				}
+
+				continue
+			}
+
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	except := filter.GetExcept()
+	if except != nil {
+		err := validateFilter(except)
+		if err != nil {
+			return fmt.Errorf("except: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -2,7 +2,10 @@ package shared
 
 import (
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/lxc/incus/v7/shared/osarch"
 	"github.com/stretchr/testify/require"
@@ -18,6 +21,12 @@ func TestSetDefinitionDefaults(t *testing.T) {
 
 	require.Equal(t, localArch, def.Image.Architecture)
 	require.Equal(t, "30d", def.Image.Expiry)
+
+	def = Definition{}
+
+	def.SetDefaultsAt(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	require.Equal(t, "20240102_0304", def.Image.Serial)
 }
 
 func TestValidateDefinition(t *testing.T) {
@@ -50,6 +59,12 @@ func TestValidateDefinition(t *testing.T) {
 				Mappings: DefinitionMappings{
 					ArchitectureMap: "debian",
 				},
+				Actions: []DefinitionAction{
+					{
+						Trigger: "post-pack",
+						Host:    true,
+					},
+				},
 			},
 			"",
 			false,
@@ -402,6 +417,175 @@ func TestValidateDefinition(t *testing.T) {
 			"actions\\.\\*\\.trigger must be one of .+",
 			true,
 		},
+		{
+			"pre-pack action in chroot",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+					URL:        "https://ubuntu.com",
+					Keys:       []string{"0xCODE"},
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Actions: []DefinitionAction{
+					{
+						Trigger: "pre-pack",
+					},
+				},
+			},
+			"actions\\.\\*\\.host must be true for the triggers .+",
+			true,
+		},
+		{
+			"invalid action timeout",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+					URL:        "https://ubuntu.com",
+					Keys:       []string{"0xCODE"},
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Actions: []DefinitionAction{
+					{
+						Trigger: "post-packages",
+						Timeout: "10",
+					},
+				},
+			},
+			"actions\\.\\*\\.timeout must be a positive duration .+",
+			true,
+		},
+		{
+			"invalid action network",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+					URL:        "https://ubuntu.com",
+					Keys:       []string{"0xCODE"},
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Actions: []DefinitionAction{
+					{
+						Trigger: "post-files",
+						Network: "bridge",
+					},
+				},
+			},
+			"actions\\.\\*\\.network must be one of .+",
+			true,
+		},
+		{
+			"relative mount target",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+					URL:        "https://ubuntu.com",
+					Keys:       []string{"0xCODE"},
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Mounts: []DefinitionMount{
+					{
+						Source: "/srv/repo",
+						Target: "srv/repo",
+					},
+				},
+			},
+			"mounts\\.\\*\\.source and mounts\\.\\*\\.target must be absolute paths",
+			true,
+		},
+		{
+			"invalid mount trigger",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+					URL:        "https://ubuntu.com",
+					Keys:       []string{"0xCODE"},
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Mounts: []DefinitionMount{
+					{
+						Source:   "/srv/repo",
+						Target:   "/srv/repo",
+						Triggers: []string{"post-files"},
+					},
+				},
+			},
+			"mounts\\.\\*\\.triggers must be some of .+",
+			true,
+		},
+		{
+			"invalid memory limit",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+					URL:        "https://ubuntu.com",
+					Keys:       []string{"0xCODE"},
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Limits: DefinitionLimits{
+					MemoryMax: "lots",
+				},
+			},
+			"limits\\.memory_max must be a size, like 4GiB",
+			true,
+		},
+		{
+			"invalid CPU quota",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+					URL:        "https://ubuntu.com",
+					Keys:       []string{"0xCODE"},
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Limits: DefinitionLimits{
+					CPUQuota: "2",
+				},
+			},
+			"limits\\.cpu_quota must be a percentage of one CPU, like 150%",
+			true,
+		},
 		{
 			"invalid package action",
 			Definition{
@@ -426,6 +610,33 @@ func TestValidateDefinition(t *testing.T) {
 			"packages\\.\\*\\.set\\.\\*\\.action must be one of .+",
 			true,
 		},
+		{
+			"invalid filter",
+			Definition{
+				Image: DefinitionImage{
+					Distribution: "ubuntu",
+					Release:      "artful",
+				},
+				Source: DefinitionSource{
+					Downloader: "debootstrap",
+				},
+				Packages: DefinitionPackages{
+					Manager: "apt",
+				},
+				Actions: []DefinitionAction{
+					{
+						Trigger: "post-unpack",
+						DefinitionFilter: DefinitionFilter{
+							Except: &DefinitionFilter{
+								Releases: []string{">=bionic"},
+							},
+						},
+					},
+				},
+			},
+			"Invalid filter: except: Invalid version .+",
+			true,
+		},
 	}
 
 	for i, tt := range tests {
@@ -440,6 +651,63 @@ func TestValidateDefinition(t *testing.T) {
 	}
 }
 
+func TestDefinitionGetMounts(t *testing.T) {
+	def := Definition{
+		Image: DefinitionImage{
+			Release:            "noble",
+			ArchitectureMapped: "amd64",
+		},
+		Mounts: []DefinitionMount{
+			{Source: "/srv/repo", Target: "/srv/repo"},
+			{Source: "/srv/keys", Target: "/etc/keys", Triggers: []string{"post-unpack", "post-packages"}},
+			{Source: "/srv/other", Target: "/srv/other", DefinitionFilter: DefinitionFilter{Releases: []string{"jammy"}}},
+		},
+	}
+
+	// Without trigger, only the mounts without triggers are returned.
+	mounts := def.GetMounts("", ImageTargetUndefined)
+	require.Len(t, mounts, 1)
+	require.Equal(t, "/srv/repo", mounts[0].Source)
+
+	mounts = def.GetMounts("post-packages", ImageTargetUndefined)
+	require.Len(t, mounts, 1)
+	require.Equal(t, "/srv/keys", mounts[0].Source)
+
+	require.Empty(t, def.GetMounts("post-update", ImageTargetUndefined))
+}
+
+func TestDefinitionLoadActionFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "setup.py"), []byte("print('hello')\n"), 0o644)
+	require.NoError(t, err)
+
+	def := Definition{
+		Actions: []DefinitionAction{
+			{Trigger: "post-unpack", Action: "echo inline"},
+			{Trigger: "post-packages", File: "setup.py", Interpreter: "python3"},
+		},
+	}
+
+	err = def.LoadActionFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, "echo inline", def.Actions[0].Action)
+	require.Equal(t, "print('hello')\n", def.Actions[1].Action)
+	require.Empty(t, def.Actions[1].File)
+
+	// Actions can't have both a script and a file.
+	def.Actions[0].File = "setup.py"
+
+	err = def.LoadActionFiles(dir)
+	require.ErrorContains(t, err, "actions.0 can't have both action and file")
+
+	// Missing files
+	def.Actions[0] = DefinitionAction{Trigger: "post-unpack", File: "missing.sh"}
+
+	err = def.LoadActionFiles(dir)
+	require.ErrorContains(t, err, "Failed to read action file")
+}
+
 func TestDefinitionSetValue(t *testing.T) {
 	d := Definition{
 		Image: DefinitionImage{
@@ -481,11 +749,93 @@ func TestDefinitionSetValue(t *testing.T) {
 
 	// Nonsense
 	err = d.SetValue("image", "[foo: bar]")
-	require.EqualError(t, err, "Unsupported type 'struct'")
+	require.ErrorContains(t, err, `Failed to parse struct "[foo: bar]"`)
 
 	err = d.SetValue("source.skip_verification", "true")
 	require.NoError(t, err)
 	require.Equal(t, true, d.Source.SkipVerification)
+
+	// Maps
+	err = d.SetValue("variables.foo", "bar")
+	require.NoError(t, err)
+	require.Equal(t, DefinitionVariable{{Value: "bar"}}, d.Variables["foo"])
+
+	err = d.SetValue("variables.foo", "baz")
+	require.NoError(t, err)
+	require.Equal(t, map[string]DefinitionVariable{"foo": {{Value: "baz"}}}, d.Variables)
+}
+
+func TestDefinitionSetValueComplex(t *testing.T) {
+	d := Definition{
+		Source: DefinitionSource{
+			Keys: []string{"0xCODE"},
+		},
+		Packages: DefinitionPackages{
+			Sets: []DefinitionPackagesSet{
+				{
+					Packages: []string{"foo"},
+					Action:   "install",
+				},
+			},
+		},
+	}
+
+	// Append to slices
+	err := d.SetValue("source.keys.+", "0xBEEF")
+	require.NoError(t, err)
+	require.Equal(t, []string{"0xCODE", "0xBEEF"}, d.Source.Keys)
+
+	err = d.SetValue("packages.sets.+.packages", "[bar, baz]")
+	require.NoError(t, err)
+	require.Len(t, d.Packages.Sets, 2)
+	require.Equal(t, []string{"bar", "baz"}, d.Packages.Sets[1].Packages)
+
+	// Negative indexes
+	err = d.SetValue("packages.sets.-1.action", "remove")
+	require.NoError(t, err)
+	require.Equal(t, "remove", d.Packages.Sets[1].Action)
+
+	err = d.SetValue("packages.sets.-1.packages.+", "qux")
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar", "baz", "qux"}, d.Packages.Sets[1].Packages)
+
+	err = d.SetValue("packages.sets.-3.action", "remove")
+	require.EqualError(t, err, "Failed to get field by tag: Index out of range")
+
+	// Single elements without a list
+	err = d.SetValue("packages.sets.0.packages", "bar")
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar"}, d.Packages.Sets[0].Packages)
+
+	// JSON values
+	err = d.SetValue("packages.repositories.+", `{"name": "ci", "url": "deb http://ci.example.com/ubuntu noble main"}`)
+	require.NoError(t, err)
+	require.Equal(t, []DefinitionPackagesRepository{{Name: "ci", URL: "deb http://ci.example.com/ubuntu noble main"}}, d.Packages.Repositories)
+
+	// Failed appends don't leave an empty element.
+	err = d.SetValue("packages.repositories.+", `{"nmae": "ci"}`)
+	require.ErrorContains(t, err, "Failed to parse struct")
+	require.Len(t, d.Packages.Repositories, 1)
+
+	sets := len(d.Packages.Sets)
+
+	err = d.SetValue("packages.sets.+.early", "maybe")
+	require.ErrorContains(t, err, "Failed to parse bool")
+	require.Len(t, d.Packages.Sets, sets)
+
+	// Maps
+	err = d.SetValue("mappings.architectures.x86_64", "amd64")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"x86_64": "amd64"}, d.Mappings.Architectures)
+
+	err = d.SetValue("mappings.architectures", "{aarch64: arm64}")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"aarch64": "arm64"}, d.Mappings.Architectures)
+
+	// Pointers
+	err = d.SetValue("packages.custom_manager.install.cmd", "pkg")
+	require.NoError(t, err)
+	require.Equal(t, "pkg", d.Packages.CustomManager.Install.Command)
 }
 
 func TestDefinitionFilter(t *testing.T) {
@@ -562,6 +912,74 @@ func TestApplyFilter(t *testing.T) {
 	require.False(t, ApplyFilter(&repo, "foo", "amd64", "default", "vm", ImageTargetContainer))
 }
 
+func TestApplyFilterPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   DefinitionFilter
+		release  string
+		arch     string
+		expected bool
+	}{
+		{"negation match", DefinitionFilter{Releases: []string{"!bookworm"}}, "bookworm", "amd64", false},
+		{"negation no match", DefinitionFilter{Releases: []string{"!bookworm"}}, "trixie", "amd64", true},
+		{"negation and allowlist", DefinitionFilter{Architectures: []string{"amd64", "arm64", "!arm64"}}, "9", "arm64", false},
+		{"glob match", DefinitionFilter{Releases: []string{"9.*"}}, "9.3", "amd64", true},
+		{"glob no match", DefinitionFilter{Releases: []string{"9.*"}}, "8.9", "amd64", false},
+		{"glob negation", DefinitionFilter{Architectures: []string{"!arm*"}}, "9", "armhf", false},
+		{"version greater or equal", DefinitionFilter{Releases: []string{">=22.04"}}, "22.10", "amd64", true},
+		{"version less", DefinitionFilter{Releases: []string{">=22.04"}}, "20.04", "amd64", false},
+		{"version numeric segments", DefinitionFilter{Releases: []string{">9"}}, "10", "amd64", true},
+		{"version range", DefinitionFilter{Releases: []string{">=20.04,<24.04"}}, "24.04", "amd64", false},
+		{"version range match", DefinitionFilter{Releases: []string{">=20.04,<24.04"}}, "22.04", "amd64", true},
+		{"version non-numeric release", DefinitionFilter{Releases: []string{">=12"}}, "bookworm", "amd64", false},
+		{"version or name", DefinitionFilter{Releases: []string{">=12", "sid"}}, "sid", "amd64", true},
+		{"except release", DefinitionFilter{Except: &DefinitionFilter{Releases: []string{"18.04", "20.04"}}}, "20.04", "amd64", false},
+		{"except other release", DefinitionFilter{Except: &DefinitionFilter{Releases: []string{"18.04", "20.04"}}}, "22.04", "amd64", true},
+		{"except all criteria", DefinitionFilter{Except: &DefinitionFilter{Releases: []string{"20.04"}, Architectures: []string{"arm64"}}}, "20.04", "amd64", true},
+		{"except empty", DefinitionFilter{Except: &DefinitionFilter{}}, "20.04", "amd64", true},
+		{"except nested", DefinitionFilter{Except: &DefinitionFilter{Releases: []string{"<22.04"}, Except: &DefinitionFilter{Releases: []string{"20.04"}}}}, "20.04", "amd64", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := DefinitionPackagesRepository{DefinitionFilter: tt.filter}
+			require.Equal(t, tt.expected, ApplyFilter(&repo, tt.release, tt.arch, "default", "container", 0))
+		})
+	}
+}
+
+func TestDefinitionFilterExceptUnmarshalYAML(t *testing.T) {
+	input := `actions:
+- trigger: post-unpack
+  action: echo foo
+  releases:
+  - ">=20.04"
+  except:
+    releases:
+    - "21.*"
+    types:
+    - vm`
+
+	def := Definition{}
+
+	err := yaml.UnmarshalStrict([]byte(input), &def)
+	require.NoError(t, err)
+	require.Equal(t, []string{">=20.04"}, def.Actions[0].Releases)
+	require.Equal(t, []string{"21.*"}, def.Actions[0].Except.Releases)
+	require.Equal(t, []DefinitionFilterType{DefinitionFilterTypeVM}, def.Actions[0].Except.Types)
+
+	require.True(t, ApplyFilter(&def.Actions[0], "21.10", "amd64", "default", "container", 0))
+	require.False(t, ApplyFilter(&def.Actions[0], "21.10", "amd64", "default", "vm", 0))
+}
+
+func TestCompareVersions(t *testing.T) {
+	require.Equal(t, 0, compareVersions("22.04", "22.04"))
+	require.Equal(t, -1, compareVersions("22.04", "22.10"))
+	require.Equal(t, 1, compareVersions("10", "9"))
+	require.Equal(t, -1, compareVersions("3.19", "3.19.1"))
+	require.Equal(t, 1, compareVersions("15.6", "15.5-beta"))
+}
+
 func TestDefinitionFilterTypeUnmarshalYAML(t *testing.T) {
 	data := "vm"
 	var out DefinitionFilterType
@@ -586,3 +1004,69 @@ func TestDefinitionFilterTypeUnmarshalYAML(t *testing.T) {
 	err = yaml.Unmarshal([]byte(data), &out)
 	require.EqualError(t, err, `Invalid filter type "vms"`)
 }
+
+func TestDefinitionMatrixExpand(t *testing.T) {
+	matrix := DefinitionMatrix{}
+	require.Equal(t, []DefinitionMatrixEntry{{}}, matrix.Expand())
+
+	matrix = DefinitionMatrix{
+		Releases:      []string{"jammy", "noble"},
+		Architectures: []string{"amd64", "arm64"},
+	}
+
+	entries := matrix.Expand()
+	require.Equal(t, []DefinitionMatrixEntry{
+		{Release: "jammy", Architecture: "amd64"},
+		{Release: "jammy", Architecture: "arm64"},
+		{Release: "noble", Architecture: "amd64"},
+		{Release: "noble", Architecture: "arm64"},
+	}, entries)
+
+	require.Equal(t, []string{"image.release=jammy", "image.architecture=amd64"}, entries[0].Options())
+
+	entry := DefinitionMatrixEntry{Variant: "cloud"}
+	require.Equal(t, []string{"image.variant=cloud"}, entry.Options())
+}
+
+func TestDefinitionVariables(t *testing.T) {
+	input := `image:
+  release: noble
+  architecture: arm64
+variables:
+  mirror: http://archive.ubuntu.com/ubuntu
+  kernel:
+  - value: linux-generic
+  - value: linux-raspi
+    architectures:
+    - arm64
+  - value: linux-kvm
+    types:
+    - vm`
+
+	def := Definition{}
+
+	err := yaml.Unmarshal([]byte(input), &def)
+	require.NoError(t, err)
+
+	require.Equal(t, DefinitionVariable{{Value: "http://archive.ubuntu.com/ubuntu"}}, def.Variables["mirror"])
+	require.Len(t, def.Variables["kernel"], 3)
+
+	def.Image.ArchitectureMapped = "arm64"
+
+	require.Equal(t, map[string]string{
+		"mirror": "http://archive.ubuntu.com/ubuntu",
+		"kernel": "linux-raspi",
+	}, def.GetVariables())
+
+	def.Targets.Type = DefinitionFilterTypeVM
+	require.Equal(t, "linux-kvm", def.GetVariables()["kernel"])
+
+	def.Image.ArchitectureMapped = "amd64"
+	def.Targets.Type = DefinitionFilterTypeContainer
+	require.Equal(t, "linux-generic", def.GetVariables()["kernel"])
+
+	// Variables without filters are marshalled as scalars.
+	out, err := yaml.Marshal(map[string]DefinitionVariable{"mirror": def.Variables["mirror"]})
+	require.NoError(t, err)
+	require.Equal(t, "mirror: http://archive.ubuntu.com/ubuntu\n", string(out))
+}
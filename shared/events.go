@@ -0,0 +1,206 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	EventStageStarted     = "stage-started"
+	EventStageFinished    = "stage-finished"
+	EventActionRun        = "action-run"
+	EventGeneratorRun     = "generator-run"
+	EventPackagesManaged  = "packages-managed"
+	EventArtifactWritten  = "artifact-written"
+	EventSourceDownloaded = "source-downloaded"
+	EventKeysImported     = "keys-imported"
+)
+
+// An Event is a build event. Only the fields relevant for its type are set.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// Stage events
+	Stage    string  `json:"stage,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+
+	// Stage events of builds with resource limits
+	Usage *ResourceUsage `json:"usage,omitempty"`
+
+	// Action events
+	Trigger  string `json:"trigger,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+
+	// Generator events
+	Generator string `json:"generator,omitempty"`
+
+	// Package events
+	Action   string   `json:"action,omitempty"`
+	Packages []string `json:"packages,omitempty"`
+
+	// Generator and artifact events
+	Path string `json:"path,omitempty"`
+
+	// Artifact events
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Source events
+	URL      string `json:"url,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+
+	// Key events
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+// An EventRecorder keeps events, and writes them to a file, one JSON object
+// per line.
+type EventRecorder struct {
+	mu     sync.Mutex
+	file   *os.File
+	err    error
+	events []Event
+	parent *EventRecorder
+}
+
+// NewEventRecorder returns a recorder appending events to the given file. If
+// the path is empty, events are only kept in memory.
+func NewEventRecorder(path string) (*EventRecorder, error) {
+	if path == "" {
+		return &EventRecorder{}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	return &EventRecorder{file: file}, nil
+}
+
+// NewChild returns a recorder which keeps its own events, and forwards them to
+// this recorder. It's used for the images of a matrix, which share the events
+// file, but have their own build reports.
+func (r *EventRecorder) NewChild() *EventRecorder {
+	return &EventRecorder{parent: r}
+}
+
+// Record writes the event. Errors are kept and returned by Close, so that
+// failing to record events doesn't fail the build.
+func (r *EventRecorder) Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		r.setErr(fmt.Errorf("Failed to marshal event: %w", err))
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, event)
+
+	if r.parent != nil {
+		r.parent.Record(event)
+	}
+
+	if r.file == nil {
+		return
+	}
+
+	// Write whole lines at once, as several processes may append to the file.
+	_, err = r.file.Write(append(data, '\n'))
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("Failed to write event: %w", err)
+	}
+}
+
+// Events returns the recorded events.
+func (r *EventRecorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.events)
+}
+
+func (r *EventRecorder) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Close closes the file, and returns the first error which occurred while
+// recording events.
+func (r *EventRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return r.err
+	}
+
+	err := r.file.Close()
+	if r.err != nil {
+		return r.err
+	}
+
+	return err
+}
+
+// RecordEvent records the event using the recorder of the context, if any.
+func RecordEvent(ctx context.Context, event Event) {
+	recorder, ok := ctx.Value(ContextKeyEvents).(*EventRecorder)
+	if !ok || recorder == nil {
+		return
+	}
+
+	recorder.Record(event)
+}
+
+// RecordArtifact records an artifact-written event for the file, including its
+// size and checksum.
+func RecordArtifact(ctx context.Context, path string) error {
+	recorder, ok := ctx.Value(ContextKeyEvents).(*EventRecorder)
+	if !ok || recorder == nil {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open %q: %w", path, err)
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("Failed to read %q: %w", path, err)
+	}
+
+	recorder.Record(Event{
+		Type:   EventArtifactWritten,
+		Path:   path,
+		Size:   size,
+		SHA256: fmt.Sprintf("%x", hash.Sum(nil)),
+	})
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package shared
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readEvents(t *testing.T, path string) []Event {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer file.Close()
+
+	var events []Event
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		require.NoError(t, err)
+
+		events = append(events, event)
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return events
+}
+
+func TestEventRecorder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+
+	// Events are appended to existing files.
+	err := os.WriteFile(path, []byte(`{"type":"stage-started","stage":"unpack"}`+"\n"), 0o644)
+	require.NoError(t, err)
+
+	recorder, err := NewEventRecorder(path)
+	require.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), ContextKeyEvents, recorder)
+
+	RecordEvent(ctx, Event{Type: EventStageFinished, Stage: "unpack", Duration: 1.5})
+
+	artifact := filepath.Join(dir, "rootfs.tar")
+
+	err = os.WriteFile(artifact, []byte("hello"), 0o644)
+	require.NoError(t, err)
+
+	err = RecordArtifact(ctx, artifact)
+	require.NoError(t, err)
+
+	err = RunAction(ctx, "post-unpack", DefinitionAction{Action: "#!/bin/sh\nexit 3\n"})
+	require.Error(t, err)
+
+	err = RunAction(ctx, "post-packages", DefinitionAction{Action: "#!/bin/sh\n"})
+	require.NoError(t, err)
+
+	require.NoError(t, recorder.Close())
+
+	events := readEvents(t, path)
+	require.Len(t, events, 5)
+
+	require.Equal(t, "unpack", events[0].Stage)
+
+	require.Equal(t, EventStageFinished, events[1].Type)
+	require.Equal(t, "unpack", events[1].Stage)
+	require.Equal(t, 1.5, events[1].Duration)
+	require.False(t, events[1].Time.IsZero())
+
+	require.Equal(t, EventArtifactWritten, events[2].Type)
+	require.Equal(t, artifact, events[2].Path)
+	require.Equal(t, int64(5), events[2].Size)
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", events[2].SHA256)
+
+	require.Equal(t, EventActionRun, events[3].Type)
+	require.Equal(t, "post-unpack", events[3].Trigger)
+	require.NotNil(t, events[3].ExitCode)
+	require.Equal(t, 3, *events[3].ExitCode)
+
+	require.Equal(t, "post-packages", events[4].Trigger)
+	require.NotNil(t, events[4].ExitCode)
+	require.Equal(t, 0, *events[4].ExitCode)
+}
+
+func TestEventRecorderMemory(t *testing.T) {
+	recorder, err := NewEventRecorder("")
+	require.NoError(t, err)
+
+	recorder.Record(Event{Type: EventStageStarted, Stage: "unpack"})
+
+	events := recorder.Events()
+	require.Len(t, events, 1)
+	require.Equal(t, "unpack", events[0].Stage)
+
+	require.NoError(t, recorder.Close())
+}
+
+func TestEventRecorderChild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	recorder, err := NewEventRecorder(path)
+	require.NoError(t, err)
+
+	recorder.Record(Event{Type: EventStageStarted, Stage: "unpack"})
+
+	// Children only keep their own events, but forward them to the file.
+	first := recorder.NewChild()
+	first.Record(Event{Type: EventStageStarted, Stage: "packages"})
+	require.NoError(t, first.Close())
+
+	second := recorder.NewChild()
+	second.Record(Event{Type: EventStageStarted, Stage: "pack"})
+	require.NoError(t, second.Close())
+
+	require.Len(t, first.Events(), 1)
+	require.Equal(t, "packages", first.Events()[0].Stage)
+	require.Len(t, second.Events(), 1)
+	require.Equal(t, "pack", second.Events()[0].Stage)
+	require.Len(t, recorder.Events(), 3)
+
+	require.NoError(t, recorder.Close())
+	require.Len(t, readEvents(t, path), 3)
+}
+
+func TestRecordEventWithoutRecorder(t *testing.T) {
+	ctx := context.Background()
+
+	// Without recorder, events are dropped and artifacts aren't read.
+	RecordEvent(ctx, Event{Type: EventStageStarted, Stage: "unpack"})
+	require.NoError(t, RecordArtifact(ctx, "/nonexistent"))
+}
@@ -0,0 +1,56 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// GPGCommand returns a gpg command which uses the given home directory.
+func GPGCommand(ctx context.Context, gpgDir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "gpg", append([]string{"--homedir", gpgDir}, args...)...)
+	cmd.Env = append(os.Environ(), "LANG=C.UTF-8")
+
+	return cmd
+}
+
+// CreateGPGHome creates a temporary gpg home directory inside of dir.
+func CreateGPGHome(dir string) (string, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", err
+	}
+
+	gpgDir, err := os.MkdirTemp(dir, "gpg.")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create gpg directory: %w", err)
+	}
+
+	return gpgDir, nil
+}
+
+// GPGFingerprints returns the key fingerprints listed in the output of gpg.
+func GPGFingerprints(output string) []string {
+	var fingerprints []string
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		if len(line) != 40 ||
+			strings.HasPrefix(line, "/") ||
+			strings.HasPrefix(line, "-") ||
+			strings.HasPrefix(line, "pub") ||
+			strings.HasPrefix(line, "sec") ||
+			strings.HasPrefix(line, "sub") ||
+			strings.HasPrefix(line, "ssb") ||
+			strings.HasPrefix(line, "uid") {
+			continue
+		}
+
+		fingerprints = append(fingerprints, line)
+	}
+
+	return fingerprints
+}
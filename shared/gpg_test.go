@@ -0,0 +1,24 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGPGFingerprints(t *testing.T) {
+	output := `/tmp/gpg.123/pubring.kbx
+------------------------
+sec   ed25519 2024-01-01 [SC]
+      A1BD8E9D78F7FE5C3E65D8AF8B48AD6246925553
+uid           [ultimate] test@example.com
+
+pub   rsa4096 2024-01-01 [SC]
+      F6ECB3762474EDA9D21B7022871920D1991BC93C
+uid           [ unknown] Other <other@example.com>
+sub   rsa4096 2024-01-01 [E]
+`
+
+	require.Equal(t, []string{"A1BD8E9D78F7FE5C3E65D8AF8B48AD6246925553", "F6ECB3762474EDA9D21B7022871920D1991BC93C"}, GPGFingerprints(output))
+	require.Nil(t, GPGFingerprints("gpg: no valid OpenPGP data found."))
+}
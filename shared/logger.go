@@ -1,25 +1,33 @@
 package shared
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/sirupsen/logrus"
 )
 
-// GetLogger returns a new logger.
-func GetLogger(debug bool) (*logrus.Logger, error) {
+// GetLogger returns a new logger. The format can be either text or json.
+func GetLogger(debug bool, format string) (*logrus.Logger, error) {
 	logger := logrus.StandardLogger()
 
 	logger.SetOutput(os.Stdout)
 
-	formatter := logrus.TextFormatter{
-		FullTimestamp: true,
-		PadLevelText:  true,
-	}
+	switch format {
+	case "text":
+		formatter := logrus.TextFormatter{
+			FullTimestamp: true,
+			PadLevelText:  true,
+		}
 
-	formatter.EnvironmentOverrideColors = true
+		formatter.EnvironmentOverrideColors = true
 
-	logger.Formatter = &formatter
+		logger.Formatter = &formatter
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	default:
+		return nil, fmt.Errorf("Unknown log format %q", format)
+	}
 
 	if debug {
 		logger.Level = logrus.DebugLevel
@@ -2,6 +2,7 @@ package shared
 
 import (
 	"fmt"
+	"slices"
 
 	"github.com/lxc/incus/v7/shared/osarch"
 )
@@ -93,6 +94,19 @@ var distroArchitecture = map[string]map[int]string{
 	"slackware":   slackwareArchitectureNames,
 }
 
+// ArchitectureMaps returns the names of all architecture maps.
+func ArchitectureMaps() []string {
+	names := make([]string, 0, len(distroArchitecture))
+
+	for name := range distroArchitecture {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
 // GetArch returns the correct architecture name used by the specified
 // distribution.
 func GetArch(distro, arch string) (string, error) {
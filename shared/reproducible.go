@@ -0,0 +1,125 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SourceDateEpoch returns the time set in the SOURCE_DATE_EPOCH environment
+// variable, which is used for all timestamps in reproducible builds.
+func SourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, errors.New("SOURCE_DATE_EPOCH isn't set")
+	}
+
+	epoch, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || epoch < 0 {
+		return time.Time{}, fmt.Errorf("Invalid SOURCE_DATE_EPOCH %q", value)
+	}
+
+	return time.Unix(epoch, 0).UTC(), nil
+}
+
+// IsReproducible returns whether the context belongs to a reproducible build.
+func IsReproducible(ctx context.Context) bool {
+	_, ok := ctx.Value(ContextKeySourceDateEpoch).(time.Time)
+
+	return ok
+}
+
+// BuildTime returns the time of reproducible builds, and the current time
+// otherwise.
+func BuildTime(ctx context.Context) time.Time {
+	t, ok := ctx.Value(ContextKeySourceDateEpoch).(time.Time)
+	if ok {
+		return t
+	}
+
+	return time.Now()
+}
+
+// reproducibleTarArgs returns the tar arguments for reproducible builds.
+func reproducibleTarArgs(ctx context.Context) []string {
+	if !IsReproducible(ctx) {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("--mtime=@%d", BuildTime(ctx).Unix()), "--clamp-mtime",
+		// The default name of the extended headers contains the process ID.
+		"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime",
+	}
+}
+
+// ClampMtimes sets the modification time of all files in root which are newer
+// than t to t.
+func ClampMtimes(root string, t time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(t.UnixNano()), unix.NsecToTimespec(t.UnixNano())}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if !info.ModTime().After(t) {
+			return nil
+		}
+
+		err = unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return fmt.Errorf("Failed to set times of %q: %w", path, err)
+		}
+
+		return nil
+	})
+}
+
+// StripNondeterminism removes the files of the rootfs which differ between
+// builds, like the machine ID. The machine ID is emptied rather than removed,
+// so that systemd generates a new one on first boot.
+func StripNondeterminism(rootfs string) error {
+	machineID := filepath.Join(rootfs, "etc", "machine-id")
+
+	info, err := os.Lstat(machineID)
+	if err == nil && info.Mode().IsRegular() {
+		err = os.Truncate(machineID, 0)
+		if err != nil {
+			return fmt.Errorf("Failed to truncate %q: %w", machineID, err)
+		}
+	}
+
+	for _, path := range []string{
+		"var/lib/dbus/machine-id",
+		"var/lib/systemd/random-seed",
+		"var/cache/ldconfig/aux-cache",
+	} {
+		path = filepath.Join(rootfs, path)
+
+		// Keep symlinks, like the D-Bus machine ID pointing to /etc/machine-id.
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceDateEpoch(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr string
+	}{
+		{"", time.Time{}, "SOURCE_DATE_EPOCH isn't set"},
+		{"abc", time.Time{}, `Invalid SOURCE_DATE_EPOCH "abc"`},
+		{"-1", time.Time{}, `Invalid SOURCE_DATE_EPOCH "-1"`},
+		{"1700000000", time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("SOURCE_DATE_EPOCH", tt.value)
+
+			got, err := SourceDateEpoch()
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBuildTime(t *testing.T) {
+	ctx := context.Background()
+
+	require.False(t, IsReproducible(ctx))
+	require.Nil(t, reproducibleTarArgs(ctx))
+	require.WithinDuration(t, time.Now(), BuildTime(ctx), time.Minute)
+
+	epoch := time.Unix(1700000000, 0).UTC()
+	ctx = context.WithValue(ctx, ContextKeySourceDateEpoch, epoch)
+
+	require.True(t, IsReproducible(ctx))
+	require.Equal(t, epoch, BuildTime(ctx))
+	require.Contains(t, reproducibleTarArgs(ctx), "--mtime=@1700000000")
+}
+
+func TestClampMtimes(t *testing.T) {
+	root := t.TempDir()
+	epoch := time.Unix(1700000000, 0)
+	old := time.Unix(1600000000, 0)
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "new"), nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "old"), nil, 0o644))
+	require.NoError(t, os.Chtimes(filepath.Join(root, "old"), old, old))
+	require.NoError(t, os.Symlink("/nonexistent", filepath.Join(root, "link")))
+
+	err := ClampMtimes(root, epoch)
+	require.NoError(t, err)
+
+	for name, want := range map[string]time.Time{"new": epoch, "old": old, "link": epoch} {
+		info, err := os.Lstat(filepath.Join(root, name))
+		require.NoError(t, err)
+		require.True(t, want.Equal(info.ModTime()), name)
+	}
+}
+
+func TestStripNondeterminism(t *testing.T) {
+	rootfs := t.TempDir()
+
+	for _, dir := range []string{"etc", "var/lib/dbus", "var/lib/systemd"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(rootfs, dir), 0o755))
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc/machine-id"), []byte("1234\n"), 0o444))
+	require.NoError(t, os.Symlink("/etc/machine-id", filepath.Join(rootfs, "var/lib/dbus/machine-id")))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "var/lib/systemd/random-seed"), []byte("seed"), 0o600))
+
+	err := StripNondeterminism(rootfs)
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(rootfs, "etc/machine-id"))
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	_, err = os.Lstat(filepath.Join(rootfs, "var/lib/dbus/machine-id"))
+	require.NoError(t, err)
+
+	require.NoFileExists(t, filepath.Join(rootfs, "var/lib/systemd/random-seed"))
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -21,12 +23,23 @@ import (
 )
 
 const (
-	ContextKeyEnviron = ContextKey("environ")
-	ContextKeyStderr  = ContextKey("stderr")
-	EnvRootUUID       = "DISTROBUILDER_ROOT_UUID"
-	EnvRootPARTUUID   = "DISTROBUILDER_ROOT_PARTUUID"
+	ContextKeyCgroup          = ContextKey("cgroup")
+	ContextKeyEnviron         = ContextKey("environ")
+	ContextKeyEvents          = ContextKey("events")
+	ContextKeyOfflineTriggers = ContextKey("offline-triggers")
+	ContextKeySourceDateEpoch = ContextKey("source-date-epoch")
+	ContextKeyStderr          = ContextKey("stderr")
+	ContextKeyStdout          = ContextKey("stdout")
+	EnvRootUUID               = "DISTROBUILDER_ROOT_UUID"
+	EnvRootPARTUUID           = "DISTROBUILDER_ROOT_PARTUUID"
+	EnvRootfs                 = "DISTROBUILDER_ROOTFS"
+	EnvTargetDir              = "DISTROBUILDER_TARGET_DIR"
+	EnvArtifacts              = "DISTROBUILDER_ARTIFACTS"
 )
 
+// maxRetryDelay is the longest delay between two attempts of RetryBackoff.
+const maxRetryDelay = time.Minute
+
 // EnvVariable represents a environment variable.
 type EnvVariable struct {
 	Value string
@@ -148,16 +161,35 @@ func Copy(src, dest string) error {
 
 // RunCommand runs a command. Stdout is written to the given io.Writer. If nil, it's written to the real stdout. Stderr is always written to the real stderr.
 func RunCommand(ctx context.Context, stdin io.Reader, stdout io.Writer, name string, arg ...string) error {
+	return newCommand(ctx, stdin, stdout, name, arg...).Run()
+}
+
+// newCommand returns the command run by RunCommand.
+func newCommand(ctx context.Context, stdin io.Reader, stdout io.Writer, name string, arg ...string) *exec.Cmd {
 	cmd := exec.CommandContext(ctx, name, arg...)
 	env, ok := ctx.Value(ContextKeyEnviron).([]string)
 	if ok && len(env) > 0 {
 		cmd.Env = append(os.Environ(), env...)
 	}
 
+	// Commands are started in the cgroup of the build, so that they can't
+	// escape its limits.
+	cgroup, ok := ctx.Value(ContextKeyCgroup).(*Cgroup)
+	if ok && cgroup != nil {
+		cmd.SysProcAttr = &unix.SysProcAttr{
+			UseCgroupFD: true,
+			CgroupFD:    int(cgroup.dir.Fd()),
+		}
+	}
+
 	if stdin != nil {
 		cmd.Stdin = stdin
 	}
 
+	if stdout == nil {
+		stdout, _ = ctx.Value(ContextKeyStdout).(io.Writer)
+	}
+
 	if stdout != nil {
 		cmd.Stdout = stdout
 	} else {
@@ -171,13 +203,19 @@ func RunCommand(ctx context.Context, stdin io.Reader, stdout io.Writer, name str
 		cmd.Stderr = os.Stderr
 	}
 
-	return cmd.Run()
+	return cmd
 }
 
 // RunScript runs a script hereby setting the SHELL and PATH env variables,
 // and redirecting the process's stdout and stderr to the real stdout and stderr
 // respectively.
 func RunScript(ctx context.Context, content string) error {
+	return runScript(ctx, content, "", false)
+}
+
+// runScript runs a script, either in the active chroot or on the host. If an
+// interpreter is set, the script is passed to it rather than executed.
+func runScript(ctx context.Context, content string, interpreter string, host bool) error {
 	fd, err := unix.MemfdCreate("tmp", 0)
 	if err != nil {
 		return fmt.Errorf("Failed to create memfd: %w", err)
@@ -191,13 +229,184 @@ func RunScript(ctx context.Context, content string) error {
 	}
 
 	fdPath := fmt.Sprintf("/proc/self/fd/%d", fd)
+	name := fdPath
+	var args []string
+
+	// The interpreter is looked up by env, as host actions only see the
+	// host's PATH once they have been started.
+	if interpreter != "" {
+		name = "/usr/bin/env"
+		args = append(strings.Fields(interpreter), fdPath)
+	}
+
+	cmd := newCommand(ctx, nil, nil, name, args...)
 
-	return RunCommand(ctx, nil, nil, fdPath)
+	// The script runs in its own process group, which is killed as a whole
+	// once the context is done. Processes which escape it, and still hold
+	// the output pipes, are only waited for a little while.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &unix.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+	}
+
+	cmd.WaitDelay = 5 * time.Second
+
+	if host {
+		runOnHost(cmd)
+	}
+
+	return cmd.Run()
+}
+
+// runWithoutNetwork runs f in a new network namespace which only has the
+// loopback interface. Processes started by f inherit the network namespace.
+func runWithoutNetwork(f func() error) error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		// The thread isn't unlocked again, so that it's terminated together
+		// with the goroutine rather than reused in the network namespace.
+		runtime.LockOSThread()
+
+		err := unix.Unshare(unix.CLONE_NEWNET)
+		if err != nil {
+			errCh <- fmt.Errorf("Failed to create network namespace: %w", err)
+			return
+		}
+
+		err = setLinkUp("lo")
+		if err != nil {
+			errCh <- fmt.Errorf("Failed to bring up loopback interface: %w", err)
+			return
+		}
+
+		errCh <- f()
+	}()
+
+	return <-errCh
+}
+
+// setLinkUp brings up the network interface.
+func setLinkUp(name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(fd)
+
+	ifreq, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+
+	err = unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq)
+	if err != nil {
+		return err
+	}
+
+	ifreq.SetUint16(ifreq.Uint16() | unix.IFF_UP)
+
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifreq)
+}
+
+// RunAction runs the script of an action, and records an action-run event.
+// Host actions which are run from within a chroot get the path of the chroot
+// on the host in the DISTROBUILDER_ROOTFS environment variable. Failed
+// actions are retried as often as set, doubling the delay between attempts.
+// Actions without network access, either set in the action or by the offline
+// triggers of the context, run in a network namespace with only loopback.
+func RunAction(ctx context.Context, trigger string, action DefinitionAction) error {
+	start := time.Now()
+
+	network := action.Network
+	if network == "" {
+		offlineTriggers, _ := ctx.Value(ContextKeyOfflineTriggers).([]string)
+		if slices.Contains(offlineTriggers, trigger) {
+			network = ActionNetworkNone
+		}
+	}
+
+	var timeout time.Duration
+
+	if action.Timeout != "" {
+		var err error
+
+		timeout, err = time.ParseDuration(action.Timeout)
+		if err != nil {
+			return fmt.Errorf("Failed to parse timeout %q: %w", action.Timeout, err)
+		}
+	}
+
+	if len(action.Env) > 0 {
+		env, _ := ctx.Value(ContextKeyEnviron).([]string)
+		env = slices.Clone(env)
+
+		for _, key := range slices.Sorted(maps.Keys(action.Env)) {
+			env = append(env, fmt.Sprintf("%s=%s", key, action.Env[key]))
+		}
+
+		ctx = context.WithValue(ctx, ContextKeyEnviron, env)
+	}
+
+	err := RetryBackoff(func() error {
+		runCtx := ctx
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+
+			runCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		run := func() error {
+			return runScript(runCtx, action.Action, action.Interpreter, action.Host)
+		}
+
+		var err error
+
+		if network == ActionNetworkNone {
+			err = runWithoutNetwork(run)
+		} else {
+			err = run()
+		}
+
+		if err != nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("Timed out after %s: %w", timeout, err)
+		}
+
+		return err
+	}, action.Retries+1, time.Second)
+
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+	}
+
+	RecordEvent(ctx, Event{
+		Type:     EventActionRun,
+		Trigger:  trigger,
+		ExitCode: &exitCode,
+		Duration: time.Since(start).Seconds(),
+	})
+
+	return err
 }
 
 // Pack creates an uncompressed tarball.
 func Pack(ctx context.Context, filename, compression, path string, args ...string) (string, error) {
-	err := RunCommand(ctx, nil, nil, "tar", append([]string{"--xattrs", "-cf", filename, "-C", path, "--sort=name"}, args...)...)
+	tarArgs := append([]string{"--xattrs", "-cf", filename, "-C", path, "--sort=name"}, reproducibleTarArgs(ctx)...)
+
+	err := RunCommand(ctx, nil, nil, "tar", append(tarArgs, args...)...)
 	if err != nil {
 		// Clean up incomplete tarball
 		os.Remove(filename)
@@ -209,7 +418,9 @@ func Pack(ctx context.Context, filename, compression, path string, args ...strin
 
 // PackUpdate updates an existing tarball.
 func PackUpdate(ctx context.Context, filename, compression, path string, args ...string) (string, error) {
-	err := RunCommand(ctx, nil, nil, "tar", append([]string{"--xattrs", "-uf", filename, "-C", path, "--sort=name"}, args...)...)
+	tarArgs := append([]string{"--xattrs", "-uf", filename, "-C", path, "--sort=name"}, reproducibleTarArgs(ctx)...)
+
+	err := RunCommand(ctx, nil, nil, "tar", append(tarArgs, args...)...)
 	if err != nil {
 		return "", fmt.Errorf("Failed to update tarball: %w", err)
 	}
@@ -236,8 +447,21 @@ func compressTarball(ctx context.Context, filename, compression string) (string,
 		args = append(args, "-"+strconv.Itoa(*level))
 	}
 
-	// If supported, use as many threads as possible.
-	if slices.Contains([]string{"zstd", "xz", "lzma"}, compression) {
+	if IsReproducible(ctx) {
+		// The output of multi-threaded compression depends on the number of
+		// threads, and some compressors store the name and time of the file.
+		if compression == "gzip" {
+			args = append(args, "-n")
+		}
+
+		buildTime := BuildTime(ctx)
+
+		err = os.Chtimes(filename, buildTime, buildTime)
+		if err != nil {
+			return "", fmt.Errorf("Failed to set times of %q: %w", filename, err)
+		}
+	} else if slices.Contains([]string{"zstd", "xz", "lzma"}, compression) {
+		// If supported, use as many threads as possible.
 		args = append(args, "--threads=0")
 	}
 
@@ -327,6 +551,20 @@ func RenderTemplate(template string, iface interface{}) (string, error) {
 		return "", fmt.Errorf("Failed unmarshalling data: %w", err)
 	}
 
+	// Templates only see the values of the variables matching the filters
+	var def *Definition
+
+	switch v := iface.(type) {
+	case Definition:
+		def = &v
+	case *Definition:
+		def = v
+	}
+
+	if def != nil {
+		ctx["variables"] = def.GetVariables()
+	}
+
 	// Load template from string
 	tpl, err := pongo2.FromString("{% autoescape off %}" + template + "{% endautoescape %}")
 	if err != nil {
@@ -384,6 +622,16 @@ func RsyncLocal(ctx context.Context, src string, dest string) error {
 
 // Retry retries a function up to <attempts> times. This is especially useful for networking.
 func Retry(f func() error, attempts uint) error {
+	return retry(f, attempts, time.Second, false)
+}
+
+// RetryBackoff retries a function up to <attempts> times, doubling the delay
+// after each attempt up to a minute.
+func RetryBackoff(f func() error, attempts uint, delay time.Duration) error {
+	return retry(f, attempts, delay, true)
+}
+
+func retry(f func() error, attempts uint, delay time.Duration, backoff bool) error {
 	var err error
 
 	for i := uint(0); i < attempts; i++ {
@@ -393,7 +641,15 @@ func Retry(f func() error, attempts uint) error {
 			break
 		}
 
-		time.Sleep(time.Second)
+		if i+1 == attempts {
+			break
+		}
+
+		time.Sleep(delay)
+
+		if backoff {
+			delay = min(delay*2, maxRetryDelay)
+		}
 	}
 
 	return err
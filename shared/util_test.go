@@ -1,11 +1,15 @@
 package shared
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/flosch/pongo2/v4"
 	"github.com/stretchr/testify/require"
@@ -31,6 +35,23 @@ func TestRenderTemplate(t *testing.T) {
 			"Ubuntu Bionic",
 			false,
 		},
+		{
+			"valid template with variables",
+			&Definition{
+				Image: DefinitionImage{
+					Variant: "cloud",
+				},
+				Variables: map[string]DefinitionVariable{
+					"foo": {
+						{Value: "bar"},
+						{Value: "baz", DefinitionFilter: DefinitionFilter{Variants: []string{"cloud"}}},
+					},
+				},
+			},
+			"{{ variables.foo }}",
+			"baz",
+			false,
+		},
 		{
 			"valid template without yaml tags",
 			pongo2.Context{
@@ -115,6 +136,82 @@ func TestSetEnvVariables(t *testing.T) {
 	require.Empty(t, val)
 }
 
+func TestRunAction(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "attempts")
+
+	// Failed actions are retried.
+	err := RunAction(context.Background(), "post-packages", DefinitionAction{
+		Action:  fmt.Sprintf("#!/bin/sh\necho x >> %s\n[ $(wc -l < %s) -ge 2 ]\n", counter, counter),
+		Retries: 2,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(counter)
+	require.NoError(t, err)
+	require.Equal(t, "x\nx\n", string(content))
+
+	// The environment and interpreter are set.
+	err = RunAction(context.Background(), "post-packages", DefinitionAction{
+		Action:      "test \"${FOO}\" = bar\n",
+		Interpreter: "sh -e",
+		Env:         map[string]string{"FOO": "bar"},
+	})
+	require.NoError(t, err)
+
+	// Actions are killed once they time out.
+	err = RunAction(context.Background(), "post-packages", DefinitionAction{
+		Action:  "#!/bin/sh\nexec sleep 10\n",
+		Timeout: "100ms",
+	})
+	require.ErrorContains(t, err, "Timed out after 100ms")
+
+	// Child processes are killed as well, even if they hold the output pipe.
+	var stdout bytes.Buffer
+
+	start := time.Now()
+	err = RunAction(context.WithValue(context.Background(), ContextKeyStdout, &stdout), "post-packages", DefinitionAction{
+		Action:  "#!/bin/sh\nsleep 10 &\nexec sleep 10\n",
+		Timeout: "100ms",
+	})
+	require.ErrorContains(t, err, "Timed out after 100ms")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRunActionNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Network namespaces require root")
+	}
+
+	// Only the loopback interface is available without network.
+	onlyLoopback := "#!/bin/sh\n[ \"$(tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' ')\" = lo ]\n"
+
+	err := RunAction(context.Background(), "post-files", DefinitionAction{Action: onlyLoopback, Network: ActionNetworkNone})
+	require.NoError(t, err)
+
+	// Offline triggers apply to actions which don't set a network.
+	ctx := context.WithValue(context.Background(), ContextKeyOfflineTriggers, []string{"post-files"})
+
+	err = RunAction(ctx, "post-files", DefinitionAction{Action: onlyLoopback})
+	require.NoError(t, err)
+
+	err = RunAction(ctx, "post-files", DefinitionAction{Action: onlyLoopback, Network: ActionNetworkHost})
+	require.Error(t, err)
+}
+
+func TestRunActionHost(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.WithValue(context.Background(), ContextKeyEnviron, []string{fmt.Sprintf("%s=%s", EnvRootfs, dir)})
+
+	// Outside of a chroot, host actions run like any other action.
+	err := RunAction(ctx, "pre-unpack", DefinitionAction{
+		Action: "#!/bin/sh\ntouch \"${DISTROBUILDER_ROOTFS}/hello\"\n",
+		Host:   true,
+	})
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dir, "hello"))
+}
+
 func TestParseCompression(t *testing.T) {
 	tests := []struct {
 		compression         string
@@ -135,6 +135,10 @@ func (s *common) DownloadHash(def shared.DefinitionImage, file, checksum string,
 			if hash == "" {
 				return "", fmt.Errorf("Hash mismatch for %s: %s != %v", imagePath, result, hashes)
 			}
+
+			shared.RecordEvent(s.ctx, shared.Event{Type: shared.EventSourceDownloaded, URL: file, Checksum: hash})
+		} else {
+			shared.RecordEvent(s.ctx, shared.Event{Type: shared.EventSourceDownloaded, URL: file})
 		}
 
 		return destDir, nil
@@ -154,6 +158,9 @@ func (s *common) DownloadHash(def shared.DefinitionImage, file, checksum string,
 	done := make(chan struct{})
 	defer close(done)
 
+	// The hash the downloaded file matched, if any.
+	var verified string
+
 	if checksum == "" {
 		err = shared.Retry(func() error {
 			_, err = incus.DownloadFileHash(s.ctx, s.client, "distrobuilder", progress, nil, imagePath, file, "", nil, image)
@@ -173,6 +180,7 @@ func (s *common) DownloadHash(def shared.DefinitionImage, file, checksum string,
 
 				_, err = incus.DownloadFileHash(s.ctx, s.client, "distrobuilder", progress, nil, imagePath, file, h, hashFunc, image)
 				if err == nil {
+					verified = h
 					break
 				}
 			}
@@ -190,6 +198,8 @@ func (s *common) DownloadHash(def shared.DefinitionImage, file, checksum string,
 
 	fmt.Println("")
 
+	shared.RecordEvent(s.ctx, shared.Event{Type: shared.EventSourceDownloaded, URL: file, Checksum: verified})
+
 	return destDir, nil
 }
 
@@ -243,17 +253,7 @@ func (s *common) VerifyFile(signedFile, signatureFile string) (bool, error) {
 
 // CreateGPGKeyring creates a new GPG keyring.
 func (s *common) CreateGPGKeyring() (string, error) {
-	err := os.MkdirAll(s.getTargetDir(), 0o700)
-	if err != nil {
-		return "", err
-	}
-
-	gpgDir, err := os.MkdirTemp(s.getTargetDir(), "gpg.")
-	if err != nil {
-		return "", fmt.Errorf("Failed to create gpg directory: %w", err)
-	}
-
-	err = os.MkdirAll(gpgDir, 0o700)
+	gpgDir, err := shared.CreateGPGHome(s.getTargetDir())
 	if err != nil {
 		return "", err
 	}
@@ -283,6 +283,14 @@ func (s *common) CreateGPGKeyring() (string, error) {
 		return "", fmt.Errorf("Failed to export keyring: %s: %w", out.String(), err)
 	}
 
+	fingerprints, err := listFingerprints(s.ctx, gpgDir)
+	if err != nil {
+		os.RemoveAll(gpgDir)
+		return "", fmt.Errorf("Failed to list keys: %w", err)
+	}
+
+	shared.RecordEvent(s.ctx, shared.Event{Type: shared.EventKeysImported, Fingerprints: fingerprints})
+
 	return filepath.Join(gpgDir, "distrobuilder.gpg"), nil
 }
 
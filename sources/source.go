@@ -3,6 +3,7 @@ package sources
 import (
 	"context"
 	"errors"
+	"slices"
 
 	"github.com/sirupsen/logrus"
 
@@ -53,6 +54,19 @@ var downloaders = map[string]func() downloader{
 	"slackware-http":       func() downloader { return &slackware{} },
 }
 
+// Names returns the names of all downloaders.
+func Names() []string {
+	names := make([]string, 0, len(downloaders))
+
+	for name := range downloaders {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
 // Load loads and initializes a downloader.
 func Load(ctx context.Context, downloaderName string, logger *logrus.Logger, definition shared.Definition, rootfsDir string, cacheDir string, sourcesDir string) (Downloader, error) {
 	df, ok := downloaders[downloaderName]
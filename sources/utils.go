@@ -10,13 +10,14 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"slices"
 	"strings"
 
 	incus "github.com/lxc/incus/v7/shared/util"
+
+	"github.com/lxc/distrobuilder/v3/shared"
 )
 
 // downloadChecksum downloads or opens URL, and matches fname against the
@@ -137,14 +138,8 @@ func getChecksum(fname string, hashLen int, r io.Reader) []string {
 	return nil
 }
 
-func gpgCommandContext(ctx context.Context, gpgDir string, args ...string) (cmd *exec.Cmd) {
-	cmd = exec.CommandContext(ctx, "gpg", append([]string{"--homedir", gpgDir}, args...)...)
-	cmd.Env = append(os.Environ(), "LANG=C.UTF-8")
-	return cmd
-}
-
 func showFingerprint(ctx context.Context, gpgDir string, publicKey string) (fingerprint string, err error) {
-	cmd := gpgCommandContext(ctx, gpgDir, "--show-keys")
+	cmd := shared.GPGCommand(ctx, gpgDir, "--show-keys")
 	cmd.Stdin = strings.NewReader(publicKey)
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
@@ -155,36 +150,19 @@ func showFingerprint(ctx context.Context, gpgDir string, publicKey string) (fing
 		return fingerprint, err
 	}
 
-	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if notFingerprint(line) {
-			continue
-		}
-
-		fingerprint = line
-		return fingerprint, err
-	}
-
-	if fingerprint == "" {
+	fingerprints := shared.GPGFingerprints(stdout.String())
+	if len(fingerprints) == 0 {
+		lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
 		err = fmt.Errorf("failed to get fingerprint from public key: %s, %v", publicKey, lines)
 		return fingerprint, err
 	}
 
+	fingerprint = fingerprints[0]
 	return fingerprint, err
 }
 
-func notFingerprint(line string) bool {
-	return len(line) != 40 ||
-		strings.HasPrefix(line, "/") ||
-		strings.HasPrefix(line, "-") ||
-		strings.HasPrefix(line, "pub") ||
-		strings.HasPrefix(line, "sub") ||
-		strings.HasPrefix(line, "uid")
-}
-
 func listFingerprints(ctx context.Context, gpgDir string) (fingerprints []string, err error) {
-	cmd := gpgCommandContext(ctx, gpgDir, "--list-keys")
+	cmd := shared.GPGCommand(ctx, gpgDir, "--list-keys")
 	var buffer bytes.Buffer
 	cmd.Stdout = &buffer
 	err = cmd.Run()
@@ -192,16 +170,7 @@ func listFingerprints(ctx context.Context, gpgDir string) (fingerprints []string
 		return fingerprints, err
 	}
 
-	lines := strings.Split(buffer.String(), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if notFingerprint(line) {
-			continue
-		}
-
-		fingerprints = append(fingerprints, line)
-	}
-
+	fingerprints = shared.GPGFingerprints(buffer.String())
 	return fingerprints, err
 }
 
@@ -214,7 +183,7 @@ func importPublicKeys(ctx context.Context, gpgDir string, publicKeys []string) e
 			return err
 		}
 
-		cmd := gpgCommandContext(ctx, gpgDir, "--import")
+		cmd := shared.GPGCommand(ctx, gpgDir, "--import")
 		cmd.Stdin = strings.NewReader(f)
 
 		var buffer bytes.Buffer
@@ -253,7 +222,7 @@ func recvFingerprints(ctx context.Context, gpgDir string, keyserver string, fing
 	}
 
 	args = append(args, "--recv-keys")
-	cmd := gpgCommandContext(ctx, gpgDir, append(args, fingerprints...)...)
+	cmd := shared.GPGCommand(ctx, gpgDir, append(args, fingerprints...)...)
 	var buffer bytes.Buffer
 	cmd.Stderr = &buffer
 